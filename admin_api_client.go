@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// adminApiTimeout is how long a request to the admin API of the running server can take.
+const adminApiTimeout = time.Second * 30
+
+/// adminApiClient calls the admin API of the running server at BASE_URL, for commands run while the server has the
+/// database open.
+type adminApiClient struct {
+	urls     *UrlBuilder
+	username string
+	password string
+	client   *http.Client
+}
+
+func newAdminApiClient(urls *UrlBuilder, configuration *config.Config) *adminApiClient {
+	return &adminApiClient{
+		urls: urls,
+		username: configuration.AdminUsername,
+		password: configuration.AdminPassword,
+		client: &http.Client{
+			Timeout: adminApiTimeout,
+		},
+	}
+}
+
+/// listSubscribers gets the subscribers with the given status, or every subscriber if it is empty.
+func (client *adminApiClient) listSubscribers(status storage.SubscriberStatus) ([]storage.Subscriber, error) {
+	var subscribers []storage.Subscriber
+
+	err := client.do("GET", "admin_api_list_subscribers", nil, &subscribers, "status", string(status))
+
+	return subscribers, err
+}
+
+/// addSubscriber subscribes an email address without asking it to confirm the subscription.
+func (client *adminApiClient) addSubscriber(emailAddress, name string, frequency storage.SubscriberFrequency) error {
+	return client.do("POST", "admin_api_add_subscriber", &addSubscriberRequest{
+		EmailAddress: emailAddress,
+		Name: name,
+		Frequency: frequency,
+	}, nil)
+}
+
+/// removeSubscriber unsubscribes an email address.
+func (client *adminApiClient) removeSubscriber(emailAddress string) error {
+	return client.do("DELETE", "admin_api_remove_subscriber", nil, nil, "email_address", emailAddress)
+}
+
+/// checkFeed queues a check of the feed for the server to run.
+func (client *adminApiClient) checkFeed() (*feedCheckResponse, error) {
+	response := &feedCheckResponse{}
+
+	err := client.do("POST", "admin_api_check_feed", struct{}{}, response)
+
+	return response, err
+}
+
+/// do sends a request to a named route of the admin API, sending the request body as JSON if it isn't nil and decoding
+/// the JSON response into the result if it isn't nil.
+func (client *adminApiClient) do(method, routeName string, requestBody, result interface{}, pairs ...string) error {
+	url, err := client.urls.Url(routeName, pairs...)
+
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader
+
+	if requestBody != nil {
+		content, err := json.Marshal(requestBody)
+
+		if err != nil {
+			return err
+		}
+
+		body = bytes.NewReader(content)
+	}
+
+	request, err := http.NewRequest(method, url, body)
+
+	if err != nil {
+		return err
+	}
+
+	if requestBody != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	request.SetBasicAuth(client.username, client.password)
+
+	response, err := client.client.Do(request)
+
+	if err != nil {
+		return fmt.Errorf("calling the server's admin API: %s", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		var apiError apiErrorResponse
+
+		if json.NewDecoder(response.Body).Decode(&apiError) == nil && len(apiError.Error) > 0 {
+			return fmt.Errorf("the server's admin API responded with status %s: %s", response.Status, apiError.Error)
+		}
+
+		return fmt.Errorf("the server's admin API responded with status %s", response.Status)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/mybb/mybb-blog-mailer/logging"
+	"github.com/mybb/mybb-blog-mailer/mail"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// maxAdminApiRequestSize is the largest body accepted by the admin API.
+const maxAdminApiRequestSize = 1 << 16
+
+/// adminApiPaths lists the paths of the admin API, which is called by commands run from the shell while the server has
+/// the database open rather than by a browser.
+///
+/// Requests to the API can't carry a CSRF token, so instead requests changing anything must have a JSON body, which a
+/// page on another site can't send without the browser first asking permission.
+var adminApiPaths = []string{
+	"/admin/api/subscribers",
+	"/admin/api/feed-checks",
+}
+
+/// addSubscriberRequest is the body of a request to add a subscriber through the admin API.
+type addSubscriberRequest struct {
+	EmailAddress string                      `json:"email_address"`
+	Name         string                      `json:"name"`
+	Frequency    storage.SubscriberFrequency `json:"frequency"`
+}
+
+/// feedCheckResponse is the response to a request to check the feed through the admin API.
+type feedCheckResponse struct {
+	JobId uint64 `json:"job_id"`
+}
+
+/// apiErrorResponse is the body of a response to a failed request to the admin API.
+type apiErrorResponse struct {
+	Error string `json:"error"`
+}
+
+/// ApiListSubscribers handles a GET request to /admin/api/subscribers, listing the subscribers with the status given by
+/// the status query parameter, or every subscriber if it is empty.
+func (adminService *AdminService) ApiListSubscribers(w http.ResponseWriter, r *http.Request) {
+	subscribers, err := adminService.store.ListSubscribers(storage.SubscriberStatus(r.URL.Query().Get("status")))
+
+	if err != nil {
+		logging.FromContext(r.Context(), adminService.logger).Error("error listing subscribers", logging.Error(err))
+
+		writeJson(w, http.StatusInternalServerError, apiErrorResponse{"Error listing subscribers"})
+		return
+	}
+
+	writeJson(w, http.StatusOK, subscribers)
+}
+
+/// ApiAddSubscriber handles a POST request to /admin/api/subscribers, subscribing an email address without asking it
+/// to confirm the subscription. A suppressed subscriber is refused with a 409 status.
+func (adminService *AdminService) ApiAddSubscriber(w http.ResponseWriter, r *http.Request) {
+	if !hasJsonBody(r) {
+		writeJson(w, http.StatusUnsupportedMediaType, apiErrorResponse{"Request body must be JSON"})
+		return
+	}
+
+	var request addSubscriberRequest
+
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminApiRequestSize)).Decode(&request); err != nil {
+		writeJson(w, http.StatusBadRequest, apiErrorResponse{fmt.Sprintf("Invalid request body: %s", err)})
+		return
+	}
+
+	if valid, err := mail.ValidateEmailAddress(request.EmailAddress); !valid {
+		writeJson(w, http.StatusBadRequest, apiErrorResponse{fmt.Sprintf("Invalid email address: %s", err)})
+		return
+	}
+
+	switch request.Frequency {
+	case "":
+		request.Frequency = storage.FrequencyEveryPost
+	case storage.FrequencyEveryPost, storage.FrequencyWeeklyDigest:
+	default:
+		writeJson(w, http.StatusBadRequest, apiErrorResponse{fmt.Sprintf("Unknown frequency '%s'", request.Frequency)})
+		return
+	}
+
+	err := adminService.subService.subscribe(r.Context(), request.EmailAddress, request.Name, "", request.Frequency)
+
+	if _, ok := err.(storage.SuppressedError); ok {
+		writeJson(w, http.StatusConflict, apiErrorResponse{"Subscriber is suppressed, as emails to it bounced or were " +
+			"reported as spam"})
+		return
+	}
+
+	if err != nil {
+		logging.FromContext(r.Context(), adminService.logger).Error("error saving subscriber",
+			logging.Email(request.EmailAddress), logging.Error(err))
+
+		writeJson(w, http.StatusInternalServerError, apiErrorResponse{"Error saving subscriber"})
+		return
+	}
+
+	subscriber, err := adminService.store.GetSubscriber(request.EmailAddress)
+
+	if err != nil {
+		logging.FromContext(r.Context(), adminService.logger).Error("error reading saved subscriber",
+			logging.Email(request.EmailAddress), logging.Error(err))
+
+		writeJson(w, http.StatusInternalServerError, apiErrorResponse{"Error reading saved subscriber"})
+		return
+	}
+
+	writeJson(w, http.StatusCreated, subscriber)
+}
+
+/// ApiRemoveSubscriber handles a DELETE request to /admin/api/subscribers, unsubscribing the email address given by the
+/// email_address query parameter and keeping the subscriber on record as unsubscribed.
+func (adminService *AdminService) ApiRemoveSubscriber(w http.ResponseWriter, r *http.Request) {
+	emailAddress := r.URL.Query().Get("email_address")
+
+	if _, err := adminService.store.GetSubscriber(emailAddress); err != nil {
+		if _, ok := err.(storage.NotFoundError); ok {
+			writeJson(w, http.StatusNotFound, apiErrorResponse{"Subscriber not found"})
+			return
+		}
+
+		logging.FromContext(r.Context(), adminService.logger).Error("error reading subscriber",
+			logging.Email(emailAddress), logging.Error(err))
+
+		writeJson(w, http.StatusInternalServerError, apiErrorResponse{"Error reading subscriber"})
+		return
+	}
+
+	if err := adminService.subService.unsubscribe(r.Context(), emailAddress); err != nil {
+		logging.FromContext(r.Context(), adminService.logger).Error("error unsubscribing",
+			logging.Email(emailAddress), logging.Error(err))
+
+		writeJson(w, http.StatusInternalServerError, apiErrorResponse{"Error unsubscribing"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/// ApiCheckFeed handles a POST request to /admin/api/feed-checks, queueing a check of the feed that notifies
+/// subscribers of any new posts, as a webhook would.
+func (adminService *AdminService) ApiCheckFeed(w http.ResponseWriter, r *http.Request) {
+	if !hasJsonBody(r) {
+		writeJson(w, http.StatusUnsupportedMediaType, apiErrorResponse{"Request body must be JSON"})
+		return
+	}
+
+	job, err := adminService.whService.jobQueue.Enqueue(checkFeedJobKind, nil)
+
+	if err != nil {
+		logging.FromContext(r.Context(), adminService.logger).Error("error queueing feed check", logging.Error(err))
+
+		writeJson(w, http.StatusInternalServerError, apiErrorResponse{"Error queueing feed check"})
+		return
+	}
+
+	logging.FromContext(r.Context(), adminService.logger).Info("queued feed check from the admin API", "job_id",
+		job.Id)
+
+	writeJson(w, http.StatusAccepted, feedCheckResponse{job.Id})
+}
+
+/// hasJsonBody checks whether a request declares a JSON body.
+func hasJsonBody(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	return err == nil && mediaType == "application/json"
+}
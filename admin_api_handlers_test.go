@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+func TestAdminApi(t *testing.T) {
+	subService := newTestSubscriptionService(t)
+	whService := &WebHookService{}
+	configuration := &config.Config{
+		AdminUsername: "admin",
+		AdminPassword: "password",
+	}
+	logger := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+
+	adminService := NewAdminService(subService.store, nil, subService, whService, configuration, logger)
+	router := newRouter(subService, whService, nil, adminService, nil, nil)
+	server := httptest.NewServer(bindMiddleware(router, make([]byte, 32), csrfExemptPaths(nil), logger))
+	defer server.Close()
+
+	urls := NewUrlBuilder(server.URL)
+	urls.SetRouter(router)
+
+	client := newAdminApiClient(urls, configuration)
+
+	if err := client.addSubscriber("someone@example.com", "Someone", storage.FrequencyWeeklyDigest); err != nil {
+		t.Fatalf("error adding subscriber: %s", err)
+	}
+
+	if err := client.addSubscriber("not an email address", "", ""); err == nil {
+		t.Errorf("expected adding an invalid email address to fail")
+	}
+
+	subscribers, err := client.listSubscribers(storage.SubscriberActive)
+	if err != nil {
+		t.Fatalf("error listing subscribers: %s", err)
+	}
+
+	if len(subscribers) != 1 || subscribers[0].EmailAddress != "someone@example.com" ||
+		subscribers[0].Frequency != storage.FrequencyWeeklyDigest {
+		t.Fatalf("expected the added subscriber to be listed, got %+v", subscribers)
+	}
+
+	if err = client.removeSubscriber("someone@example.com"); err != nil {
+		t.Fatalf("error removing subscriber: %s", err)
+	}
+
+	if err = client.removeSubscriber("nobody@example.com"); err == nil {
+		t.Errorf("expected removing an unknown subscriber to fail")
+	}
+
+	subscriber, err := subService.store.GetSubscriber("someone@example.com")
+	if err != nil {
+		t.Fatalf("error reading subscriber: %s", err)
+	}
+
+	if subscriber.Status != storage.SubscriberUnsubscribed {
+		t.Errorf("expected subscriber to be unsubscribed, got %s", subscriber.Status)
+	}
+
+	t.Run("rejects requests without credentials", func(t *testing.T) {
+		client := newAdminApiClient(urls, &config.Config{
+			AdminUsername: "admin",
+			AdminPassword: "wrong",
+		})
+
+		if _, err := client.listSubscribers(""); err == nil {
+			t.Errorf("expected listing subscribers with the wrong password to fail")
+		}
+	})
+
+	t.Run("rejects form posts", func(t *testing.T) {
+		request, _ := http.NewRequest("POST", server.URL+"/admin/api/subscribers",
+			strings.NewReader("email_address=attacker%40example.com"))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.SetBasicAuth("admin", "password")
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusUnsupportedMediaType {
+			t.Errorf("expected status %d, got %d", http.StatusUnsupportedMediaType, response.StatusCode)
+		}
+	})
+}
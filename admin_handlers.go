@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/logging"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// adminListLimit is the number of recent records shown in each list on the admin dashboard.
+const adminListLimit = 20
+
+/// AdminService serves the /admin area, showing what the mailer has done.
+type AdminService struct {
+	store       *storage.Store
+	templates   *template.Template
+	subService  *SubscriptionService
+	whService   *WebHookService
+	username    string
+	password    string
+	fromAddress string
+	fromName    string
+	logger      *slog.Logger
+}
+
+func NewAdminService(store *storage.Store, templates *template.Template, subService *SubscriptionService,
+	whService *WebHookService, configuration *config.Config, logger *slog.Logger) *AdminService {
+	fromAddress, fromName := configuration.FromAddress()
+
+	return &AdminService{
+		store: store,
+		templates: templates,
+		subService: subService,
+		whService: whService,
+		username: configuration.AdminUsername,
+		password: configuration.AdminPassword,
+		fromAddress: fromAddress,
+		fromName: fromName,
+		logger: logger,
+	}
+}
+
+/// RequireAuthentication wraps a handler so that it is only served to requests carrying the admin credentials using
+/// HTTP basic authentication.
+func (adminService *AdminService) RequireAuthentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+
+		// Compare hashes so that the time taken doesn't reveal the length of the credentials
+		usernameHash := sha256.Sum256([]byte(username))
+		expectedUsernameHash := sha256.Sum256([]byte(adminService.username))
+		passwordHash := sha256.Sum256([]byte(password))
+		expectedPasswordHash := sha256.Sum256([]byte(adminService.password))
+
+		usernameMatches := subtle.ConstantTimeCompare(usernameHash[:], expectedUsernameHash[:]) == 1
+		passwordMatches := subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:]) == 1
+
+		if !ok || !usernameMatches || !passwordMatches {
+			if ok {
+				logging.FromContext(r.Context(), adminService.logger).Warn("failed admin login", "username",
+					username, "remote_addr", r.RemoteAddr)
+			}
+
+			w.Header().Set("WWW-Authenticate", `Basic realm="MyBB Blog Mailer Admin", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+/// Dashboard handles a request to /admin, showing subscriber counts and the most recent signups, webhook deliveries
+/// and notifications.
+func (adminService *AdminService) Dashboard(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), adminService.logger)
+
+	subscribers, err := adminService.store.ListSubscribers("")
+
+	if err != nil {
+		logger.Error("error listing subscribers", logging.Error(err))
+
+		http.Error(w, "Error listing subscribers", http.StatusInternalServerError)
+		return
+	}
+
+	subscriberCounts := make(map[storage.SubscriberStatus]int)
+
+	for _, subscriber := range subscribers {
+		subscriberCounts[subscriber.Status]++
+	}
+
+	sort.Slice(subscribers, func(i, j int) bool {
+		return subscribers[i].ConfirmedAt.After(subscribers[j].ConfirmedAt)
+	})
+
+	webHookDeliveries, err := adminService.store.ListWebHookDeliveries()
+
+	if err != nil {
+		logger.Error("error listing webhook deliveries", logging.Error(err))
+
+		http.Error(w, "Error listing webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	sentPosts, err := adminService.store.ListSentPosts()
+
+	if err != nil {
+		logger.Error("error listing sent posts", logging.Error(err))
+
+		http.Error(w, "Error listing sent posts", http.StatusInternalServerError)
+		return
+	}
+
+	adminService.templates.ExecuteTemplate(w, "admin/dashboard.html", map[string]interface{}{
+		"totalSubscribers": len(subscribers),
+		"activeSubscribers": subscriberCounts[storage.SubscriberActive],
+		"unsubscribedSubscribers": subscriberCounts[storage.SubscriberUnsubscribed],
+		"suppressedSubscribers": subscriberCounts[storage.SubscriberSuppressed],
+		"recentSignups": subscribers[:limitList(len(subscribers))],
+		"webHookDeliveries": webHookDeliveries[:limitList(len(webHookDeliveries))],
+		"notifications": sentPosts[:limitList(len(sentPosts))],
+	})
+}
+
+/// Deliveries handles a request to /admin/deliveries, listing every delivery of the notification of a post with the
+/// message ID given by the mail provider or the reason it failed.
+func (adminService *AdminService) Deliveries(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), adminService.logger)
+	postKey := r.URL.Query().Get("post")
+
+	sentPost, err := adminService.store.GetSentPost(postKey)
+
+	if _, ok := err.(storage.NotFoundError); ok {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		logger.Error("error reading sent post", "post", postKey, logging.Error(err))
+
+		http.Error(w, "Error reading sent post", http.StatusInternalServerError)
+		return
+	}
+
+	deliveries, err := adminService.store.ListDeliveries(postKey)
+
+	if err != nil {
+		logger.Error("error listing deliveries", "post", postKey, logging.Error(err))
+
+		http.Error(w, "Error listing deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	adminService.templates.ExecuteTemplate(w, "admin/deliveries.html", map[string]interface{}{
+		"post": sentPost,
+		"deliveries": deliveries,
+	})
+}
+
+/// limitList gets how many items of a list of the given length are shown on the dashboard.
+func limitList(length int) int {
+	if length > adminListLimit {
+		return adminListLimit
+	}
+
+	return length
+}
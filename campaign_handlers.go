@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+
+	"github.com/mybb/mybb-blog-mailer/logging"
+	"github.com/mybb/mybb-blog-mailer/metrics"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+const (
+	/// sendCampaignPreviewJobKind is the kind of job that emails the administrator a preview of a held campaign.
+	sendCampaignPreviewJobKind = "send_campaign_preview"
+	/// sendCampaignJobKind is the kind of job that sends the notifications for an approved campaign.
+	sendCampaignJobKind = "send_campaign"
+)
+
+/// campaignJobPayload is the payload of the jobs for a campaign.
+type campaignJobPayload struct {
+	CampaignId uint64 `json:"campaign_id"`
+	/// Automatic is set for the job that sends the campaign once the automatic send delay has passed, which approves
+	/// the campaign if it is still pending.
+	Automatic bool `json:"automatic,omitempty"`
+}
+
+/// campaignPreview is a notification as it will be sent for a campaign, shown in the approval email.
+type campaignPreview struct {
+	Subject     string
+	TextContent string
+	HtmlContent template.HTML
+}
+
+/// holdPostsForApproval creates a pending campaign for new posts and queues the email asking the administrator to
+/// approve it, along with the job sending it automatically if it isn't rejected in time.
+func (whService *WebHookService) holdPostsForApproval(posts []*newBlogPost) error {
+	campaign := &storage.Campaign{
+		Status: storage.CampaignPending,
+	}
+
+	for _, post := range posts {
+		campaign.Posts = append(campaign.Posts, storage.CampaignPost{
+			Key: post.Key,
+			Title: post.Title,
+			Summary: post.Summary,
+			Url: post.Url,
+			PublishedAt: post.PublishedAt,
+			Author: post.Author,
+		})
+	}
+
+	if whService.approvalAutoSendDelay > 0 {
+		autoSendAt := time.Now().Add(whService.approvalAutoSendDelay).UTC()
+		campaign.AutoSendAt = &autoSendAt
+	}
+
+	if err := whService.store.CreateCampaign(campaign); err != nil {
+		return err
+	}
+
+	for _, post := range posts {
+		sentPost := post.toSentPost()
+		sentPost.Status = storage.SentPostHeld
+		sentPost.FirstSeenAt = time.Now().UTC()
+
+		if err := whService.store.SaveSentPost(sentPost); err != nil {
+			return fmt.Errorf("error recording post '%s' in the ledger: %s", post.Title, err)
+		}
+	}
+
+	_, err := whService.jobQueue.Enqueue(sendCampaignPreviewJobKind, &campaignJobPayload{
+		CampaignId: campaign.Id,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if campaign.AutoSendAt != nil {
+		_, err = whService.jobQueue.EnqueueAt(sendCampaignJobKind, &campaignJobPayload{
+			CampaignId: campaign.Id,
+			Automatic: true,
+		}, *campaign.AutoSendAt)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	whService.logger.Info("holding new blog posts for approval", "posts", len(posts), "campaign_id", campaign.Id)
+
+	return nil
+}
+
+/// SendCampaignPreview handles a queued job to email the administrator a preview of a held campaign, with links to
+/// approve or reject it.
+func (whService *WebHookService) SendCampaignPreview(ctx context.Context, job *storage.Job) error {
+	campaign, err := whService.getJobCampaign(job)
+
+	if err != nil {
+		return err
+	}
+
+	if campaign.Status != storage.CampaignPending {
+		whService.logger.Debug("not sending preview of campaign that was already decided", "campaign_id",
+			campaign.Id, "status", campaign.Status)
+
+		return nil
+	}
+
+	unsubscribeUrl, err := buildUnsubscribeUrl(whService.urls, whService.hmacSecret, whService.approvalEmailAddress)
+
+	if err != nil {
+		return err
+	}
+
+	approveUrl, err := buildCampaignUrl(whService.urls, whService.hmacSecret, campaign.Id, "approve")
+
+	if err != nil {
+		return err
+	}
+
+	rejectUrl, err := buildCampaignUrl(whService.urls, whService.hmacSecret, campaign.Id, "reject")
+
+	if err != nil {
+		return err
+	}
+
+	posts := campaignPosts(campaign)
+	recipient := notificationRecipient{
+		Name: "Subscriber",
+		EmailAddress: whService.approvalEmailAddress,
+		UnsubscribeUrl: unsubscribeUrl,
+	}
+
+	var previews []campaignPreview
+
+	for _, notification := range whService.planNotifications(posts) {
+		textContent, htmlContent, err := whService.renderNotification(notification, recipient)
+
+		if err != nil {
+			return err
+		}
+
+		previews = append(previews, campaignPreview{
+			Subject: notification.subject,
+			TextContent: textContent,
+			HtmlContent: template.HTML(htmlContent),
+		})
+	}
+
+	data := map[string]interface{}{
+		"campaign": campaign,
+		"previews": previews,
+		"approveUrl": approveUrl,
+		"rejectUrl": rejectUrl,
+	}
+
+	var plainTextContentBuffer bytes.Buffer
+
+	err = whService.templates.ExecuteTemplate(&plainTextContentBuffer, "emails/campaign_approval.txt", data)
+
+	if err != nil {
+		metrics.TemplateRenderErrors.WithLabelValues("emails/campaign_approval.txt").Inc()
+
+		return fmt.Errorf("unable to create plaintext email content: %s", err)
+	}
+
+	var htmlContentBuffer bytes.Buffer
+
+	err = whService.templates.ExecuteTemplate(&htmlContentBuffer, "emails/campaign_approval.html", data)
+
+	if err != nil {
+		metrics.TemplateRenderErrors.WithLabelValues("emails/campaign_approval.html").Inc()
+
+		return fmt.Errorf("unable to create HTML email content: %s", err)
+	}
+
+	return whService.mailHandler.SendAdminEmail(whService.approvalEmailAddress,
+		fmt.Sprintf("Approve Notification of %d New MyBB Blog Posts", len(posts)), plainTextContentBuffer.String(),
+		htmlContentBuffer.String())
+}
+
+/// SendCampaign handles a queued job to send the notifications for an approved campaign, or for a pending campaign
+/// whose automatic send delay has passed, stopping once the context is cancelled.
+func (whService *WebHookService) SendCampaign(ctx context.Context, job *storage.Job) error {
+	var payload campaignJobPayload
+
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+
+	if payload.Automatic {
+		approved, err := whService.decideCampaign(payload.CampaignId, storage.CampaignApproved, "automatic")
+
+		if err != nil {
+			return err
+		}
+
+		if !approved {
+			// The administrator already decided, so the campaign is either rejected or being sent by another job
+			return nil
+		}
+
+		whService.logger.Info("automatically approved campaign as it wasn't rejected in time", "campaign_id",
+			payload.CampaignId)
+	}
+
+	whService.sendLock.Lock()
+	defer whService.sendLock.Unlock()
+
+	campaign, err := whService.store.GetCampaign(payload.CampaignId)
+
+	if err != nil {
+		return err
+	}
+
+	if campaign.Status != storage.CampaignApproved {
+		whService.logger.Debug("not sending campaign that isn't approved", "campaign_id", campaign.Id, "status",
+			campaign.Status)
+
+		return nil
+	}
+
+	if err = whService.notifyOfPosts(ctx, campaignPosts(campaign)); err != nil {
+		return err
+	}
+
+	sentAt := time.Now().UTC()
+	campaign.Status = storage.CampaignSent
+	campaign.SentAt = &sentAt
+
+	return whService.store.SaveCampaign(campaign)
+}
+
+/// ReviewCampaign handles a GET request to /campaigns/approve or /campaigns/reject from the links in the approval
+/// email, asking the administrator to confirm the decision.
+///
+/// Nothing is changed here, as link scanners and mail clients prefetch links found in emails.
+func (whService *WebHookService) ReviewCampaign(w http.ResponseWriter, r *http.Request) {
+	action := mux.Vars(r)["action"]
+	query := r.URL.Query()
+
+	campaign, ok := whService.getRequestCampaign(w, r, action, query.Get("campaign"), query.Get("token"))
+
+	if !ok {
+		return
+	}
+
+	whService.templates.ExecuteTemplate(w, "campaign_review.html", map[string]interface{}{
+		csrf.TemplateTag: csrf.TemplateField(r),
+		"action": action,
+		"campaign": campaign,
+		"token": query.Get("token"),
+	})
+}
+
+/// DecideCampaign handles a POST request to /campaigns/approve or /campaigns/reject, approving or rejecting a
+/// campaign held for approval.
+func (whService *WebHookService) DecideCampaign(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), whService.logger)
+
+	err := r.ParseForm()
+
+	if err != nil {
+		logger.Error("error parsing form data for campaign decision", logging.Error(err))
+
+		http.Error(w, fmt.Sprintf("Error parsing form data for campaign decision: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	action := mux.Vars(r)["action"]
+
+	campaign, ok := whService.getRequestCampaign(w, r, action, r.PostForm.Get("campaign"),
+		r.PostForm.Get("token"))
+
+	if !ok {
+		return
+	}
+
+	logger = logger.With("campaign_id", campaign.Id)
+
+	status := storage.CampaignRejected
+
+	if action == "approve" {
+		status = storage.CampaignApproved
+	}
+
+	decided, err := whService.decideCampaign(campaign.Id, status, "email link")
+
+	if err != nil {
+		logger.Error("error recording decision for campaign", logging.Error(err))
+
+		http.Error(w, "Error recording decision", http.StatusInternalServerError)
+		return
+	}
+
+	if decided && status == storage.CampaignApproved {
+		_, err = whService.jobQueue.Enqueue(sendCampaignJobKind, &campaignJobPayload{
+			CampaignId: campaign.Id,
+		})
+
+		if err != nil {
+			logger.Error("error queueing approved campaign", logging.Error(err))
+
+			http.Error(w, "Error queueing approved campaign", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	campaign, err = whService.store.GetCampaign(campaign.Id)
+
+	if err != nil {
+		logger.Error("error reading campaign", logging.Error(err))
+
+		http.Error(w, "Error reading campaign", http.StatusInternalServerError)
+		return
+	}
+
+	whService.templates.ExecuteTemplate(w, "campaign_decided.html", map[string]interface{}{
+		"campaign": campaign,
+		"decided": decided,
+	})
+}
+
+/// decideCampaign approves or rejects a pending campaign, returning false if it was already decided.
+///
+/// Rejecting a campaign marks its posts as rejected in the ledger so that they are never sent.
+func (whService *WebHookService) decideCampaign(id uint64, status storage.CampaignStatus,
+	decidedBy string) (bool, error) {
+	whService.campaignLock.Lock()
+	defer whService.campaignLock.Unlock()
+
+	campaign, err := whService.store.GetCampaign(id)
+
+	if err != nil {
+		return false, err
+	}
+
+	if campaign.Status != storage.CampaignPending {
+		return false, nil
+	}
+
+	decidedAt := time.Now().UTC()
+	campaign.Status = status
+	campaign.DecidedAt = &decidedAt
+	campaign.DecidedBy = decidedBy
+
+	if err = whService.store.SaveCampaign(campaign); err != nil {
+		return false, err
+	}
+
+	if status != storage.CampaignRejected {
+		return true, nil
+	}
+
+	for _, post := range campaign.Posts {
+		sentPost, err := whService.store.GetSentPost(post.Key)
+
+		if err != nil {
+			return true, err
+		}
+
+		sentPost.Status = storage.SentPostRejected
+
+		if err = whService.store.SaveSentPost(sentPost); err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+/// getJobCampaign finds the campaign a queued job is for.
+func (whService *WebHookService) getJobCampaign(job *storage.Job) (*storage.Campaign, error) {
+	var payload campaignJobPayload
+
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, err
+	}
+
+	return whService.store.GetCampaign(payload.CampaignId)
+}
+
+/// getRequestCampaign finds the campaign an approval link is for after checking its token, writing an error response
+/// and returning false if it can't.
+func (whService *WebHookService) getRequestCampaign(w http.ResponseWriter, r *http.Request, action, campaignId,
+	token string) (*storage.Campaign, bool) {
+	id, err := strconv.ParseUint(campaignId, 10, 64)
+
+	if err != nil || len(token) == 0 {
+		http.Error(w, "Invalid campaign link", http.StatusBadRequest)
+		return nil, false
+	}
+
+	expectedToken := generateCampaignToken(whService.hmacSecret, id, action)
+
+	if subtle.ConstantTimeCompare([]byte(expectedToken), []byte(token)) != 1 {
+		http.Error(w, "Invalid campaign link", http.StatusForbidden)
+		return nil, false
+	}
+
+	campaign, err := whService.store.GetCampaign(id)
+
+	if _, ok := err.(storage.NotFoundError); ok {
+		http.Error(w, "Campaign not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	if err != nil {
+		logging.FromContext(r.Context(), whService.logger).Error("error reading campaign", "campaign_id", id,
+			logging.Error(err))
+
+		http.Error(w, "Error reading campaign", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return campaign, true
+}
+
+/// campaignPosts converts the snapshot of the posts in a campaign back to blog posts to send. The times the posts were
+/// first seen and sent are left for notifySubscribers to read from the ledger.
+func campaignPosts(campaign *storage.Campaign) []*newBlogPost {
+	posts := make([]*newBlogPost, len(campaign.Posts))
+
+	for i, post := range campaign.Posts {
+		posts[i] = &newBlogPost{
+			Key: post.Key,
+			Title: post.Title,
+			Summary: post.Summary,
+			Url: post.Url,
+			PublishedAt: post.PublishedAt,
+			Author: post.Author,
+		}
+	}
+
+	return posts
+}
+
+/// generateCampaignToken signs a campaign ID and action, so that only the recipient of the approval email can approve
+/// or reject the campaign, and a link to reject it can't be used to approve it.
+func generateCampaignToken(hmacSecret string, id uint64, action string) string {
+	message := fmt.Sprintf("campaign_%s_%d", action, id)
+
+	key := []byte(hmacSecret)
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(message))
+
+	return base64.URLEncoding.EncodeToString(h.Sum(nil))
+}
+
+/// buildCampaignUrl builds the absolute URL to approve or reject a campaign.
+func buildCampaignUrl(urls *UrlBuilder, hmacSecret string, id uint64, action string) (string, error) {
+	return urls.Url("review_campaign", "action", action, "campaign", strconv.FormatUint(id, 10), "token",
+		generateCampaignToken(hmacSecret, id, action))
+}
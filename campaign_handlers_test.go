@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/jobs"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// newTestCampaignService creates a webhook service holding posts for approval, with an empty store and a mail handler
+/// recording the notifications sent.
+func newTestCampaignService(t *testing.T,
+	autoSendDelay time.Duration) (*WebHookService, *recordingMailHandler, *mux.Router) {
+	t.Helper()
+
+	store := newTestSubscriptionService(t).store
+	logger := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	configuration := &config.Config{
+		BaseUrl: "https://blog-mailer.example.com",
+		HmacSecret: "secret",
+		NotificationMode: "each",
+		HoldForApproval: true,
+		ApprovalEmailAddress: "admin@example.com",
+		ApprovalAutoSendDelay: autoSendDelay,
+	}
+
+	urls := NewUrlBuilder(configuration.BaseUrl)
+	templates, err := loadTemplates(urls)
+	if err != nil {
+		t.Fatalf("error loading templates: %s", err)
+	}
+
+	mailHandler := &recordingMailHandler{}
+	whService := NewWebHookService(mailHandler, store, jobs.NewQueue(store, configuration, logger), templates, urls,
+		configuration, filepath.Join(t.TempDir(), "last_post_date"), logger)
+	router := newRouter(&SubscriptionService{}, whService, nil, nil, nil, nil)
+	urls.SetRouter(router)
+
+	return whService, mailHandler, router
+}
+
+/// holdTestPost holds a post for approval with a subscriber who confirmed before it was found and one who confirmed
+/// while it was held, returning the campaign.
+func holdTestPost(t *testing.T, whService *WebHookService) *storage.Campaign {
+	t.Helper()
+
+	saveSubscriber := func(emailAddress string, confirmedAt time.Time) {
+		err := whService.store.SaveSubscriber(&storage.Subscriber{
+			EmailAddress: emailAddress,
+			Status: storage.SubscriberActive,
+			ConfirmedAt: confirmedAt,
+		})
+
+		if err != nil {
+			t.Fatalf("error saving subscriber: %s", err)
+		}
+	}
+
+	saveSubscriber("before@example.com", time.Now().Add(-time.Hour))
+
+	err := whService.holdPostsForApproval([]*newBlogPost{{
+		Key: "post",
+		Title: "Post",
+		Url: "https://blog.example.com/post",
+		PublishedAt: time.Now(),
+	}})
+
+	if err != nil {
+		t.Fatalf("error holding post for approval: %s", err)
+	}
+
+	// The campaign is decided some time after the subscriber confirmed
+	time.Sleep(time.Millisecond * 10)
+	saveSubscriber("during@example.com", time.Now())
+	time.Sleep(time.Millisecond * 10)
+
+	campaigns, err := whService.store.ListCampaigns()
+	if err != nil || len(campaigns) != 1 {
+		t.Fatalf("expected a single campaign, got %d: %v", len(campaigns), err)
+	}
+
+	return &campaigns[0]
+}
+
+/// decide posts a decision on a campaign with the given token, as the form on the review page does.
+func decide(router *mux.Router, action string, id uint64, token string) *httptest.ResponseRecorder {
+	form := url.Values{
+		"campaign": {strconv.FormatUint(id, 10)},
+		"token": {token},
+	}
+
+	r := httptest.NewRequest("POST", "/campaigns/"+action, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	return w
+}
+
+/// runCampaignJobs runs the queued jobs sending campaigns, as the job queue would.
+func runCampaignJobs(t *testing.T, whService *WebHookService) {
+	t.Helper()
+
+	queued, err := whService.store.ListJobs(storage.JobPending)
+	if err != nil {
+		t.Fatalf("error listing jobs: %s", err)
+	}
+
+	for _, job := range queued {
+		if job.Kind != sendCampaignJobKind {
+			continue
+		}
+
+		if err = whService.SendCampaign(context.Background(), &job); err != nil {
+			t.Fatalf("error sending campaign: %s", err)
+		}
+
+		job.Status = storage.JobSucceeded
+
+		if err = whService.store.SaveJob(&job); err != nil {
+			t.Fatalf("error saving job: %s", err)
+		}
+	}
+}
+
+/// expectCampaignStatus checks the status of a campaign and of its post in the ledger.
+func expectCampaignStatus(t *testing.T, whService *WebHookService, id uint64, status storage.CampaignStatus,
+	postStatus storage.SentPostStatus) {
+	t.Helper()
+
+	campaign, err := whService.store.GetCampaign(id)
+	if err != nil {
+		t.Fatalf("error reading campaign: %s", err)
+	}
+
+	if campaign.Status != status {
+		t.Errorf("expected campaign to be %s, got %s", status, campaign.Status)
+	}
+
+	sentPost, err := whService.store.GetSentPost("post")
+	if err != nil {
+		t.Fatalf("error reading sent post: %s", err)
+	}
+
+	if sentPost.Status != postStatus {
+		t.Errorf("expected post to be %s, got %s", postStatus, sentPost.Status)
+	}
+}
+
+func TestApproveCampaign(t *testing.T) {
+	whService, mailHandler, router := newTestCampaignService(t, 0)
+	campaign := holdTestPost(t, whService)
+
+	heldPost, err := whService.store.GetSentPost("post")
+	if err != nil {
+		t.Fatalf("error reading sent post: %s", err)
+	}
+
+	w := decide(router, "approve", campaign.Id, generateCampaignToken("secret", campaign.Id, "approve"))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	expectCampaignStatus(t, whService, campaign.Id, storage.CampaignApproved, storage.SentPostHeld)
+
+	runCampaignJobs(t, whService)
+
+	expectCampaignStatus(t, whService, campaign.Id, storage.CampaignSent, storage.SentPostSent)
+
+	if len(mailHandler.sent) != 1 || mailHandler.sent[0] != "before@example.com" {
+		t.Errorf("expected only the subscriber from before the post was found to be notified, got %v",
+			mailHandler.sent)
+	}
+
+	sentPost, err := whService.store.GetSentPost("post")
+	if err != nil {
+		t.Fatalf("error reading sent post: %s", err)
+	}
+
+	if !sentPost.FirstSeenAt.Equal(heldPost.FirstSeenAt) {
+		t.Errorf("expected the post to keep the time it was first seen, %s, got %s", heldPost.FirstSeenAt,
+			sentPost.FirstSeenAt)
+	}
+}
+
+func TestRejectCampaign(t *testing.T) {
+	whService, mailHandler, router := newTestCampaignService(t, time.Hour)
+	campaign := holdTestPost(t, whService)
+
+	w := decide(router, "reject", campaign.Id, generateCampaignToken("secret", campaign.Id, "reject"))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	expectCampaignStatus(t, whService, campaign.Id, storage.CampaignRejected, storage.SentPostRejected)
+
+	// The automatic send doesn't override the rejection
+	runCampaignJobs(t, whService)
+
+	expectCampaignStatus(t, whService, campaign.Id, storage.CampaignRejected, storage.SentPostRejected)
+
+	if len(mailHandler.sent) != 0 {
+		t.Errorf("expected no notifications to be sent, got %v", mailHandler.sent)
+	}
+}
+
+func TestCampaignLinkTokens(t *testing.T) {
+	whService, mailHandler, router := newTestCampaignService(t, 0)
+	campaign := holdTestPost(t, whService)
+
+	tests := []struct {
+		name   string
+		action string
+		id     uint64
+		token  string
+		status int
+	}{
+		{"forged token", "approve", campaign.Id, "forged", http.StatusForbidden},
+		{"reject token used to approve", "approve", campaign.Id,
+			generateCampaignToken("secret", campaign.Id, "reject"), http.StatusForbidden},
+		{"token signed with another secret", "approve", campaign.Id,
+			generateCampaignToken("other", campaign.Id, "approve"), http.StatusForbidden},
+		{"token for another campaign", "approve", campaign.Id, generateCampaignToken("secret", 2, "approve"),
+			http.StatusForbidden},
+		{"unknown campaign", "approve", 2, generateCampaignToken("secret", 2, "approve"), http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := decide(router, test.action, test.id, test.token)
+
+			if w.Code != test.status {
+				t.Errorf("expected status %d, got %d", test.status, w.Code)
+			}
+
+			expectCampaignStatus(t, whService, campaign.Id, storage.CampaignPending, storage.SentPostHeld)
+		})
+	}
+
+	t.Run("link for a campaign already decided", func(t *testing.T) {
+		decide(router, "approve", campaign.Id, generateCampaignToken("secret", campaign.Id, "approve"))
+
+		w := decide(router, "reject", campaign.Id, generateCampaignToken("secret", campaign.Id, "reject"))
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
+		}
+
+		expectCampaignStatus(t, whService, campaign.Id, storage.CampaignApproved, storage.SentPostHeld)
+	})
+
+	if len(mailHandler.sent) != 0 {
+		t.Errorf("expected no notifications to be sent before the campaign's job runs, got %v", mailHandler.sent)
+	}
+}
+
+func TestAutoSendCampaign(t *testing.T) {
+	whService, mailHandler, _ := newTestCampaignService(t, time.Hour)
+	campaign := holdTestPost(t, whService)
+
+	if campaign.AutoSendAt == nil {
+		t.Fatalf("expected the campaign to be sent automatically")
+	}
+
+	queued, err := whService.store.ListJobs(storage.JobPending)
+	if err != nil {
+		t.Fatalf("error listing jobs: %s", err)
+	}
+
+	var autoSendJob *storage.Job
+
+	for i, job := range queued {
+		var payload campaignJobPayload
+
+		if job.Kind == sendCampaignJobKind && json.Unmarshal(job.Payload, &payload) == nil && payload.Automatic {
+			autoSendJob = &queued[i]
+		}
+	}
+
+	if autoSendJob == nil || autoSendJob.RunAt.Before(time.Now().Add(time.Minute*59)) {
+		t.Fatalf("expected a job sending the campaign after the delay, got %+v", autoSendJob)
+	}
+
+	runCampaignJobs(t, whService)
+
+	expectCampaignStatus(t, whService, campaign.Id, storage.CampaignSent, storage.SentPostSent)
+
+	if campaign, err = whService.store.GetCampaign(campaign.Id); err != nil {
+		t.Fatalf("error reading campaign: %s", err)
+	}
+
+	if campaign.DecidedBy != "automatic" {
+		t.Errorf("expected the campaign to be approved automatically, got '%s'", campaign.DecidedBy)
+	}
+
+	if len(mailHandler.sent) != 1 || mailHandler.sent[0] != "before@example.com" {
+		t.Errorf("expected only the subscriber from before the post was found to be notified, got %v",
+			mailHandler.sent)
+	}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/jobs"
+	"github.com/mybb/mybb-blog-mailer/mail"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// commandEnvironment holds what commands run from the shell need to do their work.
+type commandEnvironment struct {
+	configuration *config.Config
+	/// store is the database, or nil if the server has it open and the command is run through the admin API instead.
+	store      *storage.Store
+	adminApi   *adminApiClient
+	subService *SubscriptionService
+	whService  *WebHookService
+	logger     *slog.Logger
+}
+
+/// newCommandEnvironment loads the configuration, opens the database and creates the services for a command.
+///
+/// Jobs queued by a command, such as to send a notification held for approval, are left for the server to run.
+///
+/// Only one process can have the database open, so if the server is running, commands that can be run through the
+/// admin API are given a client for it instead of the database, and other commands fail until the server is stopped.
+func newCommandEnvironment(opts *options, adminApiAllowed bool) (*commandEnvironment, error) {
+	configuration, err := loadConfiguration(opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	logger := slog.Default()
+	urls := NewUrlBuilder(configuration.BaseUrl)
+	templates, err := loadTemplates(urls)
+
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := storage.Open(opts.databaseFilePath)
+
+	var adminApi *adminApiClient
+
+	if _, ok := err.(storage.LockedError); ok {
+		if !adminApiAllowed {
+			return nil, fmt.Errorf("opening database: %s; stop the server to run this command", err)
+		}
+
+		if len(configuration.AdminPassword) == 0 {
+			return nil, fmt.Errorf("opening database: %s; set ADMIN_PASSWORD to run this command through the "+
+				"server's admin API, or stop the server", err)
+		}
+
+		adminApi = newAdminApiClient(urls, configuration)
+	} else if err != nil {
+		return nil, fmt.Errorf("opening database: %s", err)
+	}
+
+	mailHandler := newMailHandler(configuration, logger)
+
+	// Sessions are only used by HTTP requests, so there is no need for the session key
+	subService := NewSubscriptionService(mailHandler, store, templates, configuration.HmacSecret,
+		configuration.ConfirmationTokenTtl, nil, logger)
+	whService := NewWebHookService(mailHandler, store, jobs.NewQueue(store, configuration, logger), templates,
+		urls, configuration, opts.lastPostDateFilePath, logger)
+
+	var adminService *AdminService
+
+	if len(configuration.AdminPassword) > 0 {
+		adminService = NewAdminService(store, templates, subService, whService, configuration, logger)
+	}
+
+	// Links in emails and requests to the admin API point to the routes of the server, so are built with its router
+	// even though it isn't served
+	urls.SetRouter(newRouter(subService, whService, nil, adminService, nil, nil))
+
+	return &commandEnvironment{
+		configuration: configuration,
+		store: store,
+		adminApi: adminApi,
+		subService: subService,
+		whService: whService,
+		logger: logger,
+	}, nil
+}
+
+/// close closes the database, if the command opened it.
+func (env *commandEnvironment) close() error {
+	if env.store == nil {
+		return nil
+	}
+
+	return env.store.Close()
+}
+
+/// sendLatest checks the feed once and notifies subscribers of any new posts, as a webhook would.
+///
+/// If the server is running, the check is queued for the server to run instead.
+func sendLatest(opts *options, args []string) error {
+	env, err := newCommandEnvironment(opts, true)
+
+	if err != nil {
+		return err
+	}
+
+	defer env.close()
+
+	if env.adminApi != nil {
+		response, err := env.adminApi.checkFeed()
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("The server is running, so queued a feed check for it to run as job %d\n", response.JobId)
+
+		return nil
+	}
+
+	// Interrupting the command stops sending between subscribers, recording who was notified so that running it again
+	// carries on from there
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	return env.whService.sendMailNotification(ctx)
+}
+
+/// checkFeed prints the posts in the feed that subscribers haven't been notified of, and the notifications that would
+/// be sent for them, without sending anything.
+///
+/// If the ledger of sent posts hasn't been started, it is started just as the first real check of the feed would.
+func checkFeed(opts *options, args []string) error {
+	env, err := newCommandEnvironment(opts, false)
+
+	if err != nil {
+		return err
+	}
+
+	defer env.store.Close()
+
+	posts, _, err := env.whService.tryGetNewPosts(nil)
+
+	if err != nil {
+		return fmt.Errorf("unable to get new blog posts: %s", err)
+	}
+
+	if len(posts) == 0 {
+		fmt.Println("No new posts found")
+
+		return nil
+	}
+
+	fmt.Printf("Found %d new posts:\n", len(posts))
+
+	for _, post := range posts {
+		retrying := ""
+
+		if !post.FirstSeenAt.IsZero() {
+			retrying = " (retrying failed deliveries)"
+		}
+
+		fmt.Printf("  %s %s <%s>%s\n", post.PublishedAt.Format("2006-01-02"), post.Title, post.Url, retrying)
+	}
+
+	if env.configuration.HoldForApproval {
+		fmt.Printf("New posts would be held for approval by %s\n", env.configuration.ApprovalEmailAddress)
+
+		return nil
+	}
+
+	subscribers, err := env.store.ListSubscribers(storage.SubscriberActive)
+
+	if err != nil {
+		return err
+	}
+
+	instantSubscribers := 0
+
+	for _, subscriber := range subscribers {
+		if !subscriber.WantsDigest() {
+			instantSubscribers++
+		}
+	}
+
+	for _, notification := range env.whService.planNotifications(posts) {
+		fmt.Printf("Would send '%s' to up to %d active subscribers\n", notification.subject, instantSubscribers)
+	}
+
+	if digestSubscribers := len(subscribers) - instantSubscribers; digestSubscribers > 0 {
+		fmt.Printf("The posts would be included in the next digest for %d subscribers\n", digestSubscribers)
+	}
+
+	return nil
+}
+
+/// renderTemplate prints an email rendered for a sample subscriber.
+func renderTemplate(opts *options, args []string) error {
+	flags := flag.NewFlagSet("render-template", flag.ContinueOnError)
+	source := flags.String("source", "sample", "Render the notification of a `sample` post or the newest post in the `feed`")
+	format := flags.String("format", "text", "Print the `text` or `html` content, or the whole `mime` message")
+
+	if err := flags.Parse(args); err != nil {
+		return usageError{err.Error()}
+	}
+
+	if flags.NArg() != 1 {
+		return usageError{"render-template needs the email to render: notification or confirmation"}
+	}
+
+	env, err := newCommandEnvironment(opts, false)
+
+	if err != nil {
+		return err
+	}
+
+	defer env.store.Close()
+
+	fromAddress, fromName := env.configuration.FromAddress()
+
+	var preview *emailPreview
+
+	switch flags.Arg(0) {
+	case "notification":
+		preview, err = buildNotificationPreview(env.whService, fromAddress, fromName, *source == "feed")
+	case "confirmation":
+		preview, err = buildConfirmationPreview(env.subService, fromAddress, fromName)
+	default:
+		return usageError{fmt.Sprintf("unknown email '%s'", flags.Arg(0))}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "text":
+		fmt.Println(preview.TextContent)
+	case "html":
+		fmt.Println(preview.HtmlContent)
+	case "mime":
+		fmt.Print(preview.RawMessage)
+	default:
+		return usageError{fmt.Sprintf("unknown format '%s'", *format)}
+	}
+
+	return nil
+}
+
+/// manageSubscribers lists, adds, removes or exports subscribers.
+func manageSubscribers(opts *options, args []string) error {
+	if len(args) == 0 {
+		return usageError{"subscribers needs an action: list, add, remove or export"}
+	}
+
+	action, args := args[0], args[1:]
+
+	flags := flag.NewFlagSet("subscribers "+action, flag.ContinueOnError)
+	status := flags.String("status", "", "Only include subscribers with the given `status`: active, unsubscribed or suppressed")
+	frequency := flags.String("frequency", string(storage.FrequencyEveryPost),
+		"Email an added subscriber `how often`: every_post or weekly_digest")
+
+	if err := flags.Parse(args); err != nil {
+		return usageError{err.Error()}
+	}
+
+	switch action {
+	case "list", "export":
+		if flags.NArg() != 0 {
+			return usageError{fmt.Sprintf("subscribers %s takes no arguments", action)}
+		}
+	case "add":
+		if flags.NArg() < 1 || flags.NArg() > 2 {
+			return usageError{"subscribers add needs an email address and optionally a name"}
+		}
+
+		switch storage.SubscriberFrequency(*frequency) {
+		case storage.FrequencyEveryPost, storage.FrequencyWeeklyDigest:
+		default:
+			return usageError{fmt.Sprintf("unknown frequency '%s'", *frequency)}
+		}
+	case "remove":
+		if flags.NArg() != 1 {
+			return usageError{"subscribers remove needs an email address"}
+		}
+	default:
+		return usageError{fmt.Sprintf("unknown subscribers action '%s'", action)}
+	}
+
+	env, err := newCommandEnvironment(opts, true)
+
+	if err != nil {
+		return err
+	}
+
+	defer env.close()
+
+	switch action {
+	case "list":
+		return listSubscribers(env, storage.SubscriberStatus(*status))
+	case "export":
+		return exportSubscribers(env, storage.SubscriberStatus(*status))
+	case "add":
+		return addSubscriber(env, flags.Arg(0), flags.Arg(1), storage.SubscriberFrequency(*frequency))
+	default:
+		return removeSubscriber(env, flags.Arg(0))
+	}
+}
+
+/// findSubscribers gets the subscribers with the given status, or every subscriber if it is empty.
+func (env *commandEnvironment) findSubscribers(status storage.SubscriberStatus) ([]storage.Subscriber, error) {
+	if env.adminApi != nil {
+		return env.adminApi.listSubscribers(status)
+	}
+
+	return env.store.ListSubscribers(status)
+}
+
+/// listSubscribers prints a table of the subscribers with the given status, or every subscriber if it is empty.
+func listSubscribers(env *commandEnvironment, status storage.SubscriberStatus) error {
+	subscribers, err := env.findSubscribers(status)
+
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(w, "EMAIL ADDRESS\tNAME\tSTATUS\tFREQUENCY\tCONFIRMED AT")
+
+	for _, subscriber := range subscribers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", subscriber.EmailAddress, subscriber.Name, subscriber.Status,
+			subscriberFrequency(&subscriber), formatOptionalTime(subscriber.ConfirmedAt))
+	}
+
+	return w.Flush()
+}
+
+/// exportSubscribers writes the subscribers with the given status, or every subscriber if it is empty, as CSV.
+func exportSubscribers(env *commandEnvironment, status storage.SubscriberStatus) error {
+	subscribers, err := env.findSubscribers(status)
+
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(os.Stdout)
+
+	w.Write([]string{"email_address", "name", "status", "frequency", "confirmed_at", "source_ip"})
+
+	for _, subscriber := range subscribers {
+		w.Write([]string{subscriber.EmailAddress, subscriber.Name, string(subscriber.Status),
+			string(subscriberFrequency(&subscriber)), formatOptionalTime(subscriber.ConfirmedAt), subscriber.SourceIp})
+	}
+
+	w.Flush()
+
+	return w.Error()
+}
+
+/// addSubscriber subscribes an email address without asking it to confirm the subscription.
+func addSubscriber(env *commandEnvironment, emailAddress, name string, frequency storage.SubscriberFrequency) error {
+	if valid, err := mail.ValidateEmailAddress(emailAddress); !valid {
+		return fmt.Errorf("invalid email address '%s': %s", emailAddress, err)
+	}
+
+	if env.adminApi != nil {
+		if err := env.adminApi.addSubscriber(emailAddress, name, frequency); err != nil {
+			return fmt.Errorf("saving subscriber '%s': %s", emailAddress, err)
+		}
+	} else if err := env.subService.subscribe(context.Background(), emailAddress, name, "", frequency); err != nil {
+		return fmt.Errorf("saving subscriber '%s': %s", emailAddress, err)
+	}
+
+	fmt.Printf("Subscribed %s\n", emailAddress)
+
+	return nil
+}
+
+/// removeSubscriber unsubscribes an email address, keeping the subscriber on record as unsubscribed.
+func removeSubscriber(env *commandEnvironment, emailAddress string) error {
+	if env.adminApi != nil {
+		if err := env.adminApi.removeSubscriber(emailAddress); err != nil {
+			return fmt.Errorf("unsubscribing '%s': %s", emailAddress, err)
+		}
+
+		fmt.Printf("Unsubscribed %s\n", emailAddress)
+
+		return nil
+	}
+
+	if _, err := env.store.GetSubscriber(emailAddress); err != nil {
+		return fmt.Errorf("finding subscriber '%s': %s", emailAddress, err)
+	}
+
+	if err := env.subService.unsubscribe(context.Background(), emailAddress); err != nil {
+		return fmt.Errorf("unsubscribing '%s': %s", emailAddress, err)
+	}
+
+	fmt.Printf("Unsubscribed %s\n", emailAddress)
+
+	return nil
+}
+
+/// replayMailGunEvent processes a MailGun event saved to a file, such as the fixtures in testdata/mailgun, as if it had
+/// been received by the /mailgun/events route. The event is signed afresh with the webhook signing key and a new token,
+/// so that the handling of events can be tried out against the local database without MailGun, and the same file can
+/// be replayed several times. As with MailGun's retries, a soft bounce replayed again isn't counted again, so reaching
+/// the soft bounce threshold needs events with different message IDs.
+func replayMailGunEvent(opts *options, args []string) error {
+	if len(args) != 1 {
+		return usageError{"replay-mailgun-event needs the file of the event to replay"}
+	}
+
+	env, err := newCommandEnvironment(opts, false)
+
+	if err != nil {
+		return err
+	}
+
+	defer env.store.Close()
+
+	signingKey := env.configuration.MailGun.WebHookSigningKey
+
+	if len(signingKey) == 0 {
+		return fmt.Errorf("MAILGUN_WEBHOOK_SIGNING_KEY must be set to replay MailGun events")
+	}
+
+	content, err := ioutil.ReadFile(args[0])
+
+	if err != nil {
+		return err
+	}
+
+	var payload map[string]interface{}
+
+	if err = json.Unmarshal(content, &payload); err != nil {
+		return fmt.Errorf("parsing event file '%s': %s", args[0], err)
+	}
+
+	tokenBytes := make([]byte, 25)
+
+	if _, err = rand.Read(tokenBytes); err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	token := hex.EncodeToString(tokenBytes)
+
+	payload["signature"] = mailGunSignature{
+		Timestamp: timestamp,
+		Token: token,
+		Signature: signMailGunEvent([]byte(signingKey), timestamp, token),
+	}
+
+	body, err := json.Marshal(payload)
+
+	if err != nil {
+		return err
+	}
+
+	request := httptest.NewRequest("POST", "/mailgun/events", bytes.NewReader(body))
+	response := httptest.NewRecorder()
+
+	NewMailGunEventService(env.store, env.subService, env.configuration, env.logger).ReceiveEvent(response, request)
+
+	fmt.Print(response.Body.String())
+
+	if response.Code != http.StatusOK {
+		return fmt.Errorf("event was rejected with status %d", response.Code)
+	}
+
+	return nil
+}
+
+/// manageConfig checks the configuration.
+func manageConfig(opts *options, args []string) error {
+	if len(args) != 1 || args[0] != "validate" {
+		return usageError{"config needs an action: validate"}
+	}
+
+	if _, err := loadConfiguration(opts); err != nil {
+		return err
+	}
+
+	fmt.Println("Configuration is valid")
+
+	return nil
+}
+
+/// subscriberFrequency gets how often a subscriber is emailed, being every post for subscribers from before digests.
+func subscriberFrequency(subscriber *storage.Subscriber) storage.SubscriberFrequency {
+	if subscriber.WantsDigest() {
+		return storage.FrequencyWeeklyDigest
+	}
+
+	return storage.FrequencyEveryPost
+}
+
+/// formatOptionalTime formats a time for the output of a command, or returns an empty string if it isn't set.
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
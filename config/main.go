@@ -3,7 +3,12 @@ package config
 import (
 	"math"
 	"fmt"
+	"log/slog"
 	"os"
+	"net"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 
@@ -24,20 +29,138 @@ type MailGunConfig struct {
 	FromName string
 	/// EmailValidation determines whether to use MailGun's email validation API. This requires a paid MailGun account.
 	EmailValidation bool
+	/// WebHookSigningKey is the key MailGun signs event webhooks with, enabling the /mailgun/events route.
+	WebHookSigningKey string
+	/// SoftBounceThreshold is the number of notifications in a row that can soft bounce before the subscriber is
+	/// suppressed.
+	SoftBounceThreshold int
+}
+
+/// SMTPConfig holds configuration for sending email notifications via an SMTP server.
+type SMTPConfig struct {
+	/// Host is the host name of the SMTP server to connect to.
+	Host string
+	/// Port is the TCP port of the SMTP server to connect to.
+	Port int
+	/// Security is the transport security to use: "starttls", "tls" (implicit TLS) or "none".
+	Security string
+	/// AuthMechanism is the SASL mechanism to authenticate with: "plain", "login" or "none".
+	AuthMechanism string
+	/// Username is the user name to authenticate with the SMTP server.
+	Username string
+	/// Password is the password to authenticate with the SMTP server.
+	Password string
+	/// FromAddress is the email address to send emails from.
+	FromAddress string
+	/// FromName is the name to show with emails sent to subscribers.
+	FromName string
+}
+
+/// DryRunConfig holds configuration for recording emails to a local directory instead of sending them.
+type DryRunConfig struct {
+	/// Directory is the directory to write emails and the index of recorded calls to.
+	Directory string
+	/// FromAddress is the email address recorded emails are from.
+	FromAddress string
+	/// FromName is the name recorded emails are from.
+	FromName string
+}
+
+/// FailoverConfig holds configuration for sending emails through several backends, falling back to the next when one
+/// fails.
+type FailoverConfig struct {
+	/// Backends are the names of the backends to try, in order of preference.
+	Backends []string
+	/// FailureThreshold is the number of consecutive failures after which a backend is skipped.
+	FailureThreshold int
+	/// Cooldown is how long a backend is skipped for after failing, before it is tried again.
+	Cooldown time.Duration
+}
+
+/// LogConfig holds configuration for the structured logs written to standard error.
+type LogConfig struct {
+	/// Level is the lowest level of messages to log.
+	Level slog.Level
+	/// Format is the format to write logs in: "logfmt" or "json".
+	Format string
+	/// RedactEmails determines whether email addresses are redacted from logs.
+	RedactEmails bool
 }
 
 /// Config holds application configuration.
 type Config struct {
 	/// ListenPort is the TCP port to listen for HTTP requests on.
 	ListenPort int
+	/// ShutdownTimeout is how long the server waits on shutdown for HTTP requests and running jobs, such as sending a
+	/// notification, to finish.
+	ShutdownTimeout time.Duration
+	/// BaseUrl is the public URL the application is reachable at, used to build links in emails.
+	BaseUrl string
+	/// MetricsAddr is the address to serve Prometheus metrics on apart from the public routes, such as "127.0.0.1:9090".
+	/// If it is empty, metrics are served at /metrics to the admin.
+	MetricsAddr string
+	/// WebHookEnabled determines whether the /webhook route is available to trigger sending notifications.
+	WebHookEnabled bool
 	/// WebHookSecret is a secret configured with the GitHub webhook to verify requests originate from GitHub.
 	WebHookSecret string
 	/// XmlFeedUrl is the URL to check for blog posts for a successful GitHub pages build.
 	XmlFeedUrl string
+	/// GitLabWebHookToken is the secret token configured with a GitLab webhook, enabling the /webhook/gitlab route.
+	GitLabWebHookToken string
+	/// GiteaWebHookSecret is the secret configured with a Gitea webhook, enabling the /webhook/gitea route.
+	GiteaWebHookSecret string
+	/// GenericWebHookSecret is the secret used to sign requests to the /webhook/generic route, enabling the route.
+	GenericWebHookSecret string
+	/// WebHookTriggers are the rules deciding which webhook events mean the site was deployed, so the feed should be
+	/// checked.
+	WebHookTriggers []TriggerRule
+	/// WebHookDeliveryRetention is how long the IDs of webhook deliveries are remembered to recognise redeliveries.
+	WebHookDeliveryRetention time.Duration
+	/// FeedPollInterval is how often to poll the feed for new posts, or zero to only check it when a webhook is received.
+	FeedPollInterval time.Duration
 	/// HmacSecret is the secret phrase used when signing an email during email verification to ensure authenticity.
 	HmacSecret string
+	/// ConfirmationTokenTtl is how long a subscription confirmation link stays valid for after it is sent.
+	ConfirmationTokenTtl time.Duration
+	/// NotificationMode determines how several posts found at once are sent: "each" sends a notification per post,
+	/// "combined" sends a single notification listing all of them.
+	NotificationMode string
+	/// HoldForApproval determines whether notifications of new posts are held until an administrator approves them.
+	HoldForApproval bool
+	/// ApprovalEmailAddress is the email address of the administrator sent notifications to approve.
+	ApprovalEmailAddress string
+	/// ApprovalAutoSendDelay is how long after a notification is held that it is sent if it hasn't been rejected, or
+	/// zero to wait for approval indefinitely.
+	ApprovalAutoSendDelay time.Duration
+	/// DigestWeekday is the day of the week digests are sent on, in UTC.
+	DigestWeekday time.Weekday
+	/// DigestHour is the hour of the day digests are sent at, in UTC.
+	DigestHour int
+	/// AdminUsername is the user name to log in to the /admin area with.
+	AdminUsername string
+	/// AdminPassword is the password to log in to the /admin area with, which is disabled if it is empty.
+	AdminPassword string
+	/// JobWorkers is the number of workers processing background jobs such as sending notifications.
+	JobWorkers int
+	/// JobMaxAttempts is the number of times a failing background job is attempted before it is marked as dead.
+	JobMaxAttempts int
+	/// JobRetryDelay is the delay before a failed background job is first retried, doubling with every attempt.
+	JobRetryDelay time.Duration
+	/// JobMaxRetryDelay is the longest delay between retries of a failed background job.
+	JobMaxRetryDelay time.Duration
+	/// MailBackend is the backend to send emails with: "mailgun", "smtp", "dryrun" to record them without sending, or
+	/// "failover" to use several backends.
+	MailBackend string
 	/// MailGun is the configuration related to sending email notifications via MailGun.
 	MailGun MailGunConfig
+	/// SMTP is the configuration related to sending email notifications via an SMTP server.
+	SMTP SMTPConfig
+	/// DryRun is the configuration related to recording emails instead of sending them.
+	DryRun DryRunConfig
+	/// Failover is the configuration related to sending emails through several backends.
+	Failover FailoverConfig
+	/// Log is the configuration related to logging.
+	Log LogConfig
 }
 
 func InitFromEnvironment(dotEnvFile string) (*Config, error) {
@@ -49,11 +172,60 @@ func InitFromEnvironment(dotEnvFile string) (*Config, error) {
 		}
 	}
 
+	webHookTriggers, ok := parseTriggerRules(helpers.GetEnv("WEB_HOOK_TRIGGERS",
+		"page_build:conclusion=built;gitlab_pipeline:conclusion=success;gitea_push;generic"))
+
+	if !ok {
+		return nil, OutOfRangeError{
+			ParameterName: "WEB_HOOK_TRIGGERS",
+		}
+	}
+
+	digestWeekday, ok := parseWeekday(helpers.GetEnv("DIGEST_WEEKDAY", "monday"))
+
+	if !ok {
+		return nil, OutOfRangeError{
+			ParameterName: "DIGEST_WEEKDAY",
+		}
+	}
+
+	var logLevel slog.Level
+
+	if err := logLevel.UnmarshalText([]byte(helpers.GetEnv("LOG_LEVEL", "info"))); err != nil {
+		return nil, OutOfRangeError{
+			ParameterName: "LOG_LEVEL",
+		}
+	}
+
 	config := &Config{
 		ListenPort: helpers.GetIntEnv("PORT", 8080),
+		ShutdownTimeout: helpers.GetDurationEnv("SHUTDOWN_TIMEOUT", time.Second * 5),
+		BaseUrl: strings.TrimRight(os.Getenv("BASE_URL"), "/"),
+		MetricsAddr: os.Getenv("METRICS_ADDR"),
+		WebHookEnabled: helpers.GetEnv("WEB_HOOK_ENABLED", "1") == "1",
 		WebHookSecret: os.Getenv("WEB_HOOK_SECRET"),
+		GitLabWebHookToken: os.Getenv("GITLAB_WEB_HOOK_TOKEN"),
+		GiteaWebHookSecret: os.Getenv("GITEA_WEB_HOOK_SECRET"),
+		GenericWebHookSecret: os.Getenv("GENERIC_WEB_HOOK_SECRET"),
+		WebHookTriggers: webHookTriggers,
+		WebHookDeliveryRetention: helpers.GetDurationEnv("WEB_HOOK_DELIVERY_RETENTION", time.Hour * 72),
 		XmlFeedUrl: helpers.GetEnv("XML_FEED_URL", "https://blog.mybb.com/feed.xml"),
+		FeedPollInterval: helpers.GetDurationEnv("FEED_POLL_INTERVAL", 0),
 		HmacSecret: os.Getenv("HMAC_SECRET"),
+		ConfirmationTokenTtl: helpers.GetDurationEnv("CONFIRMATION_TOKEN_TTL", time.Hour * 48),
+		NotificationMode: helpers.GetEnv("NOTIFICATION_MODE", "each"),
+		HoldForApproval: os.Getenv("HOLD_FOR_APPROVAL") == "1",
+		ApprovalEmailAddress: os.Getenv("APPROVAL_EMAIL_ADDRESS"),
+		ApprovalAutoSendDelay: helpers.GetDurationEnv("APPROVAL_AUTO_SEND_DELAY", time.Hour * 24),
+		DigestWeekday: digestWeekday,
+		DigestHour: helpers.GetIntEnv("DIGEST_HOUR", 9),
+		AdminUsername: helpers.GetEnv("ADMIN_USERNAME", "admin"),
+		AdminPassword: os.Getenv("ADMIN_PASSWORD"),
+		JobWorkers: helpers.GetIntEnv("JOB_WORKERS", 2),
+		JobMaxAttempts: helpers.GetIntEnv("JOB_MAX_ATTEMPTS", 8),
+		JobRetryDelay: helpers.GetDurationEnv("JOB_RETRY_DELAY", time.Second * 30),
+		JobMaxRetryDelay: helpers.GetDurationEnv("JOB_MAX_RETRY_DELAY", time.Hour),
+		MailBackend: helpers.GetEnv("MAIL_BACKEND", "mailgun"),
 		MailGun: MailGunConfig{
 			Domain: os.Getenv("MAILGUN_DOMAIN"),
 			ApiKey: os.Getenv("MAILGUN_API_KEY"),
@@ -61,9 +233,41 @@ func InitFromEnvironment(dotEnvFile string) (*Config, error) {
 			MailingListAddress: os.Getenv("MAILING_LIST_ADDRESS"),
 			FromName: helpers.GetEnv("EMAIL_FROM_NAME", "MyBB Blog"),
 			EmailValidation: os.Getenv("MAILGUN_EMAIL_VALIDATION") == "1",
+			WebHookSigningKey: os.Getenv("MAILGUN_WEBHOOK_SIGNING_KEY"),
+			SoftBounceThreshold: helpers.GetIntEnv("MAILGUN_SOFT_BOUNCE_THRESHOLD", 3),
+		},
+		SMTP: SMTPConfig{
+			Host: os.Getenv("SMTP_HOST"),
+			Port: helpers.GetIntEnv("SMTP_PORT", 587),
+			Security: helpers.GetEnv("SMTP_SECURITY", "starttls"),
+			AuthMechanism: helpers.GetEnv("SMTP_AUTH", "plain"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			FromAddress: os.Getenv("SMTP_FROM_ADDRESS"),
+			FromName: helpers.GetEnv("EMAIL_FROM_NAME", "MyBB Blog"),
+		},
+		DryRun: DryRunConfig{
+			Directory: helpers.GetEnv("DRY_RUN_DIRECTORY", "./dry_run_mail"),
+			FromAddress: helpers.GetEnv("DRY_RUN_FROM_ADDRESS", "blog@localhost"),
+			FromName: helpers.GetEnv("EMAIL_FROM_NAME", "MyBB Blog"),
+		},
+		Failover: FailoverConfig{
+			Backends: parseList(helpers.GetEnv("MAIL_FAILOVER_BACKENDS", "mailgun,smtp")),
+			FailureThreshold: helpers.GetIntEnv("MAIL_FAILOVER_FAILURE_THRESHOLD", 3),
+			Cooldown: helpers.GetDurationEnv("MAIL_FAILOVER_COOLDOWN", time.Minute * 5),
+		},
+		Log: LogConfig{
+			Level: logLevel,
+			Format: helpers.GetEnv("LOG_FORMAT", "logfmt"),
+			RedactEmails: helpers.GetEnv("LOG_REDACT_EMAILS", "1") == "1",
 		},
 	}
 
+	// Emails recorded by the dry run backend are only opened locally, so their links can point at a local server
+	if len(config.BaseUrl) == 0 && config.MailBackend == "dryrun" {
+		config.BaseUrl = fmt.Sprintf("http://localhost:%d", config.ListenPort)
+	}
+
 	err := config.validate()
 
 	if err != nil {
@@ -73,6 +277,26 @@ func InitFromEnvironment(dotEnvFile string) (*Config, error) {
 	return config, nil
 }
 
+/// FromAddress gets the address and name emails are sent from by the configured mail backend. When failing over
+/// between backends, this is the address of the preferred backend.
+func (c *Config) FromAddress() (string, string) {
+	return c.backendFromAddress(c.MailBackend)
+}
+
+/// backendFromAddress gets the address and name emails are sent from by the mail backend with the given name.
+func (c *Config) backendFromAddress(backend string) (string, string) {
+	switch backend {
+	case "smtp":
+		return c.SMTP.FromAddress, c.SMTP.FromName
+	case "dryrun":
+		return c.DryRun.FromAddress, c.DryRun.FromName
+	case "failover":
+		return c.backendFromAddress(c.Failover.Backends[0])
+	default:
+		return c.MailGun.MailingListAddress, c.MailGun.FromName
+	}
+}
+
 func (c *Config) validate() error {
 	if c.ListenPort < 1 || c.ListenPort > math.MaxUint16 {
 		return OutOfRangeError{
@@ -80,12 +304,69 @@ func (c *Config) validate() error {
 		}
 	}
 
-	if len(c.WebHookSecret) == 0 {
+	if c.ShutdownTimeout <= 0 {
+		return OutOfRangeError{
+			ParameterName: "SHUTDOWN_TIMEOUT",
+		}
+	}
+
+	if len(c.BaseUrl) == 0 {
+		return RequiredConfigMissingError{
+			ParameterName: "BASE_URL",
+		}
+	}
+
+	if baseUrl, err := url.Parse(c.BaseUrl); err != nil || (baseUrl.Scheme != "http" && baseUrl.Scheme != "https") ||
+		len(baseUrl.Host) == 0 {
+		return OutOfRangeError{
+			ParameterName: "BASE_URL",
+		}
+	}
+
+	if len(c.MetricsAddr) > 0 {
+		if _, port, err := net.SplitHostPort(c.MetricsAddr); err != nil || len(port) == 0 {
+			return OutOfRangeError{
+				ParameterName: "METRICS_ADDR",
+			}
+		}
+	}
+
+	if c.WebHookEnabled && len(c.WebHookSecret) == 0 {
 		return RequiredConfigMissingError{
 			ParameterName: "WEB_HOOK_SECRET",
 		}
 	}
 
+	for _, rule := range c.WebHookTriggers {
+		switch rule.Event {
+		case "page_build", "push", "workflow_run", "deployment_status", "gitlab_pipeline", "gitea_push", "generic":
+		default:
+			return OutOfRangeError{
+				ParameterName: "WEB_HOOK_TRIGGERS",
+			}
+		}
+	}
+
+	if c.WebHookDeliveryRetention <= 0 {
+		return OutOfRangeError{
+			ParameterName: "WEB_HOOK_DELIVERY_RETENTION",
+		}
+	}
+
+	if c.FeedPollInterval < 0 {
+		return OutOfRangeError{
+			ParameterName: "FEED_POLL_INTERVAL",
+		}
+	}
+
+	// Without any trigger, notifications would never be sent
+	if !c.WebHookEnabled && len(c.GitLabWebHookToken) == 0 && len(c.GiteaWebHookSecret) == 0 &&
+		len(c.GenericWebHookSecret) == 0 && c.FeedPollInterval == 0 {
+		return RequiredConfigMissingError{
+			ParameterName: "FEED_POLL_INTERVAL",
+		}
+	}
+
 	if len(c.XmlFeedUrl) == 0 {
 		return RequiredConfigMissingError{
 			ParameterName: "XML_FEED_URL",
@@ -98,31 +379,174 @@ func (c *Config) validate() error {
 		}
 	}
 
-	if len(c.MailGun.Domain) == 0 {
+	if c.ConfirmationTokenTtl <= 0 {
+		return OutOfRangeError{
+			ParameterName: "CONFIRMATION_TOKEN_TTL",
+		}
+	}
+
+	if c.NotificationMode != "each" && c.NotificationMode != "combined" {
+		return OutOfRangeError{
+			ParameterName: "NOTIFICATION_MODE",
+		}
+	}
+
+	if c.HoldForApproval && len(c.ApprovalEmailAddress) == 0 {
+		return RequiredConfigMissingError{
+			ParameterName: "APPROVAL_EMAIL_ADDRESS",
+		}
+	}
+
+	if c.ApprovalAutoSendDelay < 0 {
+		return OutOfRangeError{
+			ParameterName: "APPROVAL_AUTO_SEND_DELAY",
+		}
+	}
+
+	if c.DigestHour < 0 || c.DigestHour > 23 {
+		return OutOfRangeError{
+			ParameterName: "DIGEST_HOUR",
+		}
+	}
+
+	if c.JobWorkers < 1 {
+		return OutOfRangeError{
+			ParameterName: "JOB_WORKERS",
+		}
+	}
+
+	if c.JobMaxAttempts < 1 {
+		return OutOfRangeError{
+			ParameterName: "JOB_MAX_ATTEMPTS",
+		}
+	}
+
+	if c.JobRetryDelay <= 0 {
+		return OutOfRangeError{
+			ParameterName: "JOB_RETRY_DELAY",
+		}
+	}
+
+	if c.JobMaxRetryDelay < c.JobRetryDelay {
+		return OutOfRangeError{
+			ParameterName: "JOB_MAX_RETRY_DELAY",
+		}
+	}
+
+	if c.Log.Format != "logfmt" && c.Log.Format != "json" {
+		return OutOfRangeError{
+			ParameterName: "LOG_FORMAT",
+		}
+	}
+
+	if c.MailGun.SoftBounceThreshold < 1 {
+		return OutOfRangeError{
+			ParameterName: "MAILGUN_SOFT_BOUNCE_THRESHOLD",
+		}
+	}
+
+	if c.MailBackend == "failover" {
+		return c.validateFailover()
+	}
+
+	if !isMailBackend(c.MailBackend) {
+		return OutOfRangeError{
+			ParameterName: "MAIL_BACKEND",
+		}
+	}
+
+	return c.validateBackendConfig(c.MailBackend)
+}
+
+/// isMailBackend checks whether the given name is the name of a single mail backend.
+func isMailBackend(backend string) bool {
+	switch backend {
+	case "mailgun", "smtp", "dryrun":
+		return true
+	default:
+		return false
+	}
+}
+
+/// validateBackendConfig validates the configuration of the mail backend with the given name.
+func (c *Config) validateBackendConfig(backend string) error {
+	switch backend {
+	case "mailgun":
+		return c.MailGun.validate()
+	case "smtp":
+		return c.SMTP.validate()
+	default:
+		return nil
+	}
+}
+
+/// validateFailover validates the configuration of every backend failed over between.
+func (c *Config) validateFailover() error {
+	if len(c.Failover.Backends) == 0 {
+		return RequiredConfigMissingError{
+			ParameterName: "MAIL_FAILOVER_BACKENDS",
+		}
+	}
+
+	seen := make(map[string]bool)
+
+	for _, backend := range c.Failover.Backends {
+		if !isMailBackend(backend) || seen[backend] {
+			return OutOfRangeError{
+				ParameterName: "MAIL_FAILOVER_BACKENDS",
+			}
+		}
+
+		seen[backend] = true
+	}
+
+	if c.Failover.FailureThreshold < 1 {
+		return OutOfRangeError{
+			ParameterName: "MAIL_FAILOVER_FAILURE_THRESHOLD",
+		}
+	}
+
+	if c.Failover.Cooldown <= 0 {
+		return OutOfRangeError{
+			ParameterName: "MAIL_FAILOVER_COOLDOWN",
+		}
+	}
+
+	for _, backend := range c.Failover.Backends {
+		if err := c.validateBackendConfig(backend); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *MailGunConfig) validate() error {
+	if len(c.Domain) == 0 {
 		return RequiredConfigMissingError{
 			ParameterName: "MAILGUN_DOMAIN",
 		}
 	}
 
-	if len(c.MailGun.ApiKey) == 0 {
+	if len(c.ApiKey) == 0 {
 		return RequiredConfigMissingError{
 			ParameterName: "MAILGUN_API_KEY",
 		}
 	}
 
-	if len(c.MailGun.PublicKey) == 0 {
+	if len(c.PublicKey) == 0 {
 		return RequiredConfigMissingError{
 			ParameterName: "MAILGUN_PUBLIC_KEY",
 		}
 	}
 
-	if len(c.MailGun.MailingListAddress) == 0 {
+	if len(c.MailingListAddress) == 0 {
 		return RequiredConfigMissingError{
 			ParameterName: "MAILING_LIST_ADDRESS",
 		}
 	}
 
-	if len(c.MailGun.FromName) == 0 {
+	if len(c.FromName) == 0 {
 		return RequiredConfigMissingError{
 			ParameterName: "EMAIL_FROM_NAME",
 		}
@@ -130,3 +554,71 @@ func (c *Config) validate() error {
 
 	return nil
 }
+
+func (c *SMTPConfig) validate() error {
+	if len(c.Host) == 0 {
+		return RequiredConfigMissingError{
+			ParameterName: "SMTP_HOST",
+		}
+	}
+
+	if c.Port < 1 || c.Port > math.MaxUint16 {
+		return OutOfRangeError{
+			ParameterName: "SMTP_PORT",
+		}
+	}
+
+	switch c.Security {
+	case "starttls", "tls", "none":
+	default:
+		return OutOfRangeError{
+			ParameterName: "SMTP_SECURITY",
+		}
+	}
+
+	switch c.AuthMechanism {
+	case "plain", "login":
+		if len(c.Username) == 0 {
+			return RequiredConfigMissingError{
+				ParameterName: "SMTP_USERNAME",
+			}
+		}
+	case "none":
+	default:
+		return OutOfRangeError{
+			ParameterName: "SMTP_AUTH",
+		}
+	}
+
+	if len(c.FromAddress) == 0 {
+		return RequiredConfigMissingError{
+			ParameterName: "SMTP_FROM_ADDRESS",
+		}
+	}
+
+	return nil
+}
+
+/// parseList parses a comma separated list, ignoring surrounding whitespace and empty items.
+func parseList(value string) []string {
+	var items []string
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+/// parseWeekday parses the English name of a day of the week, ignoring case.
+func parseWeekday(value string) (time.Weekday, bool) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(strings.TrimSpace(value), day.String()) {
+			return day, true
+		}
+	}
+
+	return time.Sunday, false
+}
\ No newline at end of file
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestBaseUrlRequired(t *testing.T) {
+	tests := []struct {
+		name     string
+		backend  string
+		baseUrl  string
+		expected string
+		err      error
+	}{
+		{"set", "dryrun", "https://blog-mailer.example.com/", "https://blog-mailer.example.com", nil},
+		{"missing when dry running", "dryrun", "", "http://localhost:8080", nil},
+		{"missing when sending", "smtp", "", "", RequiredConfigMissingError{"BASE_URL"}},
+		{"invalid", "dryrun", "blog-mailer.example.com", "", OutOfRangeError{"BASE_URL"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("WEB_HOOK_SECRET", "secret")
+			t.Setenv("HMAC_SECRET", "secret")
+			t.Setenv("SMTP_HOST", "localhost")
+			t.Setenv("SMTP_SECURITY", "none")
+			t.Setenv("SMTP_AUTH", "none")
+			t.Setenv("SMTP_FROM_ADDRESS", "blog@example.com")
+			t.Setenv("MAILING_LIST_ADDRESS", "subscribers@example.com")
+			t.Setenv("MAIL_BACKEND", test.backend)
+			t.Setenv("BASE_URL", test.baseUrl)
+
+			config, err := InitFromEnvironment("")
+
+			if err != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+
+			if err == nil && config.BaseUrl != test.expected {
+				t.Errorf("expected base URL '%s', got '%s'", test.expected, config.BaseUrl)
+			}
+		})
+	}
+}
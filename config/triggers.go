@@ -0,0 +1,76 @@
+package config
+
+import (
+	"strings"
+)
+
+/// TriggerRule describes a webhook event that means the site was deployed, so the feed should be checked.
+///
+/// Every field other than the event is optional, and an empty field matches any value.
+type TriggerRule struct {
+	/// Event is the type of the webhook event, such as "page_build" or "workflow_run".
+	Event string
+	/// Workflow is the name of the workflow that ran, for "workflow_run" events.
+	Workflow string
+	/// Branch is the branch that was built or deployed.
+	Branch string
+	/// Conclusion is the outcome of the event: the status of a page build, the conclusion of a workflow run or the
+	/// state of a deployment.
+	Conclusion string
+	/// Environment is the environment that was deployed to, for "deployment_status" events.
+	Environment string
+}
+
+/// parseTriggerRules parses a list of trigger rules separated by semicolons, each being an event type optionally
+/// followed by a colon and a comma separated list of `key=value` conditions, such as
+/// `workflow_run:workflow=Deploy,branch=main,conclusion=success`.
+func parseTriggerRules(value string) ([]TriggerRule, bool) {
+	var rules []TriggerRule
+
+	for _, ruleValue := range strings.Split(value, ";") {
+		ruleValue = strings.TrimSpace(ruleValue)
+
+		if len(ruleValue) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(ruleValue, ":", 2)
+
+		rule := TriggerRule{
+			Event: strings.TrimSpace(parts[0]),
+		}
+
+		if len(rule.Event) == 0 {
+			return nil, false
+		}
+
+		if len(parts) == 2 {
+			for _, condition := range strings.Split(parts[1], ",") {
+				keyValue := strings.SplitN(condition, "=", 2)
+
+				if len(keyValue) != 2 {
+					return nil, false
+				}
+
+				conditionValue := strings.TrimSpace(keyValue[1])
+
+				switch strings.TrimSpace(keyValue[0]) {
+				case "workflow":
+					rule.Workflow = conditionValue
+				case "branch":
+					rule.Branch = conditionValue
+				case "conclusion":
+					rule.Conclusion = conditionValue
+				case "environment":
+					rule.Environment = conditionValue
+				default:
+					return nil, false
+				}
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, len(rules) > 0
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTriggerRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		rules []TriggerRule
+		ok    bool
+	}{
+		{
+			name: "event only",
+			value: "page_build",
+			rules: []TriggerRule{{Event: "page_build"}},
+			ok: true,
+		},
+		{
+			name: "conditions",
+			value: "workflow_run:workflow=Deploy,branch=main,conclusion=success",
+			rules: []TriggerRule{{Event: "workflow_run", Workflow: "Deploy", Branch: "main", Conclusion: "success"}},
+			ok: true,
+		},
+		{
+			name: "several rules with spaces",
+			value: " page_build:conclusion=built ; deployment_status : environment = production ;",
+			rules: []TriggerRule{
+				{Event: "page_build", Conclusion: "built"},
+				{Event: "deployment_status", Environment: "production"},
+			},
+			ok: true,
+		},
+		{
+			name: "empty",
+			value: " ; ",
+			ok: false,
+		},
+		{
+			name: "missing event",
+			value: ":branch=main",
+			ok: false,
+		},
+		{
+			name: "condition without value",
+			value: "workflow_run:branch",
+			ok: false,
+		},
+		{
+			name: "unknown condition",
+			value: "workflow_run:actor=someone",
+			ok: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules, ok := parseTriggerRules(test.value)
+
+			if ok != test.ok {
+				t.Fatalf("expected ok to be %t, got %t", test.ok, ok)
+			}
+
+			if test.ok && !reflect.DeepEqual(rules, test.rules) {
+				t.Errorf("expected %+v, got %+v", test.rules, rules)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// confirmationToken is the signed content of a subscription confirmation link.
+type confirmationToken struct {
+	/// EmailAddress is the email address that signed up.
+	EmailAddress string `json:"email"`
+	/// Name is the name that was given when signing up.
+	Name string `json:"name"`
+	/// Frequency is how often the subscriber chose to be emailed. Tokens issued before digests existed have none.
+	Frequency storage.SubscriberFrequency `json:"frequency,omitempty"`
+	/// IssuedAt is the Unix time the token was generated at.
+	IssuedAt int64 `json:"iat"`
+	/// Nonce is a random value making the token unique, recorded once used so the token can only be used once.
+	Nonce string `json:"nonce"`
+}
+
+/// InvalidTokenError is an error returned if a confirmation token is malformed or its signature doesn't match.
+type InvalidTokenError struct{}
+
+func (e InvalidTokenError) Error() string {
+	return "confirmation token is invalid"
+}
+
+/// TokenExpiredError is an error returned if a confirmation token is authentic but was issued too long ago.
+type TokenExpiredError struct {
+	/// Token is the expired token, which can be trusted to contain the details originally signed up with.
+	Token *confirmationToken
+}
+
+func (e TokenExpiredError) Error() string {
+	return "confirmation token has expired"
+}
+
+/// generateEmailConfirmationToken generates a signed token to confirm the subscription of the given email address.
+///
+/// The token has the form `<base64 payload>.<base64 signature>`, so the fields can't be confused with each other no
+/// matter which characters they contain.
+func (subService *SubscriptionService) generateEmailConfirmationToken(emailAddress, name string,
+	frequency storage.SubscriberFrequency) (string, error) {
+	nonce := make([]byte, 16)
+
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("error reading random bytes for confirmation token nonce: %s", err)
+	}
+
+	payload, err := json.Marshal(&confirmationToken{
+		EmailAddress: emailAddress,
+		Name: name,
+		Frequency: frequency,
+		IssuedAt: time.Now().Unix(),
+		Nonce: hex.EncodeToString(nonce),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+
+	return encodedPayload + "." + subService.signConfirmationPayload(encodedPayload), nil
+}
+
+/// parseEmailConfirmationToken verifies the signature and age of a confirmation token and returns its content.
+///
+/// A TokenExpiredError is returned for an authentic token that is too old, so that the details can still be offered
+/// for a new confirmation email.
+func (subService *SubscriptionService) parseEmailConfirmationToken(token string) (*confirmationToken, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 2 {
+		return nil, InvalidTokenError{}
+	}
+
+	expectedSignature := subService.signConfirmationPayload(parts[0])
+
+	if subtle.ConstantTimeCompare([]byte(expectedSignature), []byte(parts[1])) != 1 {
+		return nil, InvalidTokenError{}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+
+	if err != nil {
+		return nil, InvalidTokenError{}
+	}
+
+	parsed := &confirmationToken{}
+
+	if err = json.Unmarshal(payload, parsed); err != nil || len(parsed.EmailAddress) == 0 || len(parsed.Nonce) == 0 {
+		return nil, InvalidTokenError{}
+	}
+
+	if time.Now().After(parsed.expiresAt(subService.confirmationTokenTtl)) {
+		return nil, TokenExpiredError{
+			Token: parsed,
+		}
+	}
+
+	return parsed, nil
+}
+
+/// frequency gets how often the subscriber chose to be emailed, being every post for tokens that don't say.
+func (t *confirmationToken) frequency() storage.SubscriberFrequency {
+	if len(t.Frequency) == 0 {
+		return storage.FrequencyEveryPost
+	}
+
+	return t.Frequency
+}
+
+/// expiresAt gets the time the token stops being valid.
+func (t *confirmationToken) expiresAt(ttl time.Duration) time.Time {
+	return time.Unix(t.IssuedAt, 0).Add(ttl)
+}
+
+func (subService *SubscriptionService) signConfirmationPayload(encodedPayload string) string {
+	message := "confirm." + encodedPayload
+
+	key := []byte(subService.hmacSecret)
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(message))
+
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+func newTestTokenService(ttl time.Duration) *SubscriptionService {
+	return &SubscriptionService{
+		hmacSecret: "secret",
+		confirmationTokenTtl: ttl,
+	}
+}
+
+func TestConfirmationTokenRoundTrip(t *testing.T) {
+	subService := newTestTokenService(time.Hour)
+
+	token, err := subService.generateEmailConfirmationToken("someone@example.com", "Some.One", storage.FrequencyWeeklyDigest)
+	if err != nil {
+		t.Fatalf("error generating token: %s", err)
+	}
+
+	parsed, err := subService.parseEmailConfirmationToken(token)
+	if err != nil {
+		t.Fatalf("error parsing token: %s", err)
+	}
+
+	if parsed.EmailAddress != "someone@example.com" || parsed.Name != "Some.One" {
+		t.Errorf("unexpected token content %+v", parsed)
+	}
+
+	if parsed.frequency() != storage.FrequencyWeeklyDigest {
+		t.Errorf("expected frequency %s, got %s", storage.FrequencyWeeklyDigest, parsed.frequency())
+	}
+
+	other, err := subService.generateEmailConfirmationToken("someone@example.com", "Some.One", storage.FrequencyWeeklyDigest)
+	if err != nil {
+		t.Fatalf("error generating token: %s", err)
+	}
+
+	if other == token {
+		t.Error("expected every token to have its own nonce")
+	}
+}
+
+func TestConfirmationTokenInvalid(t *testing.T) {
+	subService := newTestTokenService(time.Hour)
+
+	token, err := subService.generateEmailConfirmationToken("someone@example.com", "", "")
+	if err != nil {
+		t.Fatalf("error generating token: %s", err)
+	}
+
+	parts := strings.Split(token, ".")
+	otherService := &SubscriptionService{
+		hmacSecret: "other",
+	}
+
+	tests := map[string]string{
+		"empty": "",
+		"no signature": parts[0],
+		"wrong signature": parts[0] + "." + subService.signConfirmationPayload("other"),
+		"extra part": token + ".extra",
+		"signed by another secret": parts[0] + "." + otherService.signConfirmationPayload(parts[0]),
+	}
+
+	for name, value := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := subService.parseEmailConfirmationToken(value); err != (InvalidTokenError{}) {
+				t.Errorf("expected InvalidTokenError, got %v", err)
+			}
+		})
+	}
+}
+
+func TestConfirmationTokenExpired(t *testing.T) {
+	subService := newTestTokenService(-time.Minute)
+
+	token, err := subService.generateEmailConfirmationToken("someone@example.com", "", "")
+	if err != nil {
+		t.Fatalf("error generating token: %s", err)
+	}
+
+	_, err = subService.parseEmailConfirmationToken(token)
+
+	expired, ok := err.(TokenExpiredError)
+
+	if !ok {
+		t.Fatalf("expected TokenExpiredError, got %v", err)
+	}
+
+	if expired.Token.EmailAddress != "someone@example.com" {
+		t.Errorf("expected the expired token's content, got %+v", expired.Token)
+	}
+
+	if expired.Token.frequency() != storage.FrequencyEveryPost {
+		t.Errorf("expected a token without a frequency to default to %s", storage.FrequencyEveryPost)
+	}
+}
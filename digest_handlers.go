@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/logging"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// sendDigestJobKind is the kind of job that sends the weekly digest of a period.
+const sendDigestJobKind = "send_digest"
+
+/// digestJobPayload is the payload of a job sending a digest.
+type digestJobPayload struct {
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+}
+
+/// SendDigest handles a job sending the digest of the posts sent during a period to every subscriber who chose weekly
+/// digests, rather than a notification of every post.
+///
+/// The result for each subscriber is recorded, so that a retry of the job only sends the digest to the subscribers
+/// it failed for. The context is checked between subscribers, and if it is cancelled, the digest is recorded as failed
+/// so that the retry carries on with the subscribers it wasn't sent to.
+func (whService *WebHookService) SendDigest(ctx context.Context, job *storage.Job) error {
+	var payload digestJobPayload
+
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("error parsing digest job payload: %s", err)
+	}
+
+	digest, err := whService.store.GetDigest(payload.PeriodEnd)
+
+	if err != nil {
+		return fmt.Errorf("error reading digest: %s", err)
+	}
+
+	if digest == nil {
+		digest = &storage.Digest{
+			PeriodStart: payload.PeriodStart,
+			PeriodEnd: payload.PeriodEnd,
+			JobId: job.Id,
+		}
+	}
+
+	if digest.Status == storage.DigestSent || digest.Status == storage.DigestEmpty {
+		return nil
+	}
+
+	posts, err := whService.digestPosts(digest)
+
+	if err != nil {
+		return err
+	}
+
+	if len(posts) == 0 {
+		whService.logger.Debug("no posts were sent during the period, so there is no digest to send",
+			"period_start", digest.PeriodStart, "period_end", digest.PeriodEnd)
+
+		digest.Status = storage.DigestEmpty
+
+		return whService.store.SaveDigest(digest)
+	}
+
+	subscribers, err := whService.store.ListSubscribers(storage.SubscriberActive)
+
+	if err != nil {
+		return fmt.Errorf("error listing subscribers to send digest to: %s", err)
+	}
+
+	notification := whService.planDigest(posts)
+
+	var tally deliveryTally
+	var interruptErr error
+
+	for _, subscriber := range subscribers {
+		if interruptErr = ctx.Err(); interruptErr != nil {
+			break
+		}
+
+		if !subscriber.WantsDigest() {
+			continue
+		}
+
+		previousDelivery, err := whService.store.GetDelivery(digest.DeliveryKey(), subscriber.EmailAddress)
+
+		if err != nil {
+			return fmt.Errorf("error reading digest deliveries: %s", err)
+		}
+
+		if previousDelivery != nil && previousDelivery.Settled() {
+			tally.add(previousDelivery)
+
+			continue
+		}
+
+		sentMessage, err := whService.notifySubscriber(&subscriber, notification)
+
+		delivery := newDelivery(previousDelivery, subscriber.EmailAddress, sentMessage, err)
+
+		if err != nil {
+			whService.logDeliveryFailure("digest", notification.subject, delivery, err)
+		}
+
+		tally.add(delivery)
+
+		if err = whService.store.RecordDelivery(digest.DeliveryKey(), delivery); err != nil {
+			whService.logger.Warn("error recording delivery", "subject", notification.subject,
+				logging.Email(subscriber.EmailAddress), logging.Error(err))
+		}
+	}
+
+	if interruptErr != nil {
+		whService.logger.Warn("interrupted sending digest", "subject", notification.subject, "delivered",
+			tally.delivered, "failed", tally.failed, logging.Error(interruptErr))
+	} else {
+		whService.logger.Info("sent digest", "subject", notification.subject, "delivered", tally.delivered, "failed",
+			tally.failed, "retrying", tally.retrying)
+	}
+
+	digest.PostKeys = nil
+
+	for _, post := range posts {
+		digest.PostKeys = append(digest.PostKeys, post.Key)
+	}
+
+	digest.SentAt = time.Now().UTC()
+	digest.Delivered = tally.delivered
+	digest.Failed = tally.failed
+
+	if tally.retrying > 0 || interruptErr != nil {
+		digest.Status = storage.DigestFailed
+	} else {
+		digest.Status = storage.DigestSent
+	}
+
+	if err = whService.store.SaveDigest(digest); err != nil {
+		whService.logger.Warn("error recording digest", "status", digest.Status, logging.Error(err))
+	}
+
+	if interruptErr != nil {
+		return tally.interrupted(interruptErr)
+	}
+
+	return tally.err()
+}
+
+/// digestPosts lists the posts whose notifications were first sent during the period of a digest, oldest first.
+func (whService *WebHookService) digestPosts(digest *storage.Digest) ([]*newBlogPost, error) {
+	sentPosts, err := whService.store.ListSentPosts()
+
+	if err != nil {
+		return nil, fmt.Errorf("error listing sent posts: %s", err)
+	}
+
+	var posts []*newBlogPost
+
+	for _, sentPost := range sentPosts {
+		if sentPost.Status != storage.SentPostSent && sentPost.Status != storage.SentPostFailed {
+			continue
+		}
+
+		// Retrying failed deliveries moves SentAt on, so posts are listed by when they were first sent so that they are
+		// only ever in one digest. Posts sent before FirstSentAt was recorded only have SentAt.
+		firstSentAt := sentPost.FirstSentAt
+
+		if firstSentAt.IsZero() {
+			firstSentAt = sentPost.SentAt
+		}
+
+		if firstSentAt.Before(digest.PeriodStart) || !firstSentAt.Before(digest.PeriodEnd) {
+			continue
+		}
+
+		posts = append(posts, &newBlogPost{
+			Key: sentPost.Key,
+			Title: sentPost.Title,
+			Summary: sentPost.Summary,
+			Url: sentPost.Url,
+			PublishedAt: sentPost.PublishedAt,
+			Author: sentPost.Author,
+		})
+	}
+
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].PublishedAt.Before(posts[j].PublishedAt)
+	})
+
+	return posts, nil
+}
+
+/// planDigest builds the digest listing the given posts.
+func (whService *WebHookService) planDigest(posts []*newBlogPost) *notification {
+	subject := "MyBB Blog Weekly Digest: 1 New Post"
+
+	if len(posts) > 1 {
+		subject = fmt.Sprintf("MyBB Blog Weekly Digest: %d New Posts", len(posts))
+	}
+
+	return &notification{
+		posts: posts,
+		subject: subject,
+		templateName: "emails/digest",
+		buildData: func(recipient notificationRecipient) interface{} {
+			return &blogPostsNotification{
+				Posts: posts,
+				notificationRecipient: recipient,
+			}
+		},
+	}
+}
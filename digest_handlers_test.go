@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+func TestDigestPosts(t *testing.T) {
+	store := newTestSubscriptionService(t).store
+	whService := &WebHookService{
+		store: store,
+	}
+
+	periodEnd := time.Date(2024, 6, 10, 9, 0, 0, 0, time.UTC)
+	digest := &storage.Digest{
+		PeriodStart: periodEnd.AddDate(0, 0, -7),
+		PeriodEnd: periodEnd,
+	}
+
+	sentPosts := []*storage.SentPost{
+		// Sent during the period
+		{Key: "in-period", Status: storage.SentPostSent, FirstSentAt: periodEnd.AddDate(0, 0, -2),
+			SentAt: periodEnd.AddDate(0, 0, -2)},
+		// Sent during the period, with failed deliveries retried after it ended
+		{Key: "retried-after-period", Status: storage.SentPostSent, FirstSentAt: periodEnd.AddDate(0, 0, -1),
+			SentAt: periodEnd.AddDate(0, 0, 1)},
+		// Sent during the previous period, with failed deliveries retried during this one
+		{Key: "retried-during-period", Status: storage.SentPostFailed, FirstSentAt: periodEnd.AddDate(0, 0, -8),
+			SentAt: periodEnd.AddDate(0, 0, -3)},
+		// Sent during the period before FirstSentAt was recorded
+		{Key: "before-first-sent-at", Status: storage.SentPostSent, SentAt: periodEnd.AddDate(0, 0, -4)},
+		{Key: "skipped", Status: storage.SentPostSkipped, SentAt: periodEnd.AddDate(0, 0, -5)},
+	}
+
+	for _, sentPost := range sentPosts {
+		if err := store.SaveSentPost(sentPost); err != nil {
+			t.Fatalf("error saving sent post: %s", err)
+		}
+	}
+
+	posts, err := whService.digestPosts(digest)
+	if err != nil {
+		t.Fatalf("error listing digest posts: %s", err)
+	}
+
+	listed := make(map[string]bool)
+
+	for _, post := range posts {
+		listed[post.Key] = true
+	}
+
+	expected := map[string]bool{
+		"in-period": true,
+		"retried-after-period": true,
+		"before-first-sent-at": true,
+	}
+
+	for _, sentPost := range sentPosts {
+		if listed[sentPost.Key] != expected[sentPost.Key] {
+			t.Errorf("expected post '%s' listed to be %t, got %t", sentPost.Key, expected[sentPost.Key],
+				listed[sentPost.Key])
+		}
+	}
+}
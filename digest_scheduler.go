@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/jobs"
+	"github.com/mybb/mybb-blog-mailer/logging"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// digestCheckInterval is how often the digest scheduler checks whether a digest is due.
+const digestCheckInterval = time.Minute
+
+/// digestPeriod is the length of the period each digest covers.
+const digestPeriod = time.Hour * 24 * 7
+
+/// DigestScheduler queues a job to send the weekly digest each time one is due.
+///
+/// Every digest queued is recorded, so that a digest is queued exactly once however often the server is restarted,
+/// and a digest due while the server was stopped is queued as soon as it starts again.
+type DigestScheduler struct {
+	store    *storage.Store
+	jobQueue *jobs.Queue
+	weekday  time.Weekday
+	hour     int
+	logger   *slog.Logger
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewDigestScheduler(store *storage.Store, jobQueue *jobs.Queue, configuration *config.Config,
+	logger *slog.Logger) *DigestScheduler {
+	return &DigestScheduler{
+		store: store,
+		jobQueue: jobQueue,
+		weekday: configuration.DigestWeekday,
+		hour: configuration.DigestHour,
+		logger: logger,
+		stop: make(chan struct{}),
+	}
+}
+
+/// Start starts checking for due digests in the background, beginning straight away.
+func (scheduler *DigestScheduler) Start() {
+	scheduler.wg.Add(1)
+
+	go func() {
+		defer scheduler.wg.Done()
+
+		ticker := time.NewTicker(digestCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := scheduler.check(); err != nil {
+				scheduler.logger.Error("error scheduling digest", logging.Error(err))
+			}
+
+			select {
+			case <-scheduler.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+/// Stop stops checking for due digests, waiting for a check in progress to finish.
+func (scheduler *DigestScheduler) Stop() {
+	close(scheduler.stop)
+
+	scheduler.wg.Wait()
+}
+
+/// check queues the most recently due digest if it hasn't been queued yet.
+///
+/// The digest covers the week before it is due, or everything since the previous digest if that was longer ago, so
+/// that posts sent while the server was stopped aren't left out.
+func (scheduler *DigestScheduler) check() error {
+	periodEnd := scheduler.lastDueAt(time.Now().UTC())
+
+	digest, err := scheduler.store.GetDigest(periodEnd)
+
+	if err != nil || digest != nil {
+		return err
+	}
+
+	periodStart := periodEnd.Add(-digestPeriod)
+
+	latestDigest, err := scheduler.store.GetLatestDigest()
+
+	if err != nil {
+		return err
+	}
+
+	if latestDigest != nil {
+		// The schedule was moved earlier, so the period due has already been covered
+		if !latestDigest.PeriodEnd.Before(periodEnd) {
+			return nil
+		}
+
+		periodStart = latestDigest.PeriodEnd
+	}
+
+	scheduler.logger.Debug("queueing digest", "period_start", periodStart, "period_end", periodEnd)
+
+	job, err := scheduler.jobQueue.Enqueue(sendDigestJobKind, &digestJobPayload{
+		PeriodStart: periodStart,
+		PeriodEnd: periodEnd,
+	})
+
+	if err != nil {
+		return fmt.Errorf("error queueing digest: %s", err)
+	}
+
+	// Only record the digest once its job is queued, so that a failure is retried by the next check
+	return scheduler.store.SaveDigest(&storage.Digest{
+		PeriodStart: periodStart,
+		PeriodEnd: periodEnd,
+		Status: storage.DigestQueued,
+		JobId: job.Id,
+	})
+}
+
+/// lastDueAt gets the most recent time a digest was due at, at or before the given time.
+func (scheduler *DigestScheduler) lastDueAt(now time.Time) time.Time {
+	dueAt := time.Date(now.Year(), now.Month(), now.Day(), scheduler.hour, 0, 0, 0, time.UTC)
+	dueAt = dueAt.AddDate(0, 0, -int((now.Weekday()-scheduler.weekday+7)%7))
+
+	if dueAt.After(now) {
+		dueAt = dueAt.AddDate(0, 0, -7)
+	}
+
+	return dueAt
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/jobs"
+	"github.com/mybb/mybb-blog-mailer/logging"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// FeedPoller periodically queues a feed check to notify subscribers of new posts, so that new posts are sent without
+/// relying on a webhook.
+///
+/// The feed check fetches the feed with a conditional request using the ETag and Last-Modified headers of the previous
+/// response, so polling is cheap for both sides and the feed is only downloaded when it changes.
+type FeedPoller struct {
+	store    *storage.Store
+	jobQueue *jobs.Queue
+	interval time.Duration
+	logger   *slog.Logger
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewFeedPoller(store *storage.Store, jobQueue *jobs.Queue, configuration *config.Config,
+	logger *slog.Logger) *FeedPoller {
+	return &FeedPoller{
+		store: store,
+		jobQueue: jobQueue,
+		interval: configuration.FeedPollInterval,
+		logger: logger,
+		stop: make(chan struct{}),
+	}
+}
+
+/// Start starts polling the feed in the background, beginning straight away.
+func (poller *FeedPoller) Start() {
+	poller.wg.Add(1)
+
+	go func() {
+		defer poller.wg.Done()
+
+		ticker := time.NewTicker(poller.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := poller.poll(); err != nil {
+				poller.logger.Error("error polling feed", logging.Error(err))
+			}
+
+			select {
+			case <-poller.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+/// Stop stops polling the feed, waiting for a poll in progress to finish.
+func (poller *FeedPoller) Stop() {
+	close(poller.stop)
+
+	poller.wg.Wait()
+}
+
+/// poll queues a feed check, unless one is already waiting to run.
+func (poller *FeedPoller) poll() error {
+	pendingJobs, err := poller.store.ListJobs(storage.JobPending)
+
+	if err != nil {
+		return fmt.Errorf("error listing jobs: %s", err)
+	}
+
+	// A feed check waiting to run, such as one being retried after the feed couldn't be read, will see any change
+	for _, job := range pendingJobs {
+		if job.Kind == checkFeedJobKind {
+			return nil
+		}
+	}
+
+	poller.logger.Debug("queueing feed check")
+
+	if _, err = poller.jobQueue.Enqueue(checkFeedJobKind, nil); err != nil {
+		return fmt.Errorf("error queueing feed check: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/logging"
+	"github.com/mybb/mybb-blog-mailer/mail"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// readinessCheckTimeout is how long a readiness check can take before it is reported as failed.
+const readinessCheckTimeout = time.Second * 5
+
+/// readinessCacheTtl is how long the result of a check against another server is reused for, so that frequent probes
+/// don't put load on the feed or the mail provider.
+const readinessCacheTtl = time.Minute
+
+/// requiredTemplates lists the templates that must be loaded for the mailer to serve pages and send emails.
+var requiredTemplates = []string{
+	"index.html",
+	"signup.html",
+	"confirm.html",
+	"confirm_expired.html",
+	"unsubscribe.html",
+	"unsubscribed.html",
+	"emails/confirm_subscription.txt",
+	"emails/confirm_subscription.html",
+	"emails/blog_post_notification.txt",
+	"emails/blog_post_notification.html",
+	"emails/blog_posts_notification.txt",
+	"emails/blog_posts_notification.html",
+	"emails/digest.txt",
+	"emails/digest.html",
+	"emails/campaign_approval.txt",
+	"emails/campaign_approval.html",
+}
+
+/// HealthService serves the /healthz and /readyz probes of a container orchestrator.
+type HealthService struct {
+	checks []readinessCheck
+	logger *slog.Logger
+}
+
+/// readinessCheck is a dependency checked before the mailer is reported as ready to serve requests.
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+/// checkResult is the result of a single readiness check.
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+/// readinessReport is the body of a response to /readyz.
+type readinessReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+/// cachedCheck reuses the result of a check for a while.
+type cachedCheck struct {
+	check     func() error
+	ttl       time.Duration
+	lock      sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+/// run runs the check, unless it was run within the TTL.
+func (c *cachedCheck) run() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if time.Since(c.checkedAt) < c.ttl {
+		return c.err
+	}
+
+	c.err = c.check()
+	c.checkedAt = time.Now()
+
+	return c.err
+}
+
+func NewHealthService(templates *template.Template, store *storage.Store, mailHandler mail.Handler,
+	whService *WebHookService, logger *slog.Logger) *HealthService {
+	feedCheck := &cachedCheck{
+		check: func() error {
+			_, _, err := whService.fetchFeed(nil)
+
+			return err
+		},
+		ttl: readinessCacheTtl,
+	}
+
+	mailCheck := &cachedCheck{
+		check: mailHandler.Ping,
+		ttl: readinessCacheTtl,
+	}
+
+	return &HealthService{
+		checks: []readinessCheck{
+			{"templates", func() error {
+				return checkTemplates(templates)
+			}},
+			// The ledger of sent posts in the database replaced the last post date file as the state that must be
+			// written once a notification is sent
+			{"state", store.Ping},
+			{"feed", feedCheck.run},
+			{"mail", mailCheck.run},
+		},
+		logger: logger,
+	}
+}
+
+/// Healthz handles a request to /healthz, reporting that the process is alive.
+func (healthService *HealthService) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]string{
+		"status": "ok",
+	})
+}
+
+/// Readyz handles a request to /readyz, checking that the templates are loaded, the database can be written to, the
+/// feed can be fetched and the mail backend can be reached.
+///
+/// Each check is reported separately, and the response has a 503 status if any of them failed.
+func (healthService *HealthService) Readyz(w http.ResponseWriter, r *http.Request) {
+	report := readinessReport{
+		Status: "ready",
+		Checks: make(map[string]checkResult),
+	}
+
+	results := make([]error, len(healthService.checks))
+
+	var wg sync.WaitGroup
+
+	for i, check := range healthService.checks {
+		wg.Add(1)
+
+		go func(i int, check readinessCheck) {
+			defer wg.Done()
+
+			results[i] = runWithTimeout(check.check, readinessCheckTimeout)
+		}(i, check)
+	}
+
+	wg.Wait()
+
+	status := http.StatusOK
+
+	for i, check := range healthService.checks {
+		if results[i] == nil {
+			report.Checks[check.name] = checkResult{
+				Status: "ok",
+			}
+
+			continue
+		}
+
+		logging.FromContext(r.Context(), healthService.logger).Warn("readiness check failed", "check", check.name,
+			logging.Error(results[i]))
+
+		report.Status = "not_ready"
+		report.Checks[check.name] = checkResult{
+			Status: "failed",
+			Error: results[i].Error(),
+		}
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJson(w, status, report)
+}
+
+/// checkTemplates checks that every required template is loaded.
+func checkTemplates(templates *template.Template) error {
+	if templates == nil {
+		return fmt.Errorf("templates aren't loaded")
+	}
+
+	for _, name := range requiredTemplates {
+		if templates.Lookup(name) == nil {
+			return fmt.Errorf("template '%s' isn't loaded", name)
+		}
+	}
+
+	return nil
+}
+
+/// runWithTimeout runs a check, failing if it doesn't finish within the timeout. A check that times out is left to
+/// finish in the background.
+func runWithTimeout(check func() error, timeout time.Duration) error {
+	result := make(chan error, 1)
+
+	go func() {
+		result <- check()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+/// writeJson writes a value as a JSON response with the given status.
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(value)
+}
@@ -3,6 +3,7 @@ package helpers
 import (
 	"os"
 	"strconv"
+	"time"
 )
 
 /// GetIntEnv gets an integer value from the environment, returning a default value if the value doesn't exist or is not numeric.
@@ -22,5 +23,16 @@ func GetEnv(name string, defaultValue string) string {
 		return strVal
 	}
 
+	return defaultValue
+}
+
+/// GetDurationEnv gets a duration value such as `48h` from the environment, returning a default value if the value doesn't exist or is not a valid duration.
+func GetDurationEnv(name string, defaultValue time.Duration) time.Duration {
+	if strVal, ok := os.LookupEnv(name); ok && len(strVal) > 0 {
+		if durationVal, err := time.ParseDuration(strVal); err == nil {
+			return durationVal
+		}
+	}
+
 	return defaultValue
 }
\ No newline at end of file
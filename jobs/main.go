@@ -0,0 +1,319 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/logging"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// pollInterval is how often idle workers check for jobs that have become due, such as retries.
+const pollInterval = time.Second * 5
+
+/// pruneInterval is how often old jobs are pruned.
+const pruneInterval = time.Hour
+
+/// succeededJobRetention is how long succeeded jobs are kept for before being pruned.
+const succeededJobRetention = time.Hour * 24 * 7
+
+/// deadJobRetention is how long dead jobs are kept for before being pruned, which is longer than succeeded jobs so that
+/// they can be inspected.
+const deadJobRetention = time.Hour * 24 * 30
+
+/// interruptTimeout is how long running jobs are given to stop once their context is cancelled on shutdown, such as to
+/// record the deliveries a notification made before it was interrupted.
+const interruptTimeout = time.Second * 2
+
+/// HandlerFunc processes a job, returning an error if the job failed and should be retried.
+///
+/// The context is cancelled if the queue is stopped before the job finishes, in which case the handler should stop as
+/// soon as it can do so without losing track of its progress, and return an error so that the job is run again.
+type HandlerFunc func(ctx context.Context, job *storage.Job) error
+
+/// Queue is a durable queue of background jobs processed by a pool of workers.
+///
+/// Failed jobs are retried with exponential backoff until they reach the maximum number of attempts, at which point
+/// they are marked as dead. Jobs are persisted in the store, so pending jobs survive restarts.
+type Queue struct {
+	store            *storage.Store
+	handlers         map[string]HandlerFunc
+	workers          int
+	maxAttempts      int
+	retryDelay       time.Duration
+	maxRetryDelay    time.Duration
+	pollInterval     time.Duration
+	interruptTimeout time.Duration
+	logger           *slog.Logger
+	wake             chan struct{}
+	stop             chan struct{}
+	/// ctx is the context running jobs are given, which is cancelled by interrupt once stopping the queue times out.
+	ctx       context.Context
+	interrupt context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+/// NewQueue creates a queue of jobs stored in the given store.
+func NewQueue(store *storage.Store, configuration *config.Config, logger *slog.Logger) *Queue {
+	ctx, interrupt := context.WithCancel(context.Background())
+
+	return &Queue{
+		store: store,
+		handlers: make(map[string]HandlerFunc),
+		workers: configuration.JobWorkers,
+		maxAttempts: configuration.JobMaxAttempts,
+		retryDelay: configuration.JobRetryDelay,
+		maxRetryDelay: configuration.JobMaxRetryDelay,
+		pollInterval: pollInterval,
+		interruptTimeout: interruptTimeout,
+		logger: logger,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		ctx: ctx,
+		interrupt: interrupt,
+	}
+}
+
+/// Handle registers the handler for jobs of the given kind. Handlers must be registered before the queue is started.
+func (q *Queue) Handle(kind string, handler HandlerFunc) {
+	q.handlers[kind] = handler
+}
+
+/// Enqueue adds a job of the given kind to the queue, with an optional payload that is encoded as JSON.
+func (q *Queue) Enqueue(kind string, payload interface{}) (*storage.Job, error) {
+	return q.EnqueueAt(kind, payload, time.Now())
+}
+
+/// EnqueueAt adds a job of the given kind to the queue to be run no earlier than the given time, with an optional
+/// payload that is encoded as JSON.
+func (q *Queue) EnqueueAt(kind string, payload interface{}, runAt time.Time) (*storage.Job, error) {
+	job := &storage.Job{
+		Kind: kind,
+		RunAt: runAt.UTC(),
+	}
+
+	if payload != nil {
+		encoded, err := json.Marshal(payload)
+
+		if err != nil {
+			return nil, fmt.Errorf("error encoding payload for %s job: %s", kind, err)
+		}
+
+		job.Payload = encoded
+	}
+
+	if err := q.store.EnqueueJob(job); err != nil {
+		return nil, err
+	}
+
+	// Wake an idle worker rather than waiting for the next poll, unless one has already been woken
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return job, nil
+}
+
+/// Start recovers jobs interrupted by the last shutdown and starts the workers.
+func (q *Queue) Start() error {
+	requeued, err := q.store.RequeueRunningJobs()
+
+	if err != nil {
+		return fmt.Errorf("error requeueing interrupted jobs: %s", err)
+	}
+
+	if requeued > 0 {
+		q.logger.Warn("requeued jobs interrupted by the last shutdown", "jobs", requeued)
+	}
+
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+
+		go q.work()
+	}
+
+	q.wg.Add(1)
+
+	go q.pruneRegularly()
+
+	return nil
+}
+
+/// Stop stops the workers, waiting for any running jobs to finish until the context is done.
+///
+/// Jobs still running when the context is done have their own context cancelled, and are given a little longer to stop
+/// and be requeued. Jobs that don't stop in time are left to be killed, and are requeued by the next Start.
+func (q *Queue) Stop(ctx context.Context) error {
+	close(q.stop)
+
+	stopped := make(chan struct{})
+
+	go func() {
+		q.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.logger.Warn("interrupting running jobs", "timeout", q.interruptTimeout)
+
+	q.interrupt()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-time.After(q.interruptTimeout):
+		return fmt.Errorf("error waiting for running jobs to finish: %s", ctx.Err())
+	}
+}
+
+/// work runs jobs as they become due until the queue is stopped.
+func (q *Queue) work() {
+	defer q.wg.Done()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+
+		job, err := q.store.ClaimJob(time.Now())
+
+		if err != nil {
+			q.logger.Error("error claiming job", logging.Error(err))
+		}
+
+		if job != nil {
+			q.run(job)
+
+			continue
+		}
+
+		select {
+		case <-q.stop:
+			return
+		case <-q.wake:
+		case <-time.After(q.pollInterval):
+		}
+	}
+}
+
+/// pruneRegularly prunes old jobs straight away and then every prune interval until the queue is stopped.
+func (q *Queue) pruneRegularly() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		q.prune()
+
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/// prune deletes succeeded and dead jobs that are older than they are kept for.
+func (q *Queue) prune() {
+	now := time.Now()
+
+	pruned, err := q.store.PruneJobs(now.Add(-succeededJobRetention), now.Add(-deadJobRetention))
+
+	if err != nil {
+		q.logger.Warn("error pruning old jobs", logging.Error(err))
+
+		return
+	}
+
+	if pruned > 0 {
+		q.logger.Debug("pruned old jobs", "jobs", pruned)
+	}
+}
+
+/// run runs a claimed job, recording whether it succeeded and scheduling a retry if it failed.
+func (q *Queue) run(job *storage.Job) {
+	job.Attempts++
+
+	logger := q.logger.With("job_id", job.Id, "job_kind", job.Kind, "attempt", job.Attempts)
+	logger.Debug("running job")
+
+	err := q.callHandler(job)
+
+	switch {
+	case err == nil:
+		job.Status = storage.JobSucceeded
+		job.LastError = ""
+	case q.ctx.Err() != nil:
+		// Being interrupted by shutdown isn't the job's fault, so it isn't counted as an attempt
+		logger.Warn("job was interrupted, requeueing", logging.Error(err))
+
+		job.Attempts--
+		job.Status = storage.JobPending
+		job.LastError = err.Error()
+		job.RunAt = time.Now().UTC()
+	case job.Attempts >= q.maxAttempts:
+		logger.Error("job failed too many times, giving up", logging.Error(err))
+
+		job.Status = storage.JobDead
+		job.LastError = err.Error()
+	default:
+		delay := q.backoff(job.Attempts)
+
+		logger.Warn("job failed, retrying", "delay", delay, logging.Error(err))
+
+		job.Status = storage.JobPending
+		job.LastError = err.Error()
+		job.RunAt = time.Now().Add(delay).UTC()
+	}
+
+	if err = q.store.SaveJob(job); err != nil {
+		logger.Error("error saving job", logging.Error(err))
+	}
+}
+
+/// callHandler calls the handler for a job, turning a missing handler or a panic into an error.
+func (q *Queue) callHandler(job *storage.Job) (err error) {
+	handler, ok := q.handlers[job.Kind]
+
+	if !ok {
+		return fmt.Errorf("no handler for job kind '%s'", job.Kind)
+	}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+
+	return handler(q.ctx, job)
+}
+
+/// backoff gets the delay before retrying a job that has failed the given number of times, doubling with every
+/// attempt up to the maximum delay.
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay := q.retryDelay
+
+	for i := 1; i < attempts && delay < q.maxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > q.maxRetryDelay {
+		delay = q.maxRetryDelay
+	}
+
+	return delay
+}
@@ -0,0 +1,268 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// newTestQueue creates a queue with a single worker in an empty store, stopping it when the test finishes.
+func newTestQueue(t *testing.T, maxAttempts int) (*Queue, *storage.Store) {
+	t.Helper()
+
+	store, err := storage.Open(filepath.Join(t.TempDir(), "mailer.db"))
+	if err != nil {
+		t.Fatalf("error opening store: %s", err)
+	}
+
+	t.Cleanup(func() {
+		store.Close()
+	})
+
+	queue := NewQueue(store, &config.Config{
+		JobWorkers: 1,
+		JobMaxAttempts: maxAttempts,
+		JobRetryDelay: time.Millisecond,
+		JobMaxRetryDelay: time.Millisecond * 4,
+	}, slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+	queue.pollInterval = time.Millisecond * 10
+	queue.interruptTimeout = time.Millisecond * 50
+
+	return queue, store
+}
+
+/// waitForJob waits for a job to reach the given status.
+func waitForJob(t *testing.T, store *storage.Store, id uint64, status storage.JobStatus) storage.Job {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 5)
+
+	for time.Now().Before(deadline) {
+		jobs, err := store.ListJobs(status)
+		if err != nil {
+			t.Fatalf("error listing jobs: %s", err)
+		}
+
+		for _, job := range jobs {
+			if job.Id == id {
+				return job
+			}
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	t.Fatalf("job %d didn't become %s", id, status)
+
+	return storage.Job{}
+}
+
+func TestQueueRunsJob(t *testing.T) {
+	queue, store := newTestQueue(t, 3)
+	payloads := make(chan string, 1)
+
+	queue.Handle("test", func(ctx context.Context, job *storage.Job) error {
+		payloads <- string(job.Payload)
+
+		return nil
+	})
+
+	if err := queue.Start(); err != nil {
+		t.Fatalf("error starting queue: %s", err)
+	}
+
+	job, err := queue.Enqueue("test", map[string]string{"key": "value"})
+	if err != nil {
+		t.Fatalf("error enqueueing job: %s", err)
+	}
+
+	succeeded := waitForJob(t, store, job.Id, storage.JobSucceeded)
+
+	if succeeded.Attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", succeeded.Attempts)
+	}
+
+	if payload := <-payloads; payload != `{"key":"value"}` {
+		t.Errorf("expected the handler to get the payload, got %s", payload)
+	}
+
+	if err = queue.Stop(context.Background()); err != nil {
+		t.Errorf("error stopping queue: %s", err)
+	}
+}
+
+func TestQueueRetriesUntilDead(t *testing.T) {
+	queue, store := newTestQueue(t, 3)
+
+	queue.Handle("test", func(ctx context.Context, job *storage.Job) error {
+		if job.Attempts == 2 {
+			panic("second attempt")
+		}
+
+		return errors.New("failed")
+	})
+
+	if err := queue.Start(); err != nil {
+		t.Fatalf("error starting queue: %s", err)
+	}
+
+	defer queue.Stop(context.Background())
+
+	job, err := queue.Enqueue("test", nil)
+	if err != nil {
+		t.Fatalf("error enqueueing job: %s", err)
+	}
+
+	dead := waitForJob(t, store, job.Id, storage.JobDead)
+
+	if dead.Attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", dead.Attempts)
+	}
+
+	if dead.LastError != "failed" {
+		t.Errorf("expected the last error to be recorded, got '%s'", dead.LastError)
+	}
+}
+
+func TestQueueMissingHandler(t *testing.T) {
+	queue, store := newTestQueue(t, 1)
+
+	if err := queue.Start(); err != nil {
+		t.Fatalf("error starting queue: %s", err)
+	}
+
+	defer queue.Stop(context.Background())
+
+	job, err := queue.Enqueue("unknown", nil)
+	if err != nil {
+		t.Fatalf("error enqueueing job: %s", err)
+	}
+
+	dead := waitForJob(t, store, job.Id, storage.JobDead)
+
+	if dead.LastError != "no handler for job kind 'unknown'" {
+		t.Errorf("unexpected error '%s'", dead.LastError)
+	}
+}
+
+func TestQueueRequeuesInterruptedJobs(t *testing.T) {
+	queue, store := newTestQueue(t, 1)
+
+	job := &storage.Job{
+		Kind: "test",
+	}
+
+	if err := store.EnqueueJob(job); err != nil {
+		t.Fatalf("error enqueueing job: %s", err)
+	}
+
+	if _, err := store.ClaimJob(time.Now()); err != nil {
+		t.Fatalf("error claiming job: %s", err)
+	}
+
+	queue.Handle("test", func(ctx context.Context, job *storage.Job) error {
+		return nil
+	})
+
+	if err := queue.Start(); err != nil {
+		t.Fatalf("error starting queue: %s", err)
+	}
+
+	defer queue.Stop(context.Background())
+
+	waitForJob(t, store, job.Id, storage.JobSucceeded)
+}
+
+func TestQueueStopTimesOut(t *testing.T) {
+	queue, _ := newTestQueue(t, 1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	queue.Handle("test", func(ctx context.Context, job *storage.Job) error {
+		close(started)
+		<-release
+
+		return nil
+	})
+
+	if err := queue.Start(); err != nil {
+		t.Fatalf("error starting queue: %s", err)
+	}
+
+	if _, err := queue.Enqueue("test", nil); err != nil {
+		t.Fatalf("error enqueueing job: %s", err)
+	}
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	if err := queue.Stop(ctx); err == nil {
+		t.Error("expected stopping to fail while a job is still running")
+	}
+
+	close(release)
+}
+
+func TestQueueInterruptsRunningJob(t *testing.T) {
+	queue, store := newTestQueue(t, 3)
+	started := make(chan struct{})
+
+	queue.Handle("test", func(ctx context.Context, job *storage.Job) error {
+		close(started)
+		<-ctx.Done()
+
+		return ctx.Err()
+	})
+
+	if err := queue.Start(); err != nil {
+		t.Fatalf("error starting queue: %s", err)
+	}
+
+	job, err := queue.Enqueue("test", nil)
+	if err != nil {
+		t.Fatalf("error enqueueing job: %s", err)
+	}
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	if err = queue.Stop(ctx); err != nil {
+		t.Errorf("expected the interrupted job to stop in time, got %s", err)
+	}
+
+	requeued := waitForJob(t, store, job.Id, storage.JobPending)
+
+	if requeued.Attempts != 0 {
+		t.Errorf("expected the interrupted attempt not to be counted, got %d attempts", requeued.Attempts)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	queue := &Queue{
+		retryDelay: time.Second,
+		maxRetryDelay: time.Second * 5,
+	}
+
+	for attempts, expected := range map[int]time.Duration{
+		1: time.Second,
+		2: time.Second * 2,
+		3: time.Second * 4,
+		4: time.Second * 5,
+		10: time.Second * 5,
+	} {
+		if delay := queue.backoff(attempts); delay != expected {
+			t.Errorf("attempt %d: expected %s, got %s", attempts, expected, delay)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+)
+
+/// EmailKey is the key email addresses are logged with, so that they can be redacted.
+const EmailKey = "email"
+
+/// RequestIdKey is the key the ID of the HTTP request being handled is logged with.
+const RequestIdKey = "request_id"
+
+/// DeliveryIdKey is the key the ID of the webhook delivery being handled is logged with.
+const DeliveryIdKey = "delivery_id"
+
+/// ErrorKey is the key errors are logged with.
+const ErrorKey = "error"
+
+/// contextKey is the key a logger is stored in a context with.
+type contextKey struct{}
+
+/// New creates a logger writing to the given writer in the configured format, ignoring messages below the configured
+/// level.
+///
+/// Unless disabled, every email address logged with EmailKey is redacted, so that logs can be shared without exposing
+/// who is subscribed.
+func New(w io.Writer, configuration *config.LogConfig) *slog.Logger {
+	options := &slog.HandlerOptions{
+		Level: configuration.Level,
+	}
+
+	if configuration.RedactEmails {
+		options.ReplaceAttr = func(groups []string, attr slog.Attr) slog.Attr {
+			if attr.Key == EmailKey {
+				return slog.String(EmailKey, RedactEmail(attr.Value.String()))
+			}
+
+			return attr
+		}
+	}
+
+	if configuration.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+
+	return slog.New(slog.NewTextHandler(w, options))
+}
+
+/// Email builds the attribute to log an email address with.
+func Email(emailAddress string) slog.Attr {
+	return slog.String(EmailKey, emailAddress)
+}
+
+/// Error builds the attribute to log an error with.
+func Error(err error) slog.Attr {
+	return slog.Any(ErrorKey, err)
+}
+
+/// RedactEmail redacts an email address, keeping only its first character and domain, such as "j***@example.com".
+func RedactEmail(emailAddress string) string {
+	at := strings.LastIndex(emailAddress, "@")
+
+	if at < 1 {
+		return "***"
+	}
+
+	return emailAddress[:1] + "***" + emailAddress[at:]
+}
+
+/// NewContext returns a copy of a context carrying the given logger.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+/// FromContext gets the logger carried by a context, such as the logger for a HTTP request with its request ID, or
+/// the given fallback if there isn't one.
+func FromContext(ctx context.Context, fallback *slog.Logger) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return fallback
+}
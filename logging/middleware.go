@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+/// RequestIdHeader is the header the ID of a HTTP request is read from and returned in.
+const RequestIdHeader = "X-Request-Id"
+
+/// requestIdPattern matches the request IDs accepted from a reverse proxy in front of the mailer.
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+/// statusRecorder records the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+/// Middleware creates middleware giving every HTTP request an ID, returned in the X-Request-Id header and attached to
+/// every message logged through the logger in the request's context.
+///
+/// A request ID set by a reverse proxy is kept, so that its logs and ours can be matched up.
+func Middleware(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestId := r.Header.Get(RequestIdHeader)
+
+			if !requestIdPattern.MatchString(requestId) {
+				requestId = generateRequestId()
+			}
+
+			w.Header().Set(RequestIdHeader, requestId)
+
+			requestLogger := logger.With(RequestIdKey, requestId)
+			recorder := &statusRecorder{
+				ResponseWriter: w,
+				status: http.StatusOK,
+			}
+			startedAt := time.Now()
+
+			next.ServeHTTP(recorder, r.WithContext(NewContext(r.Context(), requestLogger)))
+
+			// Only the path is logged, as query strings carry email addresses and tokens
+			requestLogger.Debug("handled request", "method", r.Method, "path", r.URL.Path, "status",
+				recorder.status, "duration", time.Since(startedAt))
+		})
+	}
+}
+
+/// generateRequestId generates a random ID for a request.
+func generateRequestId() string {
+	id := make([]byte, 8)
+
+	if _, err := rand.Read(id); err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,230 @@
+package dryrun
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/logging"
+	"github.com/mybb/mybb-blog-mailer/mail"
+)
+
+/// ProviderName is the name deliveries recorded by a dry run are recorded with.
+const ProviderName = "dryrun"
+
+/// indexFileName is the name of the file listing every recorded call, one JSON object per line.
+const indexFileName = "index.jsonl"
+
+/// Handler records every email to a local directory as a .eml file instead of sending it, so that the whole pipeline
+/// can be run without emailing anyone.
+///
+/// Every call, including those to subscribe and unsubscribe from the mailing list, is also appended to an index in the
+/// same directory.
+type Handler struct {
+	directory   string
+	fromAddress string
+	fromName    string
+	logger      *slog.Logger
+	/// lock serialises writes to the index, and guards the sequence number used to name files.
+	lock     sync.Mutex
+	sequence int
+}
+
+/// Record is an entry in the index of recorded calls.
+type Record struct {
+	/// Operation is the name of the handler method that was called.
+	Operation string `json:"operation"`
+	/// EmailAddress is the address the call was for.
+	EmailAddress string `json:"email_address"`
+	/// Name is the name the address was subscribed with, if any.
+	Name string `json:"name,omitempty"`
+	/// Subject is the subject of the email, if one was sent.
+	Subject string `json:"subject,omitempty"`
+	/// UnsubscribeUrl is the one-click unsubscribe URL given with a notification.
+	UnsubscribeUrl string `json:"unsubscribe_url,omitempty"`
+	/// MessageId is the Message-ID of the email, if one was sent.
+	MessageId string `json:"message_id,omitempty"`
+	/// File is the name of the .eml file the email was written to, if one was sent.
+	File string `json:"file,omitempty"`
+	/// RecordedAt is the time of the call.
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+/// NewHandler creates a new dry run mail handler using the given configuration.
+func NewHandler(configuration *config.DryRunConfig, logger *slog.Logger) *Handler {
+	return &Handler{
+		directory: configuration.Directory,
+		fromAddress: configuration.FromAddress,
+		fromName: configuration.FromName,
+		logger: logger.With("provider", ProviderName),
+	}
+}
+
+/// CheckValidEmail checks whether the given email address is a valid email address.
+func (h *Handler) CheckValidEmail(emailAddress string) (bool, error) {
+	if len(emailAddress) == 0 {
+		return false, mail.EmptyEmailAddressError{}
+	}
+
+	return mail.ValidateEmailAddress(emailAddress)
+}
+
+/// SendSubscriptionConfirmationEmail records the email asking the given address to confirm their subscription.
+func (h *Handler) SendSubscriptionConfirmationEmail(emailAddress string, textContent, htmlContent string) error {
+	_, err := h.recordEmail("confirmation", emailAddress, "Confirm Subscription", nil, textContent, htmlContent,
+		&Record{})
+
+	return err
+}
+
+/// SendAdminEmail records an email to an administrator of the mailer.
+func (h *Handler) SendAdminEmail(emailAddress, subject string, textContent, htmlContent string) error {
+	_, err := h.recordEmail("admin", emailAddress, subject, nil, textContent, htmlContent, &Record{})
+
+	return err
+}
+
+/// SubscribeEmailToMailingList records that the given address would be added to the mailing list.
+func (h *Handler) SubscribeEmailToMailingList(emailAddress, name string) error {
+	return h.record(&Record{
+		Operation: "subscribe",
+		EmailAddress: emailAddress,
+		Name: name,
+	})
+}
+
+/// UnsubscribeEmailFromMailingList records that the given address would be removed from the mailing list.
+func (h *Handler) UnsubscribeEmailFromMailingList(emailAddress string) error {
+	return h.record(&Record{
+		Operation: "unsubscribe",
+		EmailAddress: emailAddress,
+	})
+}
+
+/// SendNotificationToSubscriber records a notification of new blog posts to a single subscriber, returning the
+/// Message-ID it would have been sent with.
+func (h *Handler) SendNotificationToSubscriber(emailAddress, unsubscribeUrl, subject string, textContent,
+	htmlContent string) (mail.SentMessage, error) {
+	headers := map[string]string{
+		"List-Unsubscribe": "<" + unsubscribeUrl + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+
+	id, err := h.recordEmail("notification", emailAddress, subject, headers, textContent, htmlContent, &Record{
+		UnsubscribeUrl: unsubscribeUrl,
+	})
+
+	if err != nil {
+		return mail.SentMessage{}, err
+	}
+
+	return mail.SentMessage{
+		Id: id,
+		Provider: ProviderName,
+	}, nil
+}
+
+/// Ping checks that the index of recorded calls can be written to.
+func (h *Handler) Ping() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err := os.MkdirAll(h.directory, 0755); err != nil {
+		return fmt.Errorf("error creating dry run directory: %s", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(h.directory, indexFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening dry run index: %s", err)
+	}
+
+	return f.Close()
+}
+
+/// recordEmail writes an email to a .eml file and records it in the index, returning its Message-ID.
+func (h *Handler) recordEmail(operation, to, subject string, headers map[string]string, textContent,
+	htmlContent string, record *Record) (string, error) {
+	message, err := mail.NewMessage(h.fromAddress, h.fromName, to, subject, headers, textContent, htmlContent)
+	if err != nil {
+		return "", err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err = os.MkdirAll(h.directory, 0755); err != nil {
+		return "", fmt.Errorf("error creating dry run directory: %s", err)
+	}
+
+	h.sequence++
+
+	recordedAt := time.Now().UTC()
+	fileName := fmt.Sprintf("%s-%06d-%s.eml", recordedAt.Format("20060102T150405.000000000Z"), h.sequence,
+		operation)
+
+	if err = ioutil.WriteFile(filepath.Join(h.directory, fileName), message.Bytes(), 0644); err != nil {
+		return "", fmt.Errorf("error writing dry run email: %s", err)
+	}
+
+	record.Operation = operation
+	record.EmailAddress = to
+	record.Subject = subject
+	record.MessageId = message.Id
+	record.File = fileName
+	record.RecordedAt = recordedAt
+
+	if err = h.appendToIndex(record); err != nil {
+		return "", err
+	}
+
+	h.logger.Info("recorded email", "operation", operation, "subject", subject, logging.Email(to), "file", fileName)
+
+	return message.Id, nil
+}
+
+/// record records a call without an email in the index.
+func (h *Handler) record(record *Record) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err := os.MkdirAll(h.directory, 0755); err != nil {
+		return fmt.Errorf("error creating dry run directory: %s", err)
+	}
+
+	record.RecordedAt = time.Now().UTC()
+
+	if err := h.appendToIndex(record); err != nil {
+		return err
+	}
+
+	h.logger.Info("recorded call", "operation", record.Operation, logging.Email(record.EmailAddress))
+
+	return nil
+}
+
+/// appendToIndex appends a record to the index. The lock must be held.
+func (h *Handler) appendToIndex(record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(h.directory, indexFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening dry run index: %s", err)
+	}
+
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		f.Close()
+
+		return fmt.Errorf("error writing dry run index: %s", err)
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,181 @@
+package dryrun
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+)
+
+/// readIndex reads every record in the index in the given directory.
+func readIndex(t *testing.T, directory string) []Record {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join(directory, indexFileName))
+	if err != nil {
+		t.Fatalf("error opening index: %s", err)
+	}
+
+	defer f.Close()
+
+	var records []Record
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		var record Record
+
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("error decoding index line %q: %s", scanner.Text(), err)
+		}
+
+		records = append(records, record)
+	}
+
+	if err = scanner.Err(); err != nil {
+		t.Fatalf("error reading index: %s", err)
+	}
+
+	return records
+}
+
+/// readEmail parses the .eml file with the given name in the given directory.
+func readEmail(t *testing.T, directory, fileName string) *netmail.Message {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join(directory, fileName))
+	if err != nil {
+		t.Fatalf("error opening recorded email: %s", err)
+	}
+
+	t.Cleanup(func() {
+		f.Close()
+	})
+
+	message, err := netmail.ReadMessage(f)
+	if err != nil {
+		t.Fatalf("error parsing recorded email: %s", err)
+	}
+
+	return message
+}
+
+func TestRecordCalls(t *testing.T) {
+	// The directory is created on the first call
+	directory := filepath.Join(t.TempDir(), "dryrun")
+	handler := NewHandler(&config.DryRunConfig{
+		Directory: directory,
+		FromAddress: "blog@mybb.com",
+		FromName: "MyBB Blog",
+	}, slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+
+	if err := handler.Ping(); err != nil {
+		t.Fatalf("error pinging handler: %s", err)
+	}
+
+	if err := handler.SubscribeEmailToMailingList("someone@example.com", "Someone"); err != nil {
+		t.Fatalf("error recording subscription: %s", err)
+	}
+
+	if err := handler.SendSubscriptionConfirmationEmail("someone@example.com", "Confirm",
+		"<p>Confirm</p>"); err != nil {
+		t.Fatalf("error recording confirmation: %s", err)
+	}
+
+	sentMessage, err := handler.SendNotificationToSubscriber("someone@example.com",
+		"https://blog-mailer.example.com/unsubscribe?token=abc", "New MyBB Blog Post", "A new post",
+		"<p>A new post</p>")
+
+	if err != nil {
+		t.Fatalf("error recording notification: %s", err)
+	}
+
+	if sentMessage.Provider != ProviderName || len(sentMessage.Id) == 0 {
+		t.Errorf("expected a message ID from the dry run provider, got %+v", sentMessage)
+	}
+
+	if err = handler.UnsubscribeEmailFromMailingList("someone@example.com"); err != nil {
+		t.Fatalf("error recording unsubscription: %s", err)
+	}
+
+	records := readIndex(t, directory)
+
+	expectedOperations := []string{"subscribe", "confirmation", "notification", "unsubscribe"}
+
+	if len(records) != len(expectedOperations) {
+		t.Fatalf("expected %d records, got %d: %+v", len(expectedOperations), len(records), records)
+	}
+
+	for i, record := range records {
+		if record.Operation != expectedOperations[i] || record.EmailAddress != "someone@example.com" ||
+			record.RecordedAt.IsZero() {
+			t.Errorf("expected a %s record for someone@example.com, got %+v", expectedOperations[i], record)
+		}
+
+		// Only calls sending an email write a file
+		if hasFile := len(record.File) > 0; hasFile != (i == 1 || i == 2) {
+			t.Errorf("expected the %s record to have a file: %t, got '%s'", record.Operation, !hasFile, record.File)
+		}
+	}
+
+	if records[0].Name != "Someone" {
+		t.Errorf("expected the subscription to be recorded with the name, got '%s'", records[0].Name)
+	}
+
+	notification := records[2]
+
+	if notification.Subject != "New MyBB Blog Post" || notification.MessageId != sentMessage.Id ||
+		notification.UnsubscribeUrl != "https://blog-mailer.example.com/unsubscribe?token=abc" {
+		t.Errorf("expected the notification to be recorded with its subject, Message-ID and unsubscribe URL, got %+v",
+			notification)
+	}
+
+	if !strings.HasSuffix(notification.File, "-notification.eml") {
+		t.Errorf("expected the file to be named after the operation, got '%s'", notification.File)
+	}
+
+	message := readEmail(t, directory, notification.File)
+
+	expectedHeaders := map[string]string{
+		"To": "someone@example.com",
+		"Subject": "New MyBB Blog Post",
+		"Message-ID": sentMessage.Id,
+		"List-Unsubscribe": "<https://blog-mailer.example.com/unsubscribe?token=abc>",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+
+	for name, value := range expectedHeaders {
+		if message.Header.Get(name) != value {
+			t.Errorf("expected %s header '%s', got '%s'", name, value, message.Header.Get(name))
+		}
+	}
+
+	if from, err := message.Header.AddressList("From"); err != nil || len(from) != 1 ||
+		from[0].Address != "blog@mybb.com" {
+		t.Errorf("expected the email to be from blog@mybb.com, got %v (%v)", from, err)
+	}
+
+	// A confirmation isn't sent to a list, so has no unsubscribe headers
+	confirmation := readEmail(t, directory, records[1].File)
+
+	if confirmation.Header.Get("Subject") != "Confirm Subscription" ||
+		len(confirmation.Header.Get("List-Unsubscribe")) > 0 {
+		t.Errorf("expected a confirmation without unsubscribe headers, got %v", confirmation.Header)
+	}
+
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		t.Fatalf("error listing directory: %s", err)
+	}
+
+	if len(files) != 3 {
+		t.Errorf("expected 2 emails and the index to be written, got %d files", len(files))
+	}
+}
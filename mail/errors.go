@@ -1,7 +1,41 @@
 package mail
 
+import (
+	"errors"
+)
+
 type EmptyEmailAddressError struct{}
 
 func (e EmptyEmailAddressError) Error() string {
 	return "email address is empty"
 }
+
+/// PermanentError is returned by a mail backend when sending an email failed in a way that retrying won't fix, such as
+/// the recipient's address being rejected.
+type PermanentError struct {
+	/// Err is the reason sending failed.
+	Err error
+}
+
+func (e PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e PermanentError) Unwrap() error {
+	return e.Err
+}
+
+/// Permanent reports that retrying won't fix the error.
+func (e PermanentError) Permanent() bool {
+	return true
+}
+
+/// IsPermanent checks whether an error from a mail backend means sending the email would fail the same way if it was
+/// retried.
+func IsPermanent(err error) bool {
+	var permanent interface {
+		Permanent() bool
+	}
+
+	return errors.As(err, &permanent) && permanent.Permanent()
+}
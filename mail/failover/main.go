@@ -0,0 +1,298 @@
+package failover
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/logging"
+	"github.com/mybb/mybb-blog-mailer/mail"
+)
+
+/// Backend is a mail backend failed over between.
+type Backend struct {
+	/// Name is the name of the backend, such as "mailgun", used in logs and errors.
+	Name string
+	/// Handler is the handler sending emails through the backend.
+	Handler mail.Handler
+}
+
+/// backendHealth tracks recent failures of a backend.
+type backendHealth struct {
+	/// failures is the number of consecutive times sending through the backend failed.
+	failures int
+	/// skipUntil is the time until which the backend is skipped after failing too many times.
+	skipUntil time.Time
+}
+
+/// Handler sends emails through the first of an ordered list of backends that accepts them, such as MailGun and then
+/// an SMTP server.
+///
+/// A backend that fails several times in a row is skipped for a cooldown period, after which a single email is sent
+/// through it to check whether it has recovered. If every backend is being skipped, sending fails without trying any
+/// of them, leaving the job sending the email to retry it later.
+///
+/// A backend permanently rejecting an email, such as for an undeliverable address, shows it is working, so the error is
+/// returned as it is without trying the other backends, which would reject the email too.
+type Handler struct {
+	backends         []Backend
+	failureThreshold int
+	cooldown         time.Duration
+	logger           *slog.Logger
+	/// lock guards the health of the backends.
+	lock   sync.Mutex
+	health []backendHealth
+}
+
+/// AllBackendsFailedError is returned when no backend accepted an email.
+type AllBackendsFailedError struct {
+	/// Operation is the name of the operation that failed.
+	Operation string
+	/// Errors are the reasons each backend failed or was skipped, in order.
+	Errors []string
+}
+
+func (e AllBackendsFailedError) Error() string {
+	return fmt.Sprintf("%s failed through every mail backend: %s", e.Operation, strings.Join(e.Errors, "; "))
+}
+
+/// NewHandler creates a new failover mail handler trying the given backends in order.
+func NewHandler(configuration *config.FailoverConfig, backends []Backend, logger *slog.Logger) *Handler {
+	return &Handler{
+		backends: backends,
+		failureThreshold: configuration.FailureThreshold,
+		cooldown: configuration.Cooldown,
+		logger: logger,
+		health: make([]backendHealth, len(backends)),
+	}
+}
+
+/// Backends gets the backends failed over between, in order.
+func (h *Handler) Backends() []Backend {
+	return h.backends
+}
+
+/// CheckValidEmail checks whether the given email address is a valid email address using the first backend that
+/// isn't being skipped.
+///
+/// An error from a backend may only mean the address is invalid, so it doesn't count as a failure of the backend.
+func (h *Handler) CheckValidEmail(emailAddress string) (bool, error) {
+	for i, backend := range h.backends {
+		if h.isHealthy(i) {
+			return backend.Handler.CheckValidEmail(emailAddress)
+		}
+	}
+
+	return h.backends[0].Handler.CheckValidEmail(emailAddress)
+}
+
+/// SendSubscriptionConfirmationEmail sends an email to the given address to confirm their subscription to the mailing
+/// list through the first backend that accepts it.
+func (h *Handler) SendSubscriptionConfirmationEmail(emailAddress string, textContent, htmlContent string) error {
+	_, err := h.send("confirmation email", func(handler mail.Handler) error {
+		return handler.SendSubscriptionConfirmationEmail(emailAddress, textContent, htmlContent)
+	})
+
+	return err
+}
+
+/// SendAdminEmail sends an email to an administrator of the mailer through the first backend that accepts it.
+func (h *Handler) SendAdminEmail(emailAddress, subject string, textContent, htmlContent string) error {
+	_, err := h.send("admin email", func(handler mail.Handler) error {
+		return handler.SendAdminEmail(emailAddress, subject, textContent, htmlContent)
+	})
+
+	return err
+}
+
+/// SubscribeEmailToMailingList subscribes the given email address to the mailing list of every backend, as each
+/// keeps its own list.
+func (h *Handler) SubscribeEmailToMailingList(emailAddress, name string) error {
+	return h.forEach("subscribe", func(handler mail.Handler) error {
+		return handler.SubscribeEmailToMailingList(emailAddress, name)
+	})
+}
+
+/// UnsubscribeEmailFromMailingList unsubscribes the given email address from the mailing list of every backend.
+func (h *Handler) UnsubscribeEmailFromMailingList(emailAddress string) error {
+	return h.forEach("unsubscribe", func(handler mail.Handler) error {
+		return handler.UnsubscribeEmailFromMailingList(emailAddress)
+	})
+}
+
+/// SendNotificationToSubscriber sends an email to a single subscriber notifying of new blog posts through the first
+/// backend that accepts it, returning the message ID and the name of that backend.
+func (h *Handler) SendNotificationToSubscriber(emailAddress, unsubscribeUrl, subject string, textContent,
+	htmlContent string) (mail.SentMessage, error) {
+	var sentMessage mail.SentMessage
+
+	provider, err := h.send("notification", func(handler mail.Handler) error {
+		var err error
+
+		sentMessage, err = handler.SendNotificationToSubscriber(emailAddress, unsubscribeUrl, subject, textContent,
+			htmlContent)
+
+		return err
+	})
+
+	if err != nil {
+		return mail.SentMessage{}, err
+	}
+
+	if len(sentMessage.Provider) == 0 {
+		sentMessage.Provider = provider
+	}
+
+	return sentMessage, nil
+}
+
+/// Ping checks that at least one backend can be reached, as emails can still be sent through it. Failures don't count
+/// towards the health of a backend, as no email was sent.
+func (h *Handler) Ping() error {
+	var errs []string
+
+	for _, backend := range h.backends {
+		err := backend.Handler.Ping()
+
+		if err == nil {
+			return nil
+		}
+
+		errs = append(errs, fmt.Sprintf("%s: %s", backend.Name, err))
+	}
+
+	return AllBackendsFailedError{
+		Operation: "ping",
+		Errors: errs,
+	}
+}
+
+/// send tries an operation through each backend in order until one succeeds, skipping backends that have failed too
+/// many times in a row, and returns the name of the backend that succeeded. A permanent error is returned straight
+/// away, as the backend rejected the email itself rather than failing to send it.
+func (h *Handler) send(operation string, try func(handler mail.Handler) error) (string, error) {
+	var errs []string
+
+	for i, backend := range h.backends {
+		if !h.acquire(i) {
+			errs = append(errs, fmt.Sprintf("%s: skipped after failing %d times in a row", backend.Name,
+				h.failureThreshold))
+
+			continue
+		}
+
+		err := try(backend.Handler)
+
+		if err == nil {
+			h.recordSuccess(i)
+
+			if i > 0 {
+				h.logger.Warn("sent through fallback mail backend", "operation", operation, "backend", backend.Name)
+			}
+
+			return backend.Name, nil
+		}
+
+		if mail.IsPermanent(err) {
+			// The backend answered, so it's working even though it won't send this email
+			h.recordSuccess(i)
+
+			return "", fmt.Errorf("%s: %w", backend.Name, err)
+		}
+
+		h.recordFailure(i, err)
+
+		errs = append(errs, fmt.Sprintf("%s: %s", backend.Name, err))
+	}
+
+	return "", AllBackendsFailedError{
+		Operation: operation,
+		Errors: errs,
+	}
+}
+
+/// forEach runs an operation through every backend regardless of its health, returning an error if it failed for any
+/// of them. Failures don't count towards the health of a backend, as the operation doesn't send an email.
+func (h *Handler) forEach(operation string, try func(handler mail.Handler) error) error {
+	var errs []string
+
+	for _, backend := range h.backends {
+		if err := try(backend.Handler); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", backend.Name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s failed for some mail backends: %s", operation, strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+/// isHealthy checks whether a backend has failed fewer times in a row than the threshold.
+func (h *Handler) isHealthy(i int) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.health[i].failures < h.failureThreshold
+}
+
+/// acquire checks whether an email should be sent through a backend. A backend that has failed too many times in a
+/// row is skipped until its cooldown ends, after which a single email is let through, holding off any others for
+/// another cooldown in case it fails again.
+func (h *Handler) acquire(i int) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	health := &h.health[i]
+
+	if health.failures < h.failureThreshold {
+		return true
+	}
+
+	now := time.Now()
+
+	if now.Before(health.skipUntil) {
+		return false
+	}
+
+	health.skipUntil = now.Add(h.cooldown)
+
+	return true
+}
+
+/// recordSuccess records that a backend accepted an email.
+func (h *Handler) recordSuccess(i int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.health[i].failures >= h.failureThreshold {
+		h.logger.Warn("mail backend has recovered", "backend", h.backends[i].Name)
+	}
+
+	h.health[i] = backendHealth{}
+}
+
+/// recordFailure records that a backend failed to send an email, skipping it for a cooldown if it has failed too many
+/// times in a row.
+func (h *Handler) recordFailure(i int, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	health := &h.health[i]
+	health.failures++
+
+	if health.failures < h.failureThreshold {
+		h.logger.Warn("mail backend failed", "backend", h.backends[i].Name, logging.Error(err))
+
+		return
+	}
+
+	health.skipUntil = time.Now().Add(h.cooldown)
+
+	h.logger.Error("mail backend failed too many times in a row, skipping it", "backend", h.backends[i].Name,
+		"failures", health.failures, "cooldown", h.cooldown, logging.Error(err))
+}
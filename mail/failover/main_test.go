@@ -0,0 +1,259 @@
+package failover
+
+import (
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/mail"
+)
+
+/// fakeHandler is a mail handler failing with err, recording how many notifications it was asked to send.
+type fakeHandler struct {
+	err      error
+	provider string
+	sent     int
+}
+
+func (h *fakeHandler) CheckValidEmail(emailAddress string) (bool, error) {
+	return true, nil
+}
+
+func (h *fakeHandler) SendSubscriptionConfirmationEmail(emailAddress string, textContent, htmlContent string) error {
+	return h.err
+}
+
+func (h *fakeHandler) SubscribeEmailToMailingList(emailAddress, name string) error {
+	return nil
+}
+
+func (h *fakeHandler) UnsubscribeEmailFromMailingList(emailAddress string) error {
+	return nil
+}
+
+func (h *fakeHandler) SendAdminEmail(emailAddress, subject string, textContent, htmlContent string) error {
+	return h.err
+}
+
+func (h *fakeHandler) SendNotificationToSubscriber(emailAddress, unsubscribeUrl, subject string, textContent,
+	htmlContent string) (mail.SentMessage, error) {
+	h.sent++
+
+	if h.err != nil {
+		return mail.SentMessage{}, h.err
+	}
+
+	return mail.SentMessage{
+		Id: "<message@example.com>",
+		Provider: h.provider,
+	}, nil
+}
+
+func (h *fakeHandler) Ping() error {
+	return h.err
+}
+
+/// newTestHandler creates a failover handler between a primary and a secondary fake backend, skipping a backend after
+/// two failures in a row.
+func newTestHandler() (*Handler, *fakeHandler, *fakeHandler) {
+	primary := &fakeHandler{}
+	secondary := &fakeHandler{}
+
+	handler := NewHandler(&config.FailoverConfig{
+		FailureThreshold: 2,
+		Cooldown: time.Hour,
+	}, []Backend{
+		{Name: "primary", Handler: primary},
+		{Name: "secondary", Handler: secondary},
+	}, slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+
+	return handler, primary, secondary
+}
+
+/// notify sends a notification through the handler.
+func notify(handler *Handler) (mail.SentMessage, error) {
+	return handler.SendNotificationToSubscriber("someone@example.com", "https://blog-mailer.example.com/unsubscribe",
+		"New post", "text", "<p>html</p>")
+}
+
+func TestFallbackOrder(t *testing.T) {
+	handler, primary, secondary := newTestHandler()
+
+	sentMessage, err := notify(handler)
+	if err != nil {
+		t.Fatalf("error sending notification: %s", err)
+	}
+
+	if primary.sent != 1 || secondary.sent != 0 {
+		t.Errorf("expected only the primary backend to be used, got %d and %d", primary.sent, secondary.sent)
+	}
+
+	if sentMessage.Provider != "primary" {
+		t.Errorf("expected the provider to be recorded as 'primary', got '%s'", sentMessage.Provider)
+	}
+
+	primary.err = errors.New("connection refused")
+
+	if sentMessage, err = notify(handler); err != nil {
+		t.Fatalf("error sending notification: %s", err)
+	}
+
+	if primary.sent != 2 || secondary.sent != 1 {
+		t.Errorf("expected both backends to be tried in order, got %d and %d", primary.sent, secondary.sent)
+	}
+
+	if sentMessage.Provider != "secondary" {
+		t.Errorf("expected the provider to be recorded as 'secondary', got '%s'", sentMessage.Provider)
+	}
+
+	secondary.err = errors.New("timed out")
+
+	_, err = notify(handler)
+
+	if _, ok := err.(AllBackendsFailedError); !ok {
+		t.Errorf("expected every backend to fail, got %v", err)
+	}
+
+	if mail.IsPermanent(err) {
+		t.Errorf("expected transient failures of every backend not to be permanent")
+	}
+}
+
+func TestProviderReportedByBackend(t *testing.T) {
+	handler, primary, _ := newTestHandler()
+	primary.provider = "mailgun"
+
+	sentMessage, err := notify(handler)
+	if err != nil {
+		t.Fatalf("error sending notification: %s", err)
+	}
+
+	if sentMessage.Provider != "mailgun" {
+		t.Errorf("expected the provider reported by the backend to be kept, got '%s'", sentMessage.Provider)
+	}
+}
+
+func TestFailureThresholdAndCooldown(t *testing.T) {
+	handler, primary, secondary := newTestHandler()
+	primary.err = errors.New("connection refused")
+
+	// The first failure falls back without skipping the backend
+	if _, err := notify(handler); err != nil {
+		t.Fatalf("error sending notification: %s", err)
+	}
+
+	if !handler.isHealthy(0) {
+		t.Fatalf("expected the primary backend to be tried again after failing once")
+	}
+
+	// Reaching the threshold skips the backend for the cooldown
+	if _, err := notify(handler); err != nil {
+		t.Fatalf("error sending notification: %s", err)
+	}
+
+	if handler.isHealthy(0) {
+		t.Fatalf("expected the primary backend to be skipped after failing twice")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := notify(handler); err != nil {
+			t.Fatalf("error sending notification: %s", err)
+		}
+	}
+
+	if primary.sent != 2 || secondary.sent != 5 {
+		t.Errorf("expected the primary backend to be skipped during the cooldown, got %d and %d sent", primary.sent,
+			secondary.sent)
+	}
+
+	// Once the cooldown ends, a single probe is let through while the others are held off
+	primary.err = nil
+	handler.health[0].skipUntil = time.Now().Add(-time.Second)
+
+	if !handler.acquire(0) {
+		t.Fatalf("expected a probe to be let through after the cooldown")
+	}
+
+	if handler.acquire(0) {
+		t.Errorf("expected only a single probe to be let through")
+	}
+
+	handler.health[0].skipUntil = time.Now().Add(-time.Second)
+
+	sentMessage, err := notify(handler)
+	if err != nil {
+		t.Fatalf("error sending notification: %s", err)
+	}
+
+	if sentMessage.Provider != "primary" || !handler.isHealthy(0) {
+		t.Errorf("expected the primary backend to recover after a successful probe, sent through '%s'",
+			sentMessage.Provider)
+	}
+}
+
+func TestFailedProbe(t *testing.T) {
+	handler, primary, secondary := newTestHandler()
+	primary.err = errors.New("connection refused")
+
+	for i := 0; i < 2; i++ {
+		notify(handler)
+	}
+
+	handler.health[0].skipUntil = time.Now().Add(-time.Second)
+
+	// The probe fails, so the backend is skipped for another cooldown
+	for i := 0; i < 2; i++ {
+		if _, err := notify(handler); err != nil {
+			t.Fatalf("error sending notification: %s", err)
+		}
+	}
+
+	if primary.sent != 3 || secondary.sent != 4 {
+		t.Errorf("expected a single probe of the primary backend, got %d and %d sent", primary.sent, secondary.sent)
+	}
+
+	if !handler.health[0].skipUntil.After(time.Now()) {
+		t.Errorf("expected the primary backend to be skipped for another cooldown")
+	}
+}
+
+func TestPermanentRejection(t *testing.T) {
+	handler, primary, secondary := newTestHandler()
+	primary.err = mail.PermanentError{
+		Err: errors.New("550 no such user"),
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := notify(handler)
+
+		if !mail.IsPermanent(err) {
+			t.Fatalf("expected a permanent error, got %v", err)
+		}
+	}
+
+	if secondary.sent != 0 {
+		t.Errorf("expected a permanently rejected email not to be sent through the next backend, got %d sent",
+			secondary.sent)
+	}
+
+	if !handler.isHealthy(0) || handler.health[0].failures != 0 {
+		t.Errorf("expected permanent rejections not to count as failures of the backend, got %d",
+			handler.health[0].failures)
+	}
+
+	// A permanent rejection resets the failures counted before it, as the backend answered
+	primary.err = errors.New("connection refused")
+	notify(handler)
+
+	primary.err = mail.PermanentError{
+		Err: errors.New("550 no such user"),
+	}
+	notify(handler)
+
+	if handler.health[0].failures != 0 {
+		t.Errorf("expected failures to be reset by a permanent rejection, got %d", handler.health[0].failures)
+	}
+}
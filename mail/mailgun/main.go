@@ -1,25 +1,31 @@
 package mailgun
 
 import (
-	"log"
 	"fmt"
+	"log/slog"
+	"net/http"
 
 	"gopkg.in/mailgun/mailgun-go.v1"
 
 	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/logging"
 	"github.com/mybb/mybb-blog-mailer/mail"
 )
 
+/// ProviderName is the name deliveries sent through MailGun are recorded with.
+const ProviderName = "mailgun"
+
 /// Handler wraps a MailGun API client to make it easy to send emails to perform tasks related to emails.
 type Handler struct {
 	client mailgun.Mailgun
 	useEmailValidation bool
 	mailingListAddress string
 	fromAddressName string
+	logger *slog.Logger
 }
 
 /// NewHandler creates a new MailGun mail handler using the given configuration.
-func NewHandler(configuration *config.MailGunConfig) *Handler {
+func NewHandler(configuration *config.MailGunConfig, logger *slog.Logger) *Handler {
 	return &Handler{
 		client: mailgun.NewMailgun(
 			configuration.Domain,
@@ -29,6 +35,7 @@ func NewHandler(configuration *config.MailGunConfig) *Handler {
 		useEmailValidation: configuration.EmailValidation,
 		mailingListAddress: configuration.MailingListAddress,
 		fromAddressName: configuration.FromName,
+		logger: logger.With("provider", ProviderName),
 	}
 }
 
@@ -64,14 +71,30 @@ func (h *Handler) SendSubscriptionConfirmationEmail(emailAddress string, textCon
 	message := h.client.NewMessage(h.mailingListAddress, "Confirm Subscription", textContent, emailAddress)
 
 	message.SetHtml(htmlContent)
-	message.AddHeader("List-Unsubscribe", "%unsubscribe_email%")
 
 	resp, id, err := h.client.Send(message)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Sent email confirmation to %s with id %s and status: %s\n", emailAddress, id, resp)
+	h.logger.Info("sent email confirmation", logging.Email(emailAddress), "message_id", id, "status", resp)
+
+	return nil
+}
+
+/// SendAdminEmail sends an email to an administrator of the mailer, such as to approve a notification.
+func (h *Handler) SendAdminEmail(emailAddress, subject string, textContent, htmlContent string) error {
+	message := h.client.NewMessage(h.mailingListAddress, subject, textContent, emailAddress)
+
+	message.SetHtml(htmlContent)
+
+	resp, id, err := h.client.Send(message)
+	if err != nil {
+		return err
+	}
+
+	h.logger.Info("sent admin email", "subject", subject, logging.Email(emailAddress), "message_id", id, "status",
+		resp)
 
 	return nil
 }
@@ -86,8 +109,54 @@ func (h *Handler) SubscribeEmailToMailingList(emailAddress, name string) error {
 	return h.client.CreateMember(true, h.mailingListAddress, member)
 }
 
-/// SendNotificationToMailingList sends an email to the mailing list notifying of a new blog post.
-func (h *Handler) SendNotificationToMailingList(postTitle string, textContent, htmlContent string) error {
+/// Unsubscribe the given email address from the mailing list, ignoring addresses that aren't members.
+func (h *Handler) UnsubscribeEmailFromMailingList(emailAddress string) error {
+	err := h.client.DeleteMember(emailAddress, h.mailingListAddress)
+
+	if err != nil && mailgun.GetStatusFromErr(err) == http.StatusNotFound {
+		return nil
+	}
+
+	return err
+}
+
+/// Ping checks that the MailGun API can be reached with the configured API key by reading a single member of the
+/// mailing list.
+func (h *Handler) Ping() error {
+	_, _, err := h.client.GetMembers(1, 0, mailgun.All, h.mailingListAddress)
+
+	return err
+}
+
+/// GetMailingListMembers lists the subscribed members of the MailGun mailing list.
+func (h *Handler) GetMailingListMembers() ([]mail.Member, error) {
+	const pageSize = 100
+
+	var members []mail.Member
+
+	for skip := 0; ; skip += pageSize {
+		_, page, err := h.client.GetMembers(pageSize, skip, mailgun.Subscribed, h.mailingListAddress)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, member := range page {
+			members = append(members, mail.Member{
+				EmailAddress: member.Address,
+				Name: member.Name,
+			})
+		}
+
+		if len(page) < pageSize {
+			return members, nil
+		}
+	}
+}
+
+/// SendNotificationToSubscriber sends an email to a single subscriber notifying of new blog posts, with headers
+/// to unsubscribe with a one-click POST request to the given URL, returning the message ID MailGun assigned.
+func (h *Handler) SendNotificationToSubscriber(emailAddress, unsubscribeUrl, subject string, textContent,
+	htmlContent string) (mail.SentMessage, error) {
 	var fromAddress string
 	if len(h.fromAddressName) > 0 {
 		fromAddress = fmt.Sprintf("%s <%s>", h.fromAddressName, h.mailingListAddress)
@@ -95,17 +164,33 @@ func (h *Handler) SendNotificationToMailingList(postTitle string, textContent, h
 		fromAddress = h.mailingListAddress
 	}
 
-	message := h.client.NewMessage(fromAddress, "New MyBB Blog Post: " + postTitle, textContent, h.mailingListAddress)
+	message := h.client.NewMessage(fromAddress, subject, textContent, emailAddress)
 
 	message.SetHtml(htmlContent)
-	message.AddHeader("List-Unsubscribe", "%unsubscribe_email%")
+	message.AddHeader("List-Unsubscribe", "<" + unsubscribeUrl + ">")
+	message.AddHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
 
 	resp, id, err := h.client.Send(message)
 	if err != nil {
-		return err
+		return mail.SentMessage{}, classify(err)
 	}
 
-	log.Printf("Sent blog post notificaion for post '%s' with id %s and status: %s\n", postTitle, id, resp)
+	h.logger.Info("sent blog post notification", "subject", subject, logging.Email(emailAddress), "message_id", id,
+		"status", resp)
 
-	return nil
-}
\ No newline at end of file
+	return mail.SentMessage{
+		Id: id,
+		Provider: ProviderName,
+	}, nil
+}
+/// classify marks an error as permanent if MailGun rejected the request as invalid, such as for a malformed recipient
+/// address. Other errors, such as MailGun being unavailable or rate limiting, are worth retrying.
+func classify(err error) error {
+	if responseError, ok := err.(*mailgun.UnexpectedResponseError); ok && responseError.Actual == http.StatusBadRequest {
+		return mail.PermanentError{
+			Err: err,
+		}
+	}
+
+	return err
+}
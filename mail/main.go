@@ -4,6 +4,22 @@ import (
 	"github.com/goware/emailx"
 )
 
+/// Member is a member of a mail provider's own mailing list.
+type Member struct {
+	/// EmailAddress is the email address of the member.
+	EmailAddress string
+	/// Name is the name the member subscribed with.
+	Name string
+}
+
+/// SentMessage identifies an email a mail backend accepted for delivery.
+type SentMessage struct {
+	/// Id is the message ID assigned to the email.
+	Id string
+	/// Provider is the name of the mail backend that accepted the email, such as "mailgun" or "smtp".
+	Provider string
+}
+
 type Handler interface {
 	/// CheckValidEmail checks whether the given email address is a valid email address using the MailGun API.
 	CheckValidEmail(emailAddress string) (bool, error)
@@ -11,8 +27,17 @@ type Handler interface {
 	SendSubscriptionConfirmationEmail(emailAddress string, textContent, htmlContent string) error
 	/// Subscribe the given email address to the mailing list with the given name.
 	SubscribeEmailToMailingList(emailAddress, name string) error
-	/// SendNotificationToMailingList sends an email to the mailing list notifying of a new blog post.
-	SendNotificationToMailingList(postTitle string, textContent, htmlContent string) error
+	/// Unsubscribe the given email address from the mailing list.
+	UnsubscribeEmailFromMailingList(emailAddress string) error
+	/// SendAdminEmail sends an email to an administrator of the mailer, such as to approve a notification.
+	SendAdminEmail(emailAddress, subject string, textContent, htmlContent string) error
+	/// SendNotificationToSubscriber sends an email to a single subscriber notifying of new blog posts, with headers
+	/// to unsubscribe with a one-click POST request to the given URL as described in RFC 8058. The message ID assigned
+	/// to the email is returned, along with the backend that sent it.
+	SendNotificationToSubscriber(emailAddress, unsubscribeUrl, subject string, textContent,
+		htmlContent string) (SentMessage, error)
+	/// Ping checks that the backend can be reached with a cheap call that sends no email.
+	Ping() error
 }
 
 /// ValidateEmailAddress checks whether an email address is valid.
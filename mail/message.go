@@ -0,0 +1,138 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+/// Message is a fully rendered RFC 5322 email, ready to be written to an SMTP DATA command or saved as a .eml file.
+type Message struct {
+	/// Id is the Message-ID header of the email.
+	Id      string
+	header  bytes.Buffer
+	content bytes.Buffer
+}
+
+/// NewMessage builds a multipart/alternative message holding both the plain text and HTML bodies, along with any extra
+/// headers.
+func NewMessage(fromAddress, fromName, to, subject string, headers map[string]string, textContent,
+	htmlContent string) (*Message, error) {
+	id, err := generateMessageId(fromAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{
+		Id: id,
+	}
+
+	body := multipart.NewWriter(&m.content)
+
+	from := netmail.Address{
+		Name:    fromName,
+		Address: fromAddress,
+	}
+
+	m.writeHeader("From", from.String())
+	m.writeHeader("To", to)
+	m.writeHeader("Subject", mime.QEncoding.Encode("utf-8", subject))
+	m.writeHeader("Date", time.Now().Format(time.RFC1123Z))
+	m.writeHeader("Message-ID", id)
+
+	names := make([]string, 0, len(headers))
+
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		m.writeHeader(name, headers[name])
+	}
+
+	m.writeHeader("MIME-Version", "1.0")
+	m.writeHeader("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", body.Boundary()))
+
+	// Clients display the last alternative they understand, so the richest part goes last
+	if err = writePart(body, "text/plain; charset=utf-8", textContent); err != nil {
+		return nil, err
+	}
+
+	if err = writePart(body, "text/html; charset=utf-8", htmlContent); err != nil {
+		return nil, err
+	}
+
+	if err = body.Close(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *Message) writeHeader(name, value string) {
+	m.header.WriteString(name + ": " + value + "\r\n")
+}
+
+/// Bytes returns the complete message, headers followed by the body.
+func (m *Message) Bytes() []byte {
+	var b bytes.Buffer
+
+	b.Write(m.header.Bytes())
+	b.WriteString("\r\n")
+	b.Write(m.content.Bytes())
+
+	return b.Bytes()
+}
+
+/// writePart writes a single quoted-printable encoded body part.
+func writePart(body *multipart.Writer, contentType, content string) error {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	part, err := body.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	qp := quotedprintable.NewWriter(part)
+
+	if _, err = qp.Write([]byte(normaliseLineEndings(content))); err != nil {
+		return err
+	}
+
+	return qp.Close()
+}
+
+/// normaliseLineEndings converts bare LF line endings to the CRLF line endings required by SMTP.
+func normaliseLineEndings(content string) string {
+	return strings.Replace(strings.Replace(content, "\r\n", "\n", -1), "\n", "\r\n", -1)
+}
+
+/// generateMessageId generates a unique Message-ID using the domain of the sending address.
+func generateMessageId(fromAddress string) (string, error) {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error reading random bytes for Message-ID: %s", err)
+	}
+
+	domain := "localhost"
+
+	if at := strings.LastIndex(fromAddress, "@"); at >= 0 && at < len(fromAddress)-1 {
+		domain = fromAddress[at+1:]
+	}
+
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().Unix(), hex.EncodeToString(b), domain), nil
+}
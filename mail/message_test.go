@@ -0,0 +1,140 @@
+package mail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"strings"
+	"testing"
+)
+
+func TestNewMessage(t *testing.T) {
+	subject := "Nouvel article : MyBB 1.8.38 est arrivé"
+	textContent := "Hello,\nA new post is out: " + strings.Repeat("long line ", 20) + "\nBye"
+	htmlContent := "<p>Hello, café</p>\r\n<p>" + strings.Repeat("long line ", 20) + "</p>"
+
+	message, err := NewMessage("blog@mybb.com", "MyBB Blög", "someone@example.com", subject, map[string]string{
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		"List-Unsubscribe": "<https://blog-mailer.example.com/unsubscribe>",
+	}, textContent, htmlContent)
+
+	if err != nil {
+		t.Fatalf("error building message: %s", err)
+	}
+
+	raw := message.Bytes()
+
+	for i, line := range bytes.Split(raw, []byte("\r\n")) {
+		if bytes.IndexByte(line, '\n') >= 0 {
+			t.Fatalf("expected every line to end with CRLF, line %d has a bare LF: %q", i, line)
+		}
+
+		if len(line) > 998 {
+			t.Errorf("expected lines to be at most 998 characters, line %d has %d", i, len(line))
+		}
+	}
+
+	// The extra headers are sorted, and come before the MIME headers
+	expectedOrder := []string{"From", "To", "Subject", "Date", "Message-ID", "List-Unsubscribe",
+		"List-Unsubscribe-Post", "MIME-Version", "Content-Type"}
+	header := string(raw[:bytes.Index(raw, []byte("\r\n\r\n"))])
+
+	var order []string
+
+	for _, line := range strings.Split(header, "\r\n") {
+		order = append(order, line[:strings.Index(line, ":")])
+	}
+
+	if strings.Join(order, ",") != strings.Join(expectedOrder, ",") {
+		t.Errorf("expected headers %v, got %v", expectedOrder, order)
+	}
+
+	parsed, err := netmail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("error parsing message: %s", err)
+	}
+
+	decoder := new(mime.WordDecoder)
+
+	decodedSubject, err := decoder.DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil || decodedSubject != subject {
+		t.Errorf("expected subject '%s', got '%s' (%v)", subject, decodedSubject, err)
+	}
+
+	if strings.Contains(parsed.Header.Get("Subject"), "é") {
+		t.Errorf("expected the subject to be encoded, got '%s'", parsed.Header.Get("Subject"))
+	}
+
+	from, err := parsed.Header.AddressList("From")
+	if err != nil || len(from) != 1 || from[0].Name != "MyBB Blög" || from[0].Address != "blog@mybb.com" {
+		t.Errorf("expected the sender to be 'MyBB Blög <blog@mybb.com>', got %v (%v)", from, err)
+	}
+
+	if parsed.Header.Get("Message-ID") != message.Id || !strings.HasSuffix(message.Id, "@mybb.com>") {
+		t.Errorf("expected a Message-ID in the sender's domain matching '%s', got '%s'", message.Id,
+			parsed.Header.Get("Message-ID"))
+	}
+
+	if parsed.Header.Get("List-Unsubscribe") != "<https://blog-mailer.example.com/unsubscribe>" ||
+		parsed.Header.Get("List-Unsubscribe-Post") != "List-Unsubscribe=One-Click" {
+		t.Errorf("expected the one-click unsubscribe headers, got %v", parsed.Header)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" || len(params["boundary"]) == 0 {
+		t.Fatalf("expected a multipart/alternative message with a boundary, got '%s' (%v)",
+			parsed.Header.Get("Content-Type"), err)
+	}
+
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+
+	expectedParts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", strings.Replace(textContent, "\n", "\r\n", -1)},
+		{"text/html; charset=utf-8", htmlContent},
+	}
+
+	for _, expected := range expectedParts {
+		part, err := reader.NextRawPart()
+		if err != nil {
+			t.Fatalf("error reading %s part: %s", expected.contentType, err)
+		}
+
+		if part.Header.Get("Content-Type") != expected.contentType {
+			t.Errorf("expected part of type '%s', got '%s'", expected.contentType, part.Header.Get("Content-Type"))
+		}
+
+		if part.Header.Get("Content-Transfer-Encoding") != "quoted-printable" {
+			t.Errorf("expected a quoted-printable part, got '%s'", part.Header.Get("Content-Transfer-Encoding"))
+		}
+
+		encoded, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatalf("error reading part: %s", err)
+		}
+
+		for _, line := range strings.Split(string(encoded), "\r\n") {
+			if len(line) > 76 {
+				t.Errorf("expected quoted-printable lines to be at most 76 characters, got %d", len(line))
+			}
+		}
+
+		content, err := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(encoded)))
+		if err != nil {
+			t.Fatalf("error decoding part: %s", err)
+		}
+
+		if string(content) != expected.content {
+			t.Errorf("expected %s content %q, got %q", expected.contentType, expected.content, content)
+		}
+	}
+
+	if _, err = reader.NextRawPart(); err == nil {
+		t.Errorf("expected only a plain text and a HTML part")
+	}
+}
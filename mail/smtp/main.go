@@ -0,0 +1,369 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/logging"
+	"github.com/mybb/mybb-blog-mailer/mail"
+)
+
+/// ProviderName is the name deliveries sent through an SMTP server are recorded with.
+const ProviderName = "smtp"
+
+/// dialTimeout is how long connecting to the SMTP server can take.
+const dialTimeout = time.Second * 30
+
+/// commandTimeout is how long a session can take to send a single message, or to be started, so that an unresponsive
+/// server can't hang the caller.
+const commandTimeout = time.Minute
+
+/// idleTimeout is how long a session is kept open after sending a message, so that the next message of a fan-out of
+/// notifications can be sent over the same connection.
+const idleTimeout = time.Second * 15
+
+/// Handler sends emails through an SMTP server, such as a local Postfix relay.
+type Handler struct {
+	host          string
+	port          int
+	security      string
+	authMechanism string
+	username      string
+	password      string
+	fromAddress   string
+	fromName      string
+	idleTimeout   time.Duration
+	logger        *slog.Logger
+	lock          sync.Mutex
+	session       *session
+	idleTimer     *time.Timer
+}
+
+/// session is an open connection to the SMTP server.
+type session struct {
+	conn   net.Conn
+	client *smtp.Client
+}
+
+/// NewHandler creates a new SMTP mail handler using the given configuration.
+func NewHandler(configuration *config.SMTPConfig, logger *slog.Logger) *Handler {
+	return &Handler{
+		host:          configuration.Host,
+		port:          configuration.Port,
+		security:      configuration.Security,
+		authMechanism: configuration.AuthMechanism,
+		username:      configuration.Username,
+		password:      configuration.Password,
+		fromAddress:   configuration.FromAddress,
+		fromName:      configuration.FromName,
+		idleTimeout:   idleTimeout,
+		logger:        logger.With("provider", ProviderName),
+	}
+}
+
+/// CheckValidEmail checks whether the given email address is a valid email address.
+func (h *Handler) CheckValidEmail(emailAddress string) (bool, error) {
+	if len(emailAddress) == 0 {
+		return false, mail.EmptyEmailAddressError{}
+	}
+
+	return mail.ValidateEmailAddress(emailAddress)
+}
+
+/// SendSubscriptionConfirmationEmail sends an email to the given address to confirm their subscription to the mailing list.
+func (h *Handler) SendSubscriptionConfirmationEmail(emailAddress string, textContent, htmlContent string) error {
+	id, err := h.sendSingle(emailAddress, "Confirm Subscription", nil, textContent, htmlContent)
+	if err != nil {
+		return err
+	}
+
+	h.logger.Info("sent email confirmation", logging.Email(emailAddress), "message_id", id)
+
+	return nil
+}
+
+/// SendAdminEmail sends an email to an administrator of the mailer, such as to approve a notification.
+func (h *Handler) SendAdminEmail(emailAddress, subject string, textContent, htmlContent string) error {
+	id, err := h.sendSingle(emailAddress, subject, nil, textContent, htmlContent)
+	if err != nil {
+		return err
+	}
+
+	h.logger.Info("sent admin email", "subject", subject, logging.Email(emailAddress), "message_id", id)
+
+	return nil
+}
+
+/// SubscribeEmailToMailingList does nothing, as an SMTP server has no mailing list to add the address to.
+func (h *Handler) SubscribeEmailToMailingList(emailAddress, name string) error {
+	return nil
+}
+
+/// UnsubscribeEmailFromMailingList does nothing, as an SMTP server has no mailing list to remove the address from.
+func (h *Handler) UnsubscribeEmailFromMailingList(emailAddress string) error {
+	return nil
+}
+
+/// SendNotificationToSubscriber sends an email to a single subscriber notifying of new blog posts, with headers
+/// to unsubscribe with a one-click POST request to the given URL, returning the Message-ID of the email.
+func (h *Handler) SendNotificationToSubscriber(emailAddress, unsubscribeUrl, subject string, textContent,
+	htmlContent string) (mail.SentMessage, error) {
+	headers := map[string]string{
+		"List-Unsubscribe":      "<" + unsubscribeUrl + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+
+	id, err := h.sendSingle(emailAddress, subject, headers, textContent, htmlContent)
+	if err != nil {
+		return mail.SentMessage{}, err
+	}
+
+	h.logger.Info("sent blog post notification", "subject", subject, logging.Email(emailAddress), "message_id", id)
+
+	return mail.SentMessage{
+		Id:       id,
+		Provider: ProviderName,
+	}, nil
+}
+
+/// sendSingle sends a single message, reusing the open session with the SMTP server if there is one. The session is
+/// kept open for a while afterwards to send the next message over.
+func (h *Handler) sendSingle(to, subject string, headers map[string]string, textContent,
+	htmlContent string) (string, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, err := h.openSession()
+	if err != nil {
+		return "", err
+	}
+
+	id, err := h.send(s.client, to, subject, headers, textContent, htmlContent)
+	if err != nil {
+		var protocolError *textproto.Error
+
+		// A rejected message leaves the session usable once it's reset, but any other error leaves it in an unknown state
+		if errors.As(err, &protocolError) && s.client.Reset() == nil {
+			h.keepSession(s)
+		} else {
+			s.close()
+		}
+
+		return "", err
+	}
+
+	h.keepSession(s)
+
+	return id, nil
+}
+
+/// openSession takes the open session with the SMTP server if it's still alive, or else starts a new one. The caller must
+/// hold the lock.
+func (h *Handler) openSession() (*session, error) {
+	s := h.session
+
+	h.session = nil
+
+	if h.idleTimer != nil {
+		h.idleTimer.Stop()
+		h.idleTimer = nil
+	}
+
+	if s != nil {
+		s.conn.SetDeadline(time.Now().Add(commandTimeout))
+
+		if err := s.client.Noop(); err == nil {
+			return s, nil
+		}
+
+		s.client.Close()
+	}
+
+	s, err := h.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	s.conn.SetDeadline(time.Now().Add(commandTimeout))
+
+	return s, nil
+}
+
+/// keepSession keeps a session open to send the next message over, closing it if it isn't used within the idle
+/// timeout. The caller must hold the lock.
+func (h *Handler) keepSession(s *session) {
+	var timer *time.Timer
+
+	timer = time.AfterFunc(h.idleTimeout, func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+
+		if h.idleTimer != timer {
+			return
+		}
+
+		h.session.close()
+		h.session = nil
+		h.idleTimer = nil
+	})
+
+	h.session = s
+	h.idleTimer = timer
+}
+
+/// close ends the session, closing the connection even if the server doesn't respond.
+func (s *session) close() {
+	s.conn.SetDeadline(time.Now().Add(commandTimeout))
+	s.client.Quit()
+	s.client.Close()
+}
+
+/// Ping checks that the SMTP server can be connected and authenticated to, then ends the session without sending.
+func (h *Handler) Ping() error {
+	s, err := h.dial()
+	if err != nil {
+		return err
+	}
+
+	s.conn.SetDeadline(time.Now().Add(commandTimeout))
+
+	return s.client.Quit()
+}
+
+/// dial connects to the configured SMTP server, negotiating TLS and authenticating as configured.
+func (h *Handler) dial() (*session, error) {
+	address := net.JoinHostPort(h.host, strconv.Itoa(h.port))
+	tlsConfig := &tls.Config{
+		ServerName: h.host,
+	}
+	dialer := &net.Dialer{
+		Timeout: dialTimeout,
+	}
+
+	var conn net.Conn
+	var err error
+
+	if h.security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to SMTP server %s: %s", address, err)
+	}
+
+	// Bound the greeting, TLS negotiation and authentication too, as a server can accept connections and never respond
+	conn.SetDeadline(time.Now().Add(commandTimeout))
+
+	client, err := smtp.NewClient(conn, h.host)
+	if err != nil {
+		conn.Close()
+
+		return nil, fmt.Errorf("error starting SMTP session with %s: %s", address, err)
+	}
+
+	if h.security == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+
+			return nil, fmt.Errorf("SMTP server %s does not support STARTTLS", address)
+		}
+
+		if err = client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+
+			return nil, fmt.Errorf("error starting TLS with %s: %s", address, err)
+		}
+	}
+
+	auth := h.auth()
+
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			client.Close()
+
+			return nil, fmt.Errorf("error authenticating with %s: %s", address, err)
+		}
+	}
+
+	return &session{
+		conn:   conn,
+		client: client,
+	}, nil
+}
+
+/// auth builds the SASL mechanism to authenticate with, or nil if authentication is disabled.
+func (h *Handler) auth() smtp.Auth {
+	switch h.authMechanism {
+	case "plain":
+		return smtp.PlainAuth("", h.username, h.password, h.host)
+	case "login":
+		return &loginAuth{
+			username: h.username,
+			password: h.password,
+			host:     h.host,
+		}
+	default:
+		return nil
+	}
+}
+
+/// send sends a single multipart/alternative message to the given recipient over an open session, returning its Message-ID.
+func (h *Handler) send(client *smtp.Client, to, subject string, headers map[string]string, textContent,
+	htmlContent string) (string, error) {
+	message, err := mail.NewMessage(h.fromAddress, h.fromName, to, subject, headers, textContent, htmlContent)
+	if err != nil {
+		return "", mail.PermanentError{
+			Err: err,
+		}
+	}
+
+	if err = client.Mail(h.fromAddress); err != nil {
+		return "", classify(err)
+	}
+
+	if err = client.Rcpt(to); err != nil {
+		return "", classify(err)
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return "", classify(err)
+	}
+
+	if _, err = w.Write(message.Bytes()); err != nil {
+		w.Close()
+
+		return "", err
+	}
+
+	if err = w.Close(); err != nil {
+		return "", classify(err)
+	}
+
+	return message.Id, nil
+}
+
+/// classify marks an error as permanent if the server replied with a 5xx code, which RFC 5321 reserves for commands
+/// that won't succeed if they are repeated.
+func classify(err error) error {
+	var protocolError *textproto.Error
+
+	if errors.As(err, &protocolError) && protocolError.Code >= 500 {
+		return mail.PermanentError{
+			Err: err,
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,336 @@
+package smtp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/mail"
+)
+
+/// fakeServer is an in-process SMTP server accepting LOGIN authentication, rejecting recipients at the temp and perm
+/// domains with 4xx and 5xx replies.
+type fakeServer struct {
+	listener net.Listener
+	username string
+	password string
+
+	lock        sync.Mutex
+	connections int
+	quits       int
+	messages    []string
+	conns       []net.Conn
+}
+
+/// startFakeServer starts a fake SMTP server on a local port, stopping it when the test finishes.
+func startFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+
+	server := &fakeServer{
+		listener: listener,
+		username: "mailer",
+		password: "secret",
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			server.lock.Lock()
+			server.connections++
+			server.conns = append(server.conns, conn)
+			server.lock.Unlock()
+
+			go server.serve(conn)
+		}
+	}()
+
+	t.Cleanup(func() {
+		listener.Close()
+		server.dropConnections()
+	})
+
+	return server
+}
+
+/// serve holds a single SMTP session.
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+	}
+	readLine := func() (string, bool) {
+		line, err := reader.ReadString('\n')
+
+		return strings.TrimRight(line, "\r\n"), err == nil
+	}
+
+	reply("220 fake ESMTP")
+
+	for {
+		line, ok := readLine()
+		if !ok {
+			return
+		}
+
+		command := strings.ToUpper(line)
+
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			reply("250-fake", "250-AUTH LOGIN", "250 8BITMIME")
+		case command == "AUTH LOGIN":
+			reply("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+			username, _ := readLine()
+			reply("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+			password, _ := readLine()
+
+			if username == base64.StdEncoding.EncodeToString([]byte(s.username)) &&
+				password == base64.StdEncoding.EncodeToString([]byte(s.password)) {
+				reply("235 2.7.0 Authentication successful")
+			} else {
+				reply("535 5.7.8 Authentication credentials invalid")
+			}
+		case strings.HasPrefix(command, "MAIL FROM:"), command == "RSET", command == "NOOP":
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			if strings.Contains(command, "@TEMP.") {
+				reply("451 4.2.2 Mailbox full, try again later")
+			} else if strings.Contains(command, "@PERM.") {
+				reply("550 5.1.1 No such user")
+			} else {
+				reply("250 OK")
+			}
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+
+			var message []string
+
+			for {
+				dataLine, ok := readLine()
+				if !ok {
+					return
+				}
+
+				if dataLine == "." {
+					break
+				}
+
+				message = append(message, dataLine)
+			}
+
+			s.lock.Lock()
+			s.messages = append(s.messages, strings.Join(message, "\r\n"))
+			s.lock.Unlock()
+
+			reply("250 OK queued")
+		case command == "QUIT":
+			s.lock.Lock()
+			s.quits++
+			s.lock.Unlock()
+
+			reply("221 Bye")
+
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+/// dropConnections closes every connection to the server, as a server timing out idle sessions would.
+func (s *fakeServer) dropConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+
+	s.conns = nil
+}
+
+/// counts gets the number of connections made, sessions ended with QUIT and messages received.
+func (s *fakeServer) counts() (int, int, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.connections, s.quits, len(s.messages)
+}
+
+/// newTestHandler creates a handler sending through the fake server with LOGIN authentication.
+func newTestHandler(server *fakeServer, password string) *Handler {
+	address := server.listener.Addr().(*net.TCPAddr)
+
+	return NewHandler(&config.SMTPConfig{
+		Host:          "127.0.0.1",
+		Port:          address.Port,
+		Security:      "none",
+		AuthMechanism: "login",
+		Username:      server.username,
+		Password:      password,
+		FromAddress:   "blog@mybb.com",
+		FromName:      "MyBB Blog",
+	}, slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+}
+
+/// notify sends a notification to the given address through the handler.
+func notify(handler *Handler, emailAddress string) (mail.SentMessage, error) {
+	return handler.SendNotificationToSubscriber(emailAddress, "https://blog-mailer.example.com/unsubscribe",
+		"New MyBB Blog Post", "A new post", "<p>A new post</p>")
+}
+
+func TestSendWithLoginAuth(t *testing.T) {
+	server := startFakeServer(t)
+	handler := newTestHandler(server, server.password)
+
+	sentMessage, err := notify(handler, "someone@example.com")
+	if err != nil {
+		t.Fatalf("error sending notification: %s", err)
+	}
+
+	if sentMessage.Provider != ProviderName || len(sentMessage.Id) == 0 {
+		t.Errorf("expected a message ID from the SMTP provider, got %+v", sentMessage)
+	}
+
+	_, _, messages := server.counts()
+
+	if messages != 1 {
+		t.Fatalf("expected the server to receive 1 message, got %d", messages)
+	}
+
+	server.lock.Lock()
+	message := server.messages[0]
+	server.lock.Unlock()
+
+	if !strings.Contains(message, "Message-ID: "+sentMessage.Id) ||
+		!strings.Contains(message, "List-Unsubscribe: <https://blog-mailer.example.com/unsubscribe>") {
+		t.Errorf("expected the message to have its Message-ID and unsubscribe headers, got %q", message)
+	}
+
+	t.Run("wrong password", func(t *testing.T) {
+		_, err := notify(newTestHandler(server, "wrong"), "someone@example.com")
+
+		if err == nil || !strings.Contains(err.Error(), "535") {
+			t.Errorf("expected authentication to fail, got %v", err)
+		}
+	})
+
+	t.Run("refuses LOGIN to a remote host without TLS", func(t *testing.T) {
+		auth := &loginAuth{
+			username: "mailer",
+			password: "secret",
+			host:     "smtp.example.com",
+		}
+
+		_, _, err := auth.Start(&smtp.ServerInfo{
+			Name: "smtp.example.com",
+		})
+
+		if err == nil {
+			t.Errorf("expected credentials not to be sent over an unencrypted connection")
+		}
+	})
+}
+
+func TestRejectedRecipients(t *testing.T) {
+	server := startFakeServer(t)
+	handler := newTestHandler(server, server.password)
+
+	tests := []struct {
+		emailAddress string
+		permanent    bool
+	}{
+		{"full@temp.example.com", false},
+		{"missing@perm.example.com", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.emailAddress, func(t *testing.T) {
+			_, err := notify(handler, test.emailAddress)
+
+			if err == nil {
+				t.Fatalf("expected the recipient to be rejected")
+			}
+
+			if mail.IsPermanent(err) != test.permanent {
+				t.Errorf("expected the rejection to be permanent: %t, got %v", test.permanent, err)
+			}
+		})
+	}
+
+	// A rejected recipient doesn't end the session, so the next message is sent over it
+	if _, err := notify(handler, "someone@example.com"); err != nil {
+		t.Fatalf("error sending notification: %s", err)
+	}
+
+	if connections, _, messages := server.counts(); connections != 1 || messages != 1 {
+		t.Errorf("expected 1 message over 1 connection, got %d messages over %d connections", messages, connections)
+	}
+}
+
+func TestSessionReuse(t *testing.T) {
+	server := startFakeServer(t)
+	handler := newTestHandler(server, server.password)
+	handler.idleTimeout = time.Millisecond * 100
+
+	for i := 0; i < 3; i++ {
+		if _, err := notify(handler, "someone@example.com"); err != nil {
+			t.Fatalf("error sending notification: %s", err)
+		}
+	}
+
+	if connections, _, messages := server.counts(); connections != 1 || messages != 3 {
+		t.Fatalf("expected a fan-out to be sent over 1 connection, got %d messages over %d connections", messages,
+			connections)
+	}
+
+	// The session is ended once it has been idle for the timeout, and a new one started for the next message
+	deadline := time.Now().Add(time.Second * 5)
+
+	for _, quits, _ := server.counts(); quits == 0; _, quits, _ = server.counts() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the idle session to be ended")
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if _, err := notify(handler, "someone@example.com"); err != nil {
+		t.Fatalf("error sending notification: %s", err)
+	}
+
+	if connections, _, _ := server.counts(); connections != 2 {
+		t.Errorf("expected a new connection after the idle timeout, got %d connections", connections)
+	}
+
+	// A session the server dropped is replaced rather than failing the next message
+	handler.idleTimeout = time.Minute
+	server.dropConnections()
+
+	if _, err := notify(handler, "someone@example.com"); err != nil {
+		t.Fatalf("error sending notification after the server dropped the session: %s", err)
+	}
+
+	if connections, _, messages := server.counts(); connections != 3 || messages != 5 {
+		t.Errorf("expected 5 messages over 3 connections, got %d messages over %d connections", messages,
+			connections)
+	}
+}
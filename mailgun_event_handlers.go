@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/logging"
+	"github.com/mybb/mybb-blog-mailer/metrics"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// mailGunEventsReceiver is the name deliveries of MailGun events are recorded with to recognise redeliveries.
+const mailGunEventsReceiver = "mailgun_events"
+
+/// MailGunEventService handles the events MailGun sends about emails it delivered, such as bounces and complaints,
+/// updating the status of the subscriber concerned.
+type MailGunEventService struct {
+	store               *storage.Store
+	subService          *SubscriptionService
+	signingKey          []byte
+	softBounceThreshold int
+	deliveryRetention   time.Duration
+	logger              *slog.Logger
+}
+
+/// invalidSignatureError is returned for an event that wasn't signed by MailGun with the webhook signing key, or was
+/// signed too long ago.
+type invalidSignatureError struct {
+	reason string
+}
+
+func (e invalidSignatureError) Error() string {
+	return e.reason
+}
+
+/// reusedTokenError is returned for an event signed with a token that was already used by an earlier request.
+type reusedTokenError struct{}
+
+func (e reusedTokenError) Error() string {
+	return "signature token has already been used"
+}
+
+/// mailGunEventPayload is the body of a MailGun event webhook request.
+type mailGunEventPayload struct {
+	Signature mailGunSignature `json:"signature"`
+	EventData mailGunEvent     `json:"event-data"`
+}
+
+/// mailGunSignature is the signature MailGun sends with every event to prove it was sent by MailGun.
+type mailGunSignature struct {
+	Timestamp string `json:"timestamp"`
+	Token     string `json:"token"`
+	Signature string `json:"signature"`
+}
+
+/// mailGunEvent is an event MailGun sends about an email.
+type mailGunEvent struct {
+	/// Id is the unique ID of the event.
+	Id string `json:"id"`
+	/// Event is the type of event, such as "failed" or "complained".
+	Event string `json:"event"`
+	/// Severity is whether a failure is "permanent", being a hard bounce, or "temporary", being a soft bounce.
+	Severity string `json:"severity"`
+	/// Reason is why a failure happened, such as "bounce".
+	Reason string `json:"reason"`
+	/// Recipient is the email address the email was sent to.
+	Recipient      string `json:"recipient"`
+	DeliveryStatus struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+		Message     string `json:"message"`
+	} `json:"delivery-status"`
+	/// Message describes the email the event is about.
+	Message struct {
+		Headers struct {
+			/// MessageId is the Message-ID header of the email, which is the same for every attempt to deliver it.
+			MessageId string `json:"message-id"`
+		} `json:"headers"`
+	} `json:"message"`
+}
+
+/// String describes the event for logs and the list of webhook deliveries. The recipient is left out, so that it is only
+/// logged with logging.Email and redacted as configured.
+func (e *mailGunEvent) String() string {
+	if len(e.Severity) > 0 {
+		return fmt.Sprintf("%s (%s)", e.Event, e.Severity)
+	}
+
+	return e.Event
+}
+
+/// failureReason describes why delivery of the email failed.
+func (e *mailGunEvent) failureReason() string {
+	message := e.DeliveryStatus.Description
+
+	if len(message) == 0 {
+		message = e.DeliveryStatus.Message
+	}
+
+	if len(message) == 0 {
+		return e.Reason
+	}
+
+	return fmt.Sprintf("%s: %d %s", e.Reason, e.DeliveryStatus.Code, message)
+}
+
+func NewMailGunEventService(store *storage.Store, subService *SubscriptionService,
+	configuration *config.Config, logger *slog.Logger) *MailGunEventService {
+	return &MailGunEventService{
+		store: store,
+		subService: subService,
+		signingKey: []byte(configuration.MailGun.WebHookSigningKey),
+		softBounceThreshold: configuration.MailGun.SoftBounceThreshold,
+		deliveryRetention: configuration.WebHookDeliveryRetention,
+		logger: logger,
+	}
+}
+
+/// ReceiveEvent handles a MailGun event webhook request to /mailgun/events.
+///
+/// Subscribers are suppressed when an email to them hard bounces or they complain of spam, or once several
+/// notifications in a row soft bounce, and are marked as unsubscribed when they unsubscribe through MailGun. An email
+/// being delivered resets the count of soft bounces. Any other type of event is acknowledged and ignored.
+func (eventService *MailGunEventService) ReceiveEvent(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), eventService.logger).With("receiver", mailGunEventsReceiver)
+
+	// Every event is counted once it has been handled, by its type and what was done with it
+	eventType, status := "unknown", "error"
+
+	defer func() {
+		metrics.WebHookEvents.WithLabelValues(mailGunEventsReceiver, eventType, status).Inc()
+	}()
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebHookPayloadSize))
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading request body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	var payload mailGunEventPayload
+
+	if err = json.Unmarshal(body, &payload); err != nil {
+		status = "invalid"
+
+		http.Error(w, fmt.Sprintf("Error parsing event: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	delivery, err := eventService.verifySignature(&payload.Signature)
+
+	switch err.(type) {
+	case nil:
+	case invalidSignatureError:
+		status = "invalid"
+
+		logger.Warn("invalid MailGun event signature", "remote_addr", r.RemoteAddr, logging.Error(err))
+
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	case reusedTokenError:
+		status = "redelivery"
+
+		logger.Warn("rejecting MailGun event with a reused signature token", "remote_addr", r.RemoteAddr,
+			logging.DeliveryIdKey, payload.Signature.Token)
+
+		// MailGun doesn't retry requests rejected as not acceptable, so a redelivery of an event that was already
+		// processed isn't retried either
+		http.Error(w, "Signature token has already been used", http.StatusNotAcceptable)
+		return
+	default:
+		logger.Error("error recording MailGun event", logging.Error(err))
+
+		http.Error(w, "Error recording event", http.StatusInternalServerError)
+		return
+	}
+
+	event := &payload.EventData
+	eventType = event.Event
+
+	logger = logger.With(logging.DeliveryIdKey, delivery.Id)
+
+	outcome, err := eventService.processEvent(logging.NewContext(r.Context(), logger), event)
+
+	if err != nil {
+		logger.Error("error processing MailGun event", "event", event.String(), logging.Email(event.Recipient),
+			logging.Error(err))
+
+		if err := eventService.store.DeleteWebHookDelivery(delivery); err != nil {
+			logger.Warn("error forgetting MailGun event", logging.Error(err))
+		}
+
+		http.Error(w, "Error processing event", http.StatusInternalServerError)
+		return
+	}
+
+	status = string(outcome)
+	delivery.Event = event.String()
+	delivery.Outcome = outcome
+
+	if err = eventService.store.SaveWebHookDelivery(delivery); err != nil {
+		logger.Warn("error recording outcome of MailGun event", logging.Error(err))
+	}
+
+	fmt.Fprintf(w, "Event %s\n", outcome)
+}
+
+/// verifySignature checks that an event was signed by MailGun with the webhook signing key, recently enough that its
+/// token is still remembered, and with a token no earlier request used, returning the delivery recorded for the token.
+///
+/// Only the timestamp and token are signed, not the event itself, so deliveries are recognised by the token rather than
+/// the event ID, and any other request reusing the token is rejected as a replay.
+func (eventService *MailGunEventService) verifySignature(signature *mailGunSignature) (*storage.WebHookDelivery,
+	error) {
+	timestamp, err := strconv.ParseInt(signature.Timestamp, 10, 64)
+
+	if err != nil {
+		return nil, invalidSignatureError{fmt.Sprintf("malformed timestamp: %s", err)}
+	}
+
+	age := time.Since(time.Unix(timestamp, 0))
+
+	if age > eventService.deliveryRetention || age < -eventService.deliveryRetention {
+		return nil, invalidSignatureError{fmt.Sprintf("timestamp is %s old", age)}
+	}
+
+	expectedSignature := signMailGunEvent(eventService.signingKey, signature.Timestamp, signature.Token)
+
+	if len(signature.Token) == 0 || !hmac.Equal([]byte(signature.Signature), []byte(expectedSignature)) {
+		return nil, invalidSignatureError{"signature doesn't match"}
+	}
+
+	delivery := &storage.WebHookDelivery{
+		Receiver: mailGunEventsReceiver,
+		Id: signature.Token,
+		ReceivedAt: time.Now().UTC(),
+	}
+
+	firstDelivery, err := eventService.store.RecordWebHookDelivery(delivery, eventService.deliveryRetention)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !firstDelivery {
+		return nil, reusedTokenError{}
+	}
+
+	return delivery, nil
+}
+
+/// processEvent applies an event to the subscriber it concerns, returning what was done with it.
+func (eventService *MailGunEventService) processEvent(ctx context.Context,
+	event *mailGunEvent) (storage.WebHookDeliveryOutcome, error) {
+	logger := logging.FromContext(ctx, eventService.logger)
+
+	var err error
+
+	switch event.Event {
+	case "failed":
+		if event.Severity == "permanent" {
+			err = eventService.suppress(ctx, event.Recipient, "hard bounce, "+event.failureReason())
+		} else {
+			err = eventService.recordSoftBounce(ctx, event.Recipient, event.Message.Headers.MessageId,
+				event.failureReason())
+		}
+	case "complained":
+		err = eventService.suppress(ctx, event.Recipient, "spam complaint")
+	case "unsubscribed":
+		var subscriber *storage.Subscriber
+
+		// A suppressed subscriber stays suppressed, as they mustn't be emailed even if they subscribe again
+		if subscriber, err = eventService.store.GetSubscriber(event.Recipient); err == nil &&
+			subscriber.Status != storage.SubscriberSuppressed {
+			err = eventService.subService.unsubscribe(ctx, event.Recipient)
+		}
+	case "delivered":
+		err = eventService.store.UpdateSubscriber(event.Recipient, func(subscriber *storage.Subscriber) error {
+			subscriber.SoftBounces = 0
+			subscriber.SoftBouncedMessageIds = nil
+
+			return nil
+		})
+	default:
+		logger.Debug("ignoring unsupported MailGun event", "event", event.String(), logging.Email(event.Recipient))
+
+		return storage.WebHookDeliveryUnsupported, nil
+	}
+
+	if _, ok := err.(storage.NotFoundError); ok {
+		logger.Debug("ignoring MailGun event for an unknown subscriber", "event", event.String(),
+			logging.Email(event.Recipient))
+
+		return storage.WebHookDeliveryIgnored, nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return storage.WebHookDeliveryProcessed, nil
+}
+
+/// suppress marks a subscriber as suppressed so that they are no longer emailed, and removes them from the mail
+/// provider's own mailing list.
+func (eventService *MailGunEventService) suppress(ctx context.Context, emailAddress, reason string) error {
+	err := eventService.store.UpdateSubscriber(emailAddress, func(subscriber *storage.Subscriber) error {
+		subscriber.Status = storage.SubscriberSuppressed
+		subscriber.SuppressionReason = reason
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	logger := logging.FromContext(ctx, eventService.logger)
+	logger.Warn("suppressed subscriber", logging.Email(emailAddress), "reason", reason)
+
+	eventService.unsubscribeFromMailingList(logger, emailAddress)
+
+	return nil
+}
+
+/// recordSoftBounce counts a soft bounce of an email to a subscriber, suppressing them once the threshold of soft
+/// bounces in a row is reached.
+///
+/// MailGun sends an event for every attempt to deliver an email it retries, so an email already counted by its message
+/// ID isn't counted again.
+func (eventService *MailGunEventService) recordSoftBounce(ctx context.Context, emailAddress, messageId,
+	reason string) error {
+	suppressed := false
+
+	err := eventService.store.UpdateSubscriber(emailAddress, func(subscriber *storage.Subscriber) error {
+		if len(messageId) > 0 {
+			for _, id := range subscriber.SoftBouncedMessageIds {
+				if id == messageId {
+					return nil
+				}
+			}
+
+			subscriber.SoftBouncedMessageIds = append(subscriber.SoftBouncedMessageIds, messageId)
+
+			// Only the most recent are kept, as a retry of an email from before them is unlikely
+			if excess := len(subscriber.SoftBouncedMessageIds) - eventService.softBounceThreshold; excess > 0 {
+				subscriber.SoftBouncedMessageIds = subscriber.SoftBouncedMessageIds[excess:]
+			}
+		}
+
+		subscriber.SoftBounces++
+
+		if subscriber.Status == storage.SubscriberActive && subscriber.SoftBounces >= eventService.softBounceThreshold {
+			subscriber.Status = storage.SubscriberSuppressed
+			subscriber.SuppressionReason = fmt.Sprintf("%d soft bounces in a row, last %s", subscriber.SoftBounces,
+				reason)
+			suppressed = true
+		}
+
+		return nil
+	})
+
+	if err != nil || !suppressed {
+		return err
+	}
+
+	logger := logging.FromContext(ctx, eventService.logger)
+	logger.Warn("suppressed subscriber after soft bounces in a row", logging.Email(emailAddress), "soft_bounces",
+		eventService.softBounceThreshold)
+
+	eventService.unsubscribeFromMailingList(logger, emailAddress)
+
+	return nil
+}
+
+/// unsubscribeFromMailingList removes a suppressed subscriber from the mail provider's own mailing list on a best
+/// effort basis, as the local subscriber store is the source of truth.
+func (eventService *MailGunEventService) unsubscribeFromMailingList(logger *slog.Logger, emailAddress string) {
+	err := eventService.subService.mailHandler.UnsubscribeEmailFromMailingList(emailAddress)
+
+	if err != nil {
+		logger.Warn("error unsubscribing email from the mail provider's mailing list", logging.Email(emailAddress),
+			logging.Error(err))
+	}
+}
+
+/// signMailGunEvent computes the hex encoded signature MailGun sends with an event, being a HMAC-SHA256 of the
+/// timestamp followed by the token.
+func signMailGunEvent(signingKey []byte, timestamp, token string) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(timestamp + token))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
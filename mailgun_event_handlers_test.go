@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// newTestMailGunEventService creates a MailGun event service with an empty store and a dry run mail handler.
+func newTestMailGunEventService(t *testing.T) *MailGunEventService {
+	t.Helper()
+
+	subService := newTestSubscriptionService(t)
+
+	return &MailGunEventService{
+		store: subService.store,
+		subService: subService,
+		signingKey: []byte("signing-key"),
+		softBounceThreshold: 3,
+		deliveryRetention: time.Hour * 72,
+		logger: slog.New(slog.NewTextHandler(ioutil.Discard, nil)),
+	}
+}
+
+/// readMailGunFixture reads a sample MailGun event from testdata/mailgun.
+func readMailGunFixture(t *testing.T, name string) *mailGunEventPayload {
+	t.Helper()
+
+	content, err := ioutil.ReadFile(filepath.Join("testdata", "mailgun", name))
+	if err != nil {
+		t.Fatalf("error reading fixture: %s", err)
+	}
+
+	var payload mailGunEventPayload
+
+	if err = json.Unmarshal(content, &payload); err != nil {
+		t.Fatalf("error parsing fixture: %s", err)
+	}
+
+	return &payload
+}
+
+func TestVerifyMailGunSignature(t *testing.T) {
+	eventService := newTestMailGunEventService(t)
+
+	signed := func(signingKey string, signedAt time.Time, token string) *mailGunSignature {
+		timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+
+		return &mailGunSignature{
+			Timestamp: timestamp,
+			Token: token,
+			Signature: signMailGunEvent([]byte(signingKey), timestamp, token),
+		}
+	}
+
+	if _, err := eventService.verifySignature(signed("signing-key", time.Now(), "used-token")); err != nil {
+		t.Fatalf("error verifying the first use of a token: %s", err)
+	}
+
+	tests := []struct {
+		name      string
+		signature *mailGunSignature
+		expected  error
+	}{
+		{"valid", signed("signing-key", time.Now(), "new-token"), nil},
+		{"bad signature", signed("wrong-key", time.Now(), "bad-signature-token"), invalidSignatureError{}},
+		{"stale timestamp", signed("signing-key", time.Now().Add(-time.Hour*73), "stale-token"),
+			invalidSignatureError{}},
+		{"future timestamp", signed("signing-key", time.Now().Add(time.Hour*73), "future-token"),
+			invalidSignatureError{}},
+		{"malformed timestamp", &mailGunSignature{Timestamp: "yesterday", Token: "malformed-token"},
+			invalidSignatureError{}},
+		{"missing token", signed("signing-key", time.Now(), ""), invalidSignatureError{}},
+		{"reused token", signed("signing-key", time.Now(), "used-token"), reusedTokenError{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delivery, err := eventService.verifySignature(test.signature)
+
+			switch test.expected.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("expected signature to be valid, got %s", err)
+				}
+
+				if delivery.Id != test.signature.Token {
+					t.Errorf("expected delivery to be recorded for token '%s', got '%s'", test.signature.Token,
+						delivery.Id)
+				}
+			case invalidSignatureError:
+				if _, ok := err.(invalidSignatureError); !ok {
+					t.Errorf("expected an invalid signature error, got %v", err)
+				}
+			case reusedTokenError:
+				if _, ok := err.(reusedTokenError); !ok {
+					t.Errorf("expected a reused token error, got %v", err)
+				}
+			}
+		})
+	}
+
+	// A bad signature mustn't use up the token, or anyone could block the events MailGun sends
+	if _, err := eventService.verifySignature(signed("signing-key", time.Now(), "bad-signature-token")); err != nil {
+		t.Errorf("expected the token of a badly signed request to still be usable, got %s", err)
+	}
+}
+
+func TestProcessMailGunEvent(t *testing.T) {
+	tests := []struct {
+		fixture             string
+		softBounces         int
+		expectedStatus      storage.SubscriberStatus
+		expectedSoftBounces int
+	}{
+		{"hard_bounce.json", 0, storage.SubscriberSuppressed, 0},
+		{"complaint.json", 0, storage.SubscriberSuppressed, 0},
+		{"soft_bounce.json", 0, storage.SubscriberActive, 1},
+		{"soft_bounce.json", 2, storage.SubscriberSuppressed, 3},
+		{"unsubscribe.json", 0, storage.SubscriberUnsubscribed, 0},
+		{"delivered.json", 2, storage.SubscriberActive, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture+" after "+strconv.Itoa(test.softBounces)+" soft bounces", func(t *testing.T) {
+			eventService := newTestMailGunEventService(t)
+			event := &readMailGunFixture(t, test.fixture).EventData
+
+			err := eventService.store.SaveSubscriber(&storage.Subscriber{
+				EmailAddress: event.Recipient,
+				Status: storage.SubscriberActive,
+				SoftBounces: test.softBounces,
+			})
+
+			if err != nil {
+				t.Fatalf("error saving subscriber: %s", err)
+			}
+
+			outcome, err := eventService.processEvent(context.Background(), event)
+			if err != nil {
+				t.Fatalf("error processing event: %s", err)
+			}
+
+			if outcome != storage.WebHookDeliveryProcessed {
+				t.Errorf("expected event to be processed, got %s", outcome)
+			}
+
+			subscriber, err := eventService.store.GetSubscriber(event.Recipient)
+			if err != nil {
+				t.Fatalf("error reading subscriber: %s", err)
+			}
+
+			if subscriber.Status != test.expectedStatus {
+				t.Errorf("expected status %s, got %s", test.expectedStatus, subscriber.Status)
+			}
+
+			if subscriber.SoftBounces != test.expectedSoftBounces {
+				t.Errorf("expected %d soft bounces, got %d", test.expectedSoftBounces, subscriber.SoftBounces)
+			}
+
+			if test.expectedStatus == storage.SubscriberSuppressed && len(subscriber.SuppressionReason) == 0 {
+				t.Errorf("expected a suppression reason")
+			}
+		})
+	}
+
+	t.Run("soft bounces of a retried email", func(t *testing.T) {
+		eventService := newTestMailGunEventService(t)
+		event := &readMailGunFixture(t, "soft_bounce.json").EventData
+
+		err := eventService.store.SaveSubscriber(&storage.Subscriber{
+			EmailAddress: event.Recipient,
+			Status: storage.SubscriberActive,
+		})
+
+		if err != nil {
+			t.Fatalf("error saving subscriber: %s", err)
+		}
+
+		// MailGun sends an event for each retry of the same email, which only counts once
+		for i := 0; i < 3; i++ {
+			if _, err = eventService.processEvent(context.Background(), event); err != nil {
+				t.Fatalf("error processing event: %s", err)
+			}
+		}
+
+		subscriber, err := eventService.store.GetSubscriber(event.Recipient)
+		if err != nil {
+			t.Fatalf("error reading subscriber: %s", err)
+		}
+
+		if subscriber.Status != storage.SubscriberActive || subscriber.SoftBounces != 1 {
+			t.Fatalf("expected an active subscriber with 1 soft bounce, got %s with %d", subscriber.Status,
+				subscriber.SoftBounces)
+		}
+
+		// Soft bounces of different emails are each counted
+		for _, messageId := range []string{"second@mybb.com", "third@mybb.com"} {
+			event.Message.Headers.MessageId = messageId
+
+			if _, err = eventService.processEvent(context.Background(), event); err != nil {
+				t.Fatalf("error processing event: %s", err)
+			}
+		}
+
+		if subscriber, err = eventService.store.GetSubscriber(event.Recipient); err != nil {
+			t.Fatalf("error reading subscriber: %s", err)
+		}
+
+		if subscriber.Status != storage.SubscriberSuppressed || subscriber.SoftBounces != 3 {
+			t.Errorf("expected a suppressed subscriber with 3 soft bounces, got %s with %d", subscriber.Status,
+				subscriber.SoftBounces)
+		}
+	})
+
+	t.Run("unknown subscriber", func(t *testing.T) {
+		eventService := newTestMailGunEventService(t)
+
+		outcome, err := eventService.processEvent(context.Background(),
+			&readMailGunFixture(t, "hard_bounce.json").EventData)
+
+		if err != nil {
+			t.Fatalf("error processing event: %s", err)
+		}
+
+		if outcome != storage.WebHookDeliveryIgnored {
+			t.Errorf("expected event to be ignored, got %s", outcome)
+		}
+	})
+}
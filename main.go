@@ -1,103 +1,563 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 	"crypto/rand"
 	"fmt"
 	"io/ioutil"
 	"encoding/base64"
+	"html/template"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/csrf"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/jobs"
+	"github.com/mybb/mybb-blog-mailer/logging"
+	"github.com/mybb/mybb-blog-mailer/mail"
+	"github.com/mybb/mybb-blog-mailer/mail/dryrun"
+	"github.com/mybb/mybb-blog-mailer/mail/failover"
 	"github.com/mybb/mybb-blog-mailer/mail/mailgun"
+	"github.com/mybb/mybb-blog-mailer/mail/smtp"
+	"github.com/mybb/mybb-blog-mailer/metrics"
+	"github.com/mybb/mybb-blog-mailer/storage"
 	"github.com/mybb/mybb-blog-mailer/templating"
 )
 
+const (
+	/// httpReadHeaderTimeout is how long a client can take to send the headers of a request.
+	httpReadHeaderTimeout = time.Second * 10
+	/// httpReadTimeout is how long a client can take to send a whole request.
+	httpReadTimeout = time.Second * 30
+	/// httpWriteTimeout is how long a request can take to be handled and its response written, from the end of its
+	/// headers.
+	httpWriteTimeout = time.Second * 30
+	/// httpIdleTimeout is how long a keep-alive connection is kept open waiting for the next request.
+	httpIdleTimeout = time.Second * 120
+)
+
 // init sets basic runtime settings for the application.
 func init() {
 	log.SetFlags(log.LstdFlags)
 	runtime.GOMAXPROCS(runtime.NumCPU())
 }
 
+/// options holds the command line flags shared by every command.
+type options struct {
+	configFilePath       string
+	csrfKeyFilePath      string
+	sessionKeyFilePath   string
+	lastPostDateFilePath string
+	databaseFilePath     string
+}
+
+/// command is a subcommand of the mailer, run with the remaining command line arguments.
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(opts *options, args []string) error
+}
+
+/// commands lists every command, the first being the default if none is given.
+var commands = []command{
+	{"serve", "serve", "run the HTTP server and background jobs", serve},
+	{"send-latest", "send-latest", "check the feed once and notify subscribers of any new posts", sendLatest},
+	{"check-feed", "check-feed", "print the new posts in the feed and the notifications that would be sent",
+		checkFeed},
+	{"render-template", "render-template [-source sample|feed] [-format text|html|mime] notification|confirmation",
+		"render an email for a sample subscriber", renderTemplate},
+	{"subscribers", "subscribers list|add|remove|export", "list, add, remove or export subscribers",
+		manageSubscribers},
+	{"replay-mailgun-event", "replay-mailgun-event file", "sign a saved MailGun event and process it as if it was received",
+		replayMailGunEvent},
+	{"config", "config validate", "check the configuration is valid", manageConfig},
+}
+
+/// usageError is returned by a command given invalid arguments.
+type usageError struct {
+	message string
+}
+
+func (e usageError) Error() string {
+	return e.message
+}
+
 func main() {
-	configFilePath := flag.String("config", "./.env",
+	opts := &options{}
+
+	flag.StringVar(&opts.configFilePath, "config", "./.env",
 		"Optional path to a .env configuration file")
-	storedCsrfKeyFilePath := flag.String("csrf_key_path", "./.csrf_key",
+	flag.StringVar(&opts.csrfKeyFilePath, "csrf_key_path", "./.csrf_key",
 		"Path to store the CSRF key")
-	storedSessionKeyPath := flag.String("session_key_path", "./.session_key",
+	flag.StringVar(&opts.sessionKeyFilePath, "session_key_path", "./.session_key",
 		"Path to store the session key")
-	lastPostDateFilePath := flag.String("last_post_path", "./last_post_date",
-		"Path to store the date of the last blog post that was sent to subscribers")
+	flag.StringVar(&opts.lastPostDateFilePath, "last_post_path", "./last_post_date",
+		"Path of the date of the last blog post that was sent to subscribers by older versions, read once to start the ledger of sent posts")
+	flag.StringVar(&opts.databaseFilePath, "db_path", "./mailer.db",
+		"Path to store the database of subscribers")
 
+	flag.Usage = usage
 	flag.Parse()
 
-	configuration, err := config.InitFromEnvironment(*configFilePath)
+	name := commands[0].name
+	args := flag.Args()
+
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+
+		err := cmd.run(opts, args)
+
+		if _, ok := err.(usageError); ok {
+			slog.Error("invalid arguments", "command", name, logging.Error(err))
+			flag.Usage()
+			os.Exit(2)
+		}
+
+		if err != nil {
+			slog.Error("command failed", "command", name, logging.Error(err))
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	slog.Error("unknown command", "command", name)
+	flag.Usage()
+	os.Exit(2)
+}
+
+/// usage prints the commands and flags the mailer accepts.
+func usage() {
+	output := flag.CommandLine.Output()
+
+	fmt.Fprintf(output, "Usage: %s [flags] [command]\n\nCommands:\n", os.Args[0])
+
+	for _, cmd := range commands {
+		fmt.Fprintf(output, "  %s\n    \t%s\n", cmd.usage, cmd.description)
+	}
+
+	fmt.Fprintf(output, "\nFlags:\n")
+
+	flag.PrintDefaults()
+}
+
+/// loadConfiguration reads the configuration from the environment and the .env file given by the flags, and sets up
+/// the default logger as configured.
+func loadConfiguration(opts *options) (*config.Config, error) {
+	configuration, err := config.InitFromEnvironment(opts.configFilePath)
 
 	if err != nil {
-		log.Printf("[ERROR] initialising configuration: %s\n", err)
-		flag.Usage()
-		os.Exit(1)
+		return nil, fmt.Errorf("initialising configuration: %s", err)
 	}
 
-	sessionKey, err := readOrGenerateKey(*storedSessionKeyPath)
+	slog.SetDefault(logging.New(os.Stderr, &configuration.Log))
+
+	return configuration, nil
+}
+
+/// openStore opens the database given by the flags.
+///
+/// The database can only be opened by one process at a time, so this fails while the server is running.
+func openStore(opts *options) (*storage.Store, error) {
+	store, err := storage.Open(opts.databaseFilePath)
 
 	if err != nil {
-		log.Fatalf("[ERROR] reading or generating session key: %s\n", err)
+		return nil, fmt.Errorf("opening database: %s", err)
+	}
+
+	return store, nil
+}
+
+/// newMailHandler creates the handler for the configured mail backend, or for failing over between several backends.
+func newMailHandler(configuration *config.Config, logger *slog.Logger) mail.Handler {
+	if configuration.MailBackend != "failover" {
+		return newBackendMailHandler(configuration, configuration.MailBackend, logger)
 	}
 
-	mailHandler := mailgun.NewHandler(&configuration.MailGun)
+	var backends []failover.Backend
 
-	templates, err := templating.FindAndParseTemplates("./templates", templating.BuildDefaultFunctionMap())
+	for _, name := range configuration.Failover.Backends {
+		backends = append(backends, failover.Backend{
+			Name: name,
+			Handler: newBackendMailHandler(configuration, name, logger),
+		})
+	}
+
+	return failover.NewHandler(&configuration.Failover, backends, logger)
+}
+
+/// newBackendMailHandler creates the handler for the single mail backend with the given name, counting every call to
+/// it in the metrics.
+func newBackendMailHandler(configuration *config.Config, backend string, logger *slog.Logger) mail.Handler {
+	switch backend {
+	case "smtp":
+		return metrics.NewMailHandler(smtp.ProviderName, smtp.NewHandler(&configuration.SMTP, logger))
+	case "dryrun":
+		logger.Warn("mail backend is dryrun, so emails are recorded instead of being sent", "directory",
+			configuration.DryRun.Directory)
+
+		return metrics.NewMailHandler(dryrun.ProviderName, dryrun.NewHandler(&configuration.DryRun, logger))
+	default:
+		return metrics.NewMailHandler(mailgun.ProviderName, mailgun.NewHandler(&configuration.MailGun, logger))
+	}
+}
+
+/// findMailGunHandler gets the MailGun handler among the configured mail backends, or nil if MailGun isn't used.
+func findMailGunHandler(mailHandler mail.Handler) *mailgun.Handler {
+	if failoverHandler, ok := mailHandler.(*failover.Handler); ok {
+		for _, backend := range failoverHandler.Backends() {
+			if mailGunHandler := findMailGunHandler(backend.Handler); mailGunHandler != nil {
+				return mailGunHandler
+			}
+		}
+	}
+
+	if metricsHandler, ok := mailHandler.(*metrics.MailHandler); ok {
+		return findMailGunHandler(metricsHandler.Unwrap())
+	}
+
+	mailGunHandler, _ := mailHandler.(*mailgun.Handler)
+
+	return mailGunHandler
+}
+
+/// loadTemplates parses every page and email template, building URLs with the given URL builder.
+func loadTemplates(urls *UrlBuilder) (*template.Template, error) {
+	funcMap := templating.BuildDefaultFunctionMap()
+
+	for name, function := range urls.FuncMap() {
+		funcMap[name] = function
+	}
+
+	templates, err := templating.FindAndParseTemplates("./templates", funcMap)
+
+	if err != nil {
+		return nil, fmt.Errorf("reading templates: %s", err)
+	}
+
+	return templates, nil
+}
+
+/// serve runs the HTTP server and the background job workers until the process is stopped.
+func serve(opts *options, args []string) error {
+	configuration, err := loadConfiguration(opts)
 
 	if err != nil {
-		log.Fatalf("[ERROR] reading templates: %s\n", err)
+		return err
 	}
 
-	subscriptionService := NewSubscriptionService(mailHandler, templates, configuration.HmacSecret,
-		sessionKey)
-	webHookService := NewWebHookService(mailHandler, templates, configuration.WebHookSecret, configuration.XmlFeedUrl,
-		*lastPostDateFilePath)
+	logger := slog.Default()
 
-	router := newRouter(subscriptionService, webHookService)
+	if !strings.HasPrefix(configuration.BaseUrl, "https://") {
+		logger.Warn("BASE_URL is not a HTTPS URL, so mail providers will ignore one-click unsubscribe links")
+	}
 
-	csrfKey, err := readOrGenerateKey(*storedCsrfKeyFilePath)
+	sessionKey, err := readOrGenerateKey(opts.sessionKeyFilePath)
 
 	if err != nil {
-		log.Fatalf("[ERROR] reading or generating CSRF key: %s\n", err)
+		return fmt.Errorf("reading or generating session key: %s", err)
 	}
 
-	log.Printf("[DEBUG] starting HTTP server on :%d\n", configuration.ListenPort)
+	csrfKey, err := readOrGenerateKey(opts.csrfKeyFilePath)
+
+	if err != nil {
+		return fmt.Errorf("reading or generating CSRF key: %s", err)
+	}
 
-	err = http.ListenAndServe(":"+strconv.Itoa(configuration.ListenPort), bindMiddleware(router, csrfKey))
+	store, err := openStore(opts)
 
 	if err != nil {
-		log.Fatalf("[ERROR] running HTTP server: %s\n", err)
+		return err
+	}
+
+	defer store.Close()
+
+	mailHandler := newMailHandler(configuration, logger)
+
+	if mailGunHandler := findMailGunHandler(mailHandler); mailGunHandler != nil {
+		if err = importMailingListMembers(store, mailGunHandler, logger); err != nil {
+			return fmt.Errorf("importing MailGun mailing list members: %s", err)
+		}
+	}
+
+	urls := NewUrlBuilder(configuration.BaseUrl)
+	templates, err := loadTemplates(urls)
+
+	if err != nil {
+		return err
+	}
+
+	subscriptionService := NewSubscriptionService(mailHandler, store, templates, configuration.HmacSecret,
+		configuration.ConfirmationTokenTtl, sessionKey, logger)
+	jobQueue := jobs.NewQueue(store, configuration, logger)
+	webHookService := NewWebHookService(mailHandler, store, jobQueue, templates, urls, configuration,
+		opts.lastPostDateFilePath, logger)
+
+	jobQueue.Handle(checkFeedJobKind, webHookService.CheckFeed)
+	jobQueue.Handle(sendCampaignPreviewJobKind, webHookService.SendCampaignPreview)
+	jobQueue.Handle(sendCampaignJobKind, webHookService.SendCampaign)
+	jobQueue.Handle(sendDigestJobKind, webHookService.SendDigest)
+
+	var adminService *AdminService
+
+	if len(configuration.AdminPassword) > 0 {
+		adminService = NewAdminService(store, templates, subscriptionService, webHookService, configuration, logger)
+	} else {
+		logger.Debug("ADMIN_PASSWORD is not set, so the admin area is disabled")
 	}
+
+	var eventService *MailGunEventService
+
+	if len(configuration.MailGun.WebHookSigningKey) > 0 {
+		eventService = NewMailGunEventService(store, subscriptionService, configuration, logger)
+	}
+
+	healthService := NewHealthService(templates, store, mailHandler, webHookService, logger)
+
+	var metricsHandler http.Handler
+	var metricsServer *http.Server
+
+	if len(configuration.MetricsAddr) > 0 {
+		metricsRouter := http.NewServeMux()
+		metricsRouter.Handle("/metrics", promhttp.Handler())
+
+		metricsServer = &http.Server{
+			Addr: configuration.MetricsAddr,
+			Handler: metricsRouter,
+			ReadHeaderTimeout: httpReadHeaderTimeout,
+			ReadTimeout: httpReadTimeout,
+			WriteTimeout: httpWriteTimeout,
+			IdleTimeout: httpIdleTimeout,
+		}
+	} else if adminService != nil {
+		metricsHandler = adminService.RequireAuthentication(promhttp.Handler())
+	} else {
+		logger.Debug("neither METRICS_ADDR nor ADMIN_PASSWORD are set, so metrics are disabled")
+	}
+
+	// The router is needed to build links in emails, so must be set before any job runs
+	router := newRouter(subscriptionService, webHookService, eventService, adminService, healthService,
+		metricsHandler)
+	urls.SetRouter(router)
+
+	// Signals are handled from before any job runs, so that a job is never interrupted without waiting for it
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	if err = jobQueue.Start(); err != nil {
+		return fmt.Errorf("starting job queue: %s", err)
+	}
+
+	var feedPoller *FeedPoller
+
+	if configuration.FeedPollInterval > 0 {
+		logger.Debug("polling feed", "interval", configuration.FeedPollInterval)
+
+		feedPoller = NewFeedPoller(store, jobQueue, configuration, logger)
+		feedPoller.Start()
+	}
+
+	logger.Debug("sending weekly digests", "weekday", configuration.DigestWeekday, "hour_utc",
+		configuration.DigestHour)
+
+	digestScheduler := NewDigestScheduler(store, jobQueue, configuration, logger)
+	digestScheduler.Start()
+
+	server := &http.Server{
+		Addr: ":" + strconv.Itoa(configuration.ListenPort),
+		Handler: bindMiddleware(router, csrfKey, csrfExemptPaths(webHookService.receivers), logger),
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout: httpReadTimeout,
+		WriteTimeout: httpWriteTimeout,
+		IdleTimeout: httpIdleTimeout,
+	}
+
+	serverErrors := make(chan error, 2)
+
+	go func() {
+		logger.Info("starting HTTP server", "port", configuration.ListenPort)
+
+		serverErrors <- server.ListenAndServe()
+	}()
+
+	if metricsServer != nil {
+		go func() {
+			logger.Info("starting metrics server", "address", configuration.MetricsAddr)
+
+			if err := metricsServer.ListenAndServe(); err != nil {
+				serverErrors <- fmt.Errorf("metrics server: %s", err)
+			}
+		}()
+	}
+
+	select {
+	case err = <-serverErrors:
+		err = fmt.Errorf("running HTTP server: %s", err)
+	case <-ctx.Done():
+		logger.Info("shutting down, waiting for requests and running jobs to finish", "timeout",
+			configuration.ShutdownTimeout)
+	}
+
+	// A second signal stops the process straight away
+	stopSignals()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), configuration.ShutdownTimeout)
+	defer cancel()
+
+	if shutdownErr := shutdown(shutdownCtx, server, metricsServer, jobQueue, feedPoller,
+		digestScheduler); shutdownErr != nil {
+		logger.Error("error shutting down cleanly", logging.Error(shutdownErr))
+	} else if err == nil {
+		logger.Info("shut down cleanly")
+	}
+
+	return err
+}
+
+/// shutdown stops the HTTP servers and then the background workers, waiting for HTTP requests and running jobs to
+/// finish until the context is done. Jobs still running then are interrupted, so that a notification being sent stops
+/// between subscribers and records its deliveries for the retry.
+func shutdown(ctx context.Context, server, metricsServer *http.Server, jobQueue *jobs.Queue, feedPoller *FeedPoller,
+	digestScheduler *DigestScheduler) error {
+	var serverErr error
+
+	// Requests are stopped first, as webhooks queue jobs
+	if err := server.Shutdown(ctx); err != nil {
+		serverErr = fmt.Errorf("error shutting down HTTP server: %s", err)
+	}
+
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(ctx); err != nil && serverErr == nil {
+			serverErr = fmt.Errorf("error shutting down metrics server: %s", err)
+		}
+	}
+
+	if feedPoller != nil {
+		feedPoller.Stop()
+	}
+
+	digestScheduler.Stop()
+
+	if err := jobQueue.Stop(ctx); err != nil {
+		return err
+	}
+
+	return serverErr
 }
 
-/// newRouter creates and configures a HTTP router to dispatch requests to handlers.
-func newRouter(subscriptionService *SubscriptionService, whService *WebHookService) *mux.Router {
+/// newRouter creates and configures a HTTP router to dispatch requests to handlers. MailGun events, the admin area, the
+/// health probes and metrics are only routed if their services or handler are given.
+func newRouter(subscriptionService *SubscriptionService, whService *WebHookService,
+	eventService *MailGunEventService, adminService *AdminService, healthService *HealthService,
+	metricsHandler http.Handler) *mux.Router {
 	router := mux.NewRouter()
 
 	router.HandleFunc("/", subscriptionService.Index).Methods("GET").Name("index")
 	router.HandleFunc("/signup", subscriptionService.SignUp).Methods("POST").Name("sign_up")
 	router.HandleFunc("/confirm", subscriptionService.ConfirmSignUp).Methods("GET").Name(
 		"confirm_signup")
+	router.HandleFunc("/unsubscribe", subscriptionService.Unsubscribe).Methods("GET").Name("unsubscribe")
+	router.HandleFunc("/unsubscribe", subscriptionService.ConfirmUnsubscribe).Methods("POST").Name(
+		"confirm_unsubscribe")
+	router.HandleFunc("/unsubscribe/one-click", subscriptionService.OneClickUnsubscribe).Methods("POST").Name(
+		"one_click_unsubscribe")
+	router.HandleFunc("/campaigns/{action:approve|reject}", whService.ReviewCampaign).Methods("GET").Name(
+		"review_campaign")
+	router.HandleFunc("/campaigns/{action:approve|reject}", whService.DecideCampaign).Methods("POST").Name(
+		"decide_campaign")
+
+	for _, receiver := range whService.receivers {
+		router.HandleFunc(receiver.path, whService.Receive(receiver)).Methods("POST").Name(receiver.name)
+	}
 
-	router.HandleFunc("/webhook", whService.Index).Methods("POST").Name("webhook")
+	if eventService != nil {
+		router.HandleFunc("/mailgun/events", eventService.ReceiveEvent).Methods("POST").Name("mailgun_events")
+	}
+
+	if metricsHandler != nil {
+		router.Handle("/metrics", metricsHandler).Methods("GET").Name("metrics")
+	}
+
+	if healthService != nil {
+		router.HandleFunc("/healthz", healthService.Healthz).Methods("GET").Name("healthz")
+		router.HandleFunc("/readyz", healthService.Readyz).Methods("GET").Name("readyz")
+	}
+
+	if adminService != nil {
+		adminRouter := router.PathPrefix("/admin").Subrouter()
+		adminRouter.Use(adminService.RequireAuthentication)
+
+		adminRouter.HandleFunc("", adminService.Dashboard).Methods("GET").Name("admin_dashboard")
+		adminRouter.HandleFunc("/deliveries", adminService.Deliveries).Methods("GET").Name("admin_deliveries")
+		adminRouter.HandleFunc("/preview/notification", adminService.PreviewNotification).Methods("GET").Name(
+			"admin_preview_notification")
+		adminRouter.HandleFunc("/preview/confirmation", adminService.PreviewConfirmation).Methods("GET").Name(
+			"admin_preview_confirmation")
+		adminRouter.HandleFunc("/api/subscribers", adminService.ApiListSubscribers).Methods("GET").Name(
+			"admin_api_list_subscribers")
+		adminRouter.HandleFunc("/api/subscribers", adminService.ApiAddSubscriber).Methods("POST").Name(
+			"admin_api_add_subscriber")
+		adminRouter.HandleFunc("/api/subscribers", adminService.ApiRemoveSubscriber).Methods("DELETE").Name(
+			"admin_api_remove_subscriber")
+		adminRouter.HandleFunc("/api/feed-checks", adminService.ApiCheckFeed).Methods("POST").Name(
+			"admin_api_check_feed")
+	}
 
 	return router
 }
 
-/// bindMiddleware wraps a HTTP handler with a stack of middleware.
-func bindMiddleware(handler http.Handler, csrfkey []byte) http.Handler {
+/// serverRequestedPaths lists the paths other than the webhook receivers' that are requested by other servers rather
+/// than by a browser showing one of our forms.
+var serverRequestedPaths = []string{
+	"/unsubscribe/one-click",
+	"/mailgun/events",
+	"/healthz",
+	"/readyz",
+}
+
+/// csrfExemptPaths builds the set of paths that can never carry a CSRF token, being the path of every webhook receiver,
+/// the other paths requested by other servers and the admin API.
+func csrfExemptPaths(receivers []webHookReceiver) map[string]bool {
+	exemptPaths := make(map[string]bool)
+
+	for _, receiver := range receivers {
+		exemptPaths[receiver.path] = true
+	}
+
+	for _, path := range serverRequestedPaths {
+		exemptPaths[path] = true
+	}
+
+	for _, path := range adminApiPaths {
+		exemptPaths[path] = true
+	}
+
+	return exemptPaths
+}
+
+/// bindMiddleware wraps a HTTP handler with a stack of middleware, the outermost giving each request an ID and a logger
+/// carrying it. Requests to the exempt paths skip CSRF protection.
+func bindMiddleware(handler http.Handler, csrfkey []byte, exemptPaths map[string]bool,
+	logger *slog.Logger) http.Handler {
 	var secureOption csrf.Option
 	if os.Getenv("DEBUG") == "1" {
 		secureOption = csrf.Secure(false)
@@ -106,8 +566,48 @@ func bindMiddleware(handler http.Handler, csrfkey []byte) http.Handler {
 	}
 
 	csrfMiddleware := csrf.Protect(csrfkey, secureOption)
+	csrfProtectedHandler := csrfMiddleware(handler)
+
+	return logging.Middleware(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exemptPaths[r.URL.Path] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		csrfProtectedHandler.ServeHTTP(w, r)
+	}))
+}
+
+/// importMailingListMembers copies the members of the MailGun mailing list into an empty subscriber store, so that
+/// subscribers from before the store existed keep receiving notifications.
+func importMailingListMembers(store *storage.Store, handler *mailgun.Handler, logger *slog.Logger) error {
+	subscribers, err := store.ListSubscribers("")
+
+	if err != nil || len(subscribers) > 0 {
+		return err
+	}
+
+	members, err := handler.GetMailingListMembers()
+
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		err = store.SaveSubscriber(&storage.Subscriber{
+			EmailAddress: member.EmailAddress,
+			Name: member.Name,
+			Status: storage.SubscriberActive,
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.Info("imported members from the MailGun mailing list", "members", len(members))
 
-	return csrfMiddleware(handler)
+	return nil
 }
 
 /// readOrGenerateKey reads a 32 byte key from a base64 encoded file, or generates a new key f the file doesn't exist or is empty.
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"github.com/mybb/mybb-blog-mailer/mail"
+)
+
+/// MailHandler wraps the handler of a single mail backend, counting every call to it in MailSends.
+type MailHandler struct {
+	provider string
+	handler  mail.Handler
+}
+
+/// NewMailHandler wraps the handler of the mail backend with the given name so that calls to it are counted.
+func NewMailHandler(provider string, handler mail.Handler) *MailHandler {
+	return &MailHandler{
+		provider: provider,
+		handler: handler,
+	}
+}
+
+/// Unwrap gets the handler calls are counted for.
+func (h *MailHandler) Unwrap() mail.Handler {
+	return h.handler
+}
+
+func (h *MailHandler) CheckValidEmail(emailAddress string) (bool, error) {
+	valid, err := h.handler.CheckValidEmail(emailAddress)
+
+	h.count("validate", err)
+
+	return valid, err
+}
+
+func (h *MailHandler) SendSubscriptionConfirmationEmail(emailAddress string, textContent, htmlContent string) error {
+	err := h.handler.SendSubscriptionConfirmationEmail(emailAddress, textContent, htmlContent)
+
+	h.count("confirmation", err)
+
+	return err
+}
+
+func (h *MailHandler) SubscribeEmailToMailingList(emailAddress, name string) error {
+	err := h.handler.SubscribeEmailToMailingList(emailAddress, name)
+
+	h.count("subscribe", err)
+
+	return err
+}
+
+func (h *MailHandler) UnsubscribeEmailFromMailingList(emailAddress string) error {
+	err := h.handler.UnsubscribeEmailFromMailingList(emailAddress)
+
+	h.count("unsubscribe", err)
+
+	return err
+}
+
+func (h *MailHandler) SendAdminEmail(emailAddress, subject string, textContent, htmlContent string) error {
+	err := h.handler.SendAdminEmail(emailAddress, subject, textContent, htmlContent)
+
+	h.count("admin", err)
+
+	return err
+}
+
+func (h *MailHandler) SendNotificationToSubscriber(emailAddress, unsubscribeUrl, subject string, textContent,
+	htmlContent string) (mail.SentMessage, error) {
+	sentMessage, err := h.handler.SendNotificationToSubscriber(emailAddress, unsubscribeUrl, subject, textContent,
+		htmlContent)
+
+	h.count("notification", err)
+
+	return sentMessage, err
+}
+
+/// Ping checks that the backend can be reached. Pings aren't counted, as they send nothing.
+func (h *MailHandler) Ping() error {
+	return h.handler.Ping()
+}
+
+/// count counts a call to the backend.
+func (h *MailHandler) count(operation string, err error) {
+	MailSends.WithLabelValues(h.provider, operation, Result(err)).Inc()
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+/// namespace prefixes the name of every metric.
+const namespace = "blog_mailer"
+
+/// Results of operations, used as the "result" label of the metrics counting them.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+/// SignUps counts sign-up requests by result: "confirmation_sent", "invalid" if validation failed, "suppressed" if the
+/// address was suppressed so wasn't emailed, or "error".
+var SignUps = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name: "signups_total",
+	Help: "Sign-up requests by result.",
+}, []string{"result"})
+
+/// Confirmations counts requests to confirm a subscription by result: "confirmed", "expired", "invalid",
+/// "already_used", "suppressed" or "error".
+var Confirmations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name: "confirmations_total",
+	Help: "Subscription confirmation requests by result.",
+}, []string{"result"})
+
+/// ValidationFailures counts sign-up requests rejected by the field that failed validation.
+var ValidationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name: "validation_failures_total",
+	Help: "Sign-up requests rejected by the field that failed validation.",
+}, []string{"field"})
+
+/// WebHookEvents counts webhook deliveries by the receiver they were sent to, the type of event and what was done with
+/// them.
+var WebHookEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name: "webhook_events_total",
+	Help: "Webhook deliveries by receiver, event type and status.",
+}, []string{"receiver", "event", "status"})
+
+/// FeedFetchDuration observes how long fetching and parsing the feed takes, whether or not it succeeds.
+var FeedFetchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name: "feed_fetch_duration_seconds",
+	Help: "Time taken to fetch and parse the feed.",
+	Buckets: prometheus.DefBuckets,
+})
+
+/// FeedFetchErrors counts failures to fetch or parse the feed.
+var FeedFetchErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name: "feed_fetch_errors_total",
+	Help: "Failures to fetch or parse the feed.",
+})
+
+/// TemplateRenderErrors counts failures to render an email by template name.
+var TemplateRenderErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name: "template_render_errors_total",
+	Help: "Failures to render an email by template.",
+}, []string{"template"})
+
+/// MailSends counts calls to the mail backends by provider, operation and result.
+var MailSends = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name: "mail_sends_total",
+	Help: "Calls to the mail backends by provider, operation and result.",
+}, []string{"provider", "operation", "result"})
+
+/// Result gets the result label of an operation that returned the given error.
+func Result(err error) string {
+	if err != nil {
+		return ResultFailure
+	}
+
+	return ResultSuccess
+}
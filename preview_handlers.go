@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/logging"
+	"github.com/mybb/mybb-blog-mailer/mail"
+)
+
+const (
+	/// previewEmailAddress is the address of the subscriber emails are previewed for.
+	previewEmailAddress = "subscriber@example.com"
+	/// previewName is the name of the subscriber emails are previewed for.
+	previewName = "Sample Subscriber"
+	/// previewConfirmationToken stands in for the confirmation token in previews, so that a preview never contains a
+	/// working confirmation link.
+	previewConfirmationToken = "preview"
+)
+
+/// emailPreview is an email rendered for a sample subscriber without sending it.
+type emailPreview struct {
+	Subject     string
+	TextContent string
+	HtmlContent string
+	/// RawMessage is the complete MIME message as it would be sent through an SMTP server.
+	RawMessage string
+}
+
+/// PreviewNotification handles a request to /admin/preview/notification, rendering the notification of a single blog
+/// post for a sample subscriber. The post is the newest post in the feed if the source query parameter is "feed", or
+/// a sample post otherwise.
+func (adminService *AdminService) PreviewNotification(w http.ResponseWriter, r *http.Request) {
+	source := r.URL.Query().Get("source")
+
+	preview, err := buildNotificationPreview(adminService.whService, adminService.fromAddress, adminService.fromName,
+		source == "feed")
+
+	if err != nil {
+		logging.FromContext(r.Context(), adminService.logger).Error("error rendering notification preview",
+			logging.Error(err))
+
+		http.Error(w, fmt.Sprintf("Error rendering notification: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	adminService.templates.ExecuteTemplate(w, "admin/preview.html", map[string]interface{}{
+		"name": "Notification",
+		"source": source,
+		"preview": preview,
+	})
+}
+
+/// PreviewConfirmation handles a request to /admin/preview/confirmation, rendering the email asking a sample
+/// subscriber to confirm their subscription.
+func (adminService *AdminService) PreviewConfirmation(w http.ResponseWriter, r *http.Request) {
+	preview, err := buildConfirmationPreview(adminService.subService, adminService.fromAddress,
+		adminService.fromName)
+
+	if err != nil {
+		logging.FromContext(r.Context(), adminService.logger).Error("error rendering confirmation email preview",
+			logging.Error(err))
+
+		http.Error(w, fmt.Sprintf("Error rendering confirmation email: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	adminService.templates.ExecuteTemplate(w, "admin/preview.html", map[string]interface{}{
+		"name": "Confirmation Email",
+		"preview": preview,
+	})
+}
+
+/// buildNotificationPreview renders the notification of a single blog post for a sample subscriber, using the newest
+/// post in the feed if fromFeed is set or a sample post otherwise.
+func buildNotificationPreview(whService *WebHookService, fromAddress, fromName string,
+	fromFeed bool) (*emailPreview, error) {
+	post := &newBlogPost{
+		Key: "https://blog.mybb.com/sample-post",
+		Title: "A Sample Blog Post",
+		Summary: "<p>This is the summary of a sample blog post, with <strong>formatting</strong> and " +
+			"<a href=\"https://mybb.com\">a link</a>.</p>",
+		Url: "https://blog.mybb.com/sample-post",
+		PublishedAt: time.Now(),
+		Author: "MyBB Team",
+	}
+
+	if fromFeed {
+		feedPosts, _, err := whService.readFeedPosts(nil)
+
+		if err != nil {
+			return nil, fmt.Errorf("error reading feed: %s", err)
+		}
+
+		if len(feedPosts) == 0 {
+			return nil, fmt.Errorf("the feed has no posts")
+		}
+
+		post = feedPosts[0]
+
+		for _, feedPost := range feedPosts {
+			if feedPost.PublishedAt.After(post.PublishedAt) {
+				post = feedPost
+			}
+		}
+	}
+
+	notification := whService.planNotifications([]*newBlogPost{post})[0]
+
+	unsubscribeUrl, err := buildUnsubscribeUrl(whService.urls, whService.hmacSecret, previewEmailAddress)
+
+	if err != nil {
+		return nil, err
+	}
+
+	oneClickUnsubscribeUrl, err := buildOneClickUnsubscribeUrl(whService.urls, whService.hmacSecret,
+		previewEmailAddress)
+
+	if err != nil {
+		return nil, err
+	}
+
+	textContent, htmlContent, err := whService.renderNotification(notification, notificationRecipient{
+		Name: previewName,
+		EmailAddress: previewEmailAddress,
+		UnsubscribeUrl: unsubscribeUrl,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newEmailPreview(fromAddress, fromName, notification.subject, map[string]string{
+		"List-Unsubscribe": "<" + oneClickUnsubscribeUrl + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}, textContent, htmlContent)
+}
+
+/// buildConfirmationPreview renders the email asking a sample subscriber to confirm their subscription.
+func buildConfirmationPreview(subService *SubscriptionService, fromAddress, fromName string) (*emailPreview, error) {
+	textContent, htmlContent, err := subService.renderConfirmationEmail(previewEmailAddress, previewName,
+		previewConfirmationToken)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newEmailPreview(fromAddress, fromName, "Confirm Subscription", nil, textContent, htmlContent)
+}
+
+/// newEmailPreview builds the MIME message of a rendered email to preview it.
+func newEmailPreview(fromAddress, fromName, subject string, headers map[string]string, textContent,
+	htmlContent string) (*emailPreview, error) {
+	message, err := mail.NewMessage(fromAddress, fromName, previewEmailAddress, subject, headers, textContent,
+		htmlContent)
+
+	if err != nil {
+		return nil, fmt.Errorf("error building MIME message: %s", err)
+	}
+
+	return &emailPreview{
+		Subject: subject,
+		TextContent: textContent,
+		HtmlContent: htmlContent,
+		RawMessage: string(message.Bytes()),
+	}, nil
+}
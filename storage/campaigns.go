@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var campaignsBucket = []byte("campaigns")
+
+/// CampaignStatus is the state of a campaign held for approval.
+type CampaignStatus string
+
+const (
+	/// CampaignPending is a campaign waiting to be approved or rejected.
+	CampaignPending CampaignStatus = "pending"
+	/// CampaignApproved is a campaign that was approved and is waiting to be sent.
+	CampaignApproved CampaignStatus = "approved"
+	/// CampaignRejected is a campaign that was rejected, so is never sent.
+	CampaignRejected CampaignStatus = "rejected"
+	/// CampaignSent is a campaign whose notifications were sent.
+	CampaignSent CampaignStatus = "sent"
+)
+
+/// CampaignPost is a snapshot of a blog post in a campaign, taken when the post was found in the feed so that what
+/// is sent is exactly what was approved.
+type CampaignPost struct {
+	Key         string    `json:"key"`
+	Title       string    `json:"title"`
+	Summary     string    `json:"summary"`
+	Url         string    `json:"url"`
+	PublishedAt time.Time `json:"published_at"`
+	Author      string    `json:"author"`
+}
+
+/// Campaign is a notification of new blog posts that is held until an administrator approves it.
+type Campaign struct {
+	/// Id is the sequential identifier of the campaign, assigned when it is created.
+	Id uint64 `json:"id"`
+	/// Posts are the posts the notification is for.
+	Posts []CampaignPost `json:"posts"`
+	/// Status is the state of the campaign.
+	Status CampaignStatus `json:"status"`
+	/// CreatedAt is the time the campaign was created.
+	CreatedAt time.Time `json:"created_at"`
+	/// AutoSendAt is the time the campaign is approved automatically if it hasn't been rejected, if ever.
+	AutoSendAt *time.Time `json:"auto_send_at,omitempty"`
+	/// DecidedAt is the time the campaign was approved or rejected.
+	DecidedAt *time.Time `json:"decided_at,omitempty"`
+	/// DecidedBy describes who approved or rejected the campaign.
+	DecidedBy string `json:"decided_by,omitempty"`
+	/// SentAt is the time the notifications for the campaign were sent.
+	SentAt *time.Time `json:"sent_at,omitempty"`
+}
+
+/// CreateCampaign persists a new campaign, assigning its ID.
+func (s *Store) CreateCampaign(campaign *Campaign) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(campaignsBucket)
+
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		campaign.Id = id
+		campaign.CreatedAt = time.Now().UTC()
+
+		value, err := json.Marshal(campaign)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(sequenceKey(id), value)
+	})
+}
+
+/// GetCampaign finds the campaign with the given ID, returning a NotFoundError if there is none.
+func (s *Store) GetCampaign(id uint64) (*Campaign, error) {
+	var campaign *Campaign
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(campaignsBucket).Get(sequenceKey(id))
+
+		if value == nil {
+			return NotFoundError{
+				Key: strconv.FormatUint(id, 10),
+			}
+		}
+
+		campaign = &Campaign{}
+
+		return json.Unmarshal(value, campaign)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return campaign, nil
+}
+
+/// SaveCampaign updates a campaign.
+func (s *Store) SaveCampaign(campaign *Campaign) error {
+	value, err := json.Marshal(campaign)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(campaignsBucket).Put(sequenceKey(campaign.Id), value)
+	})
+}
+
+/// ListCampaigns lists every campaign, most recent first.
+func (s *Store) ListCampaigns() ([]Campaign, error) {
+	var campaigns []Campaign
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(campaignsBucket).Cursor()
+
+		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+			var campaign Campaign
+
+			if err := json.Unmarshal(v, &campaign); err != nil {
+				return err
+			}
+
+			campaigns = append(campaigns, campaign)
+		}
+
+		return nil
+	})
+
+	return campaigns, err
+}
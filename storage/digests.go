@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var digestsBucket = []byte("digests")
+
+/// DigestStatus is the state of a weekly digest.
+type DigestStatus string
+
+const (
+	/// DigestQueued is a digest whose job has been queued but hasn't finished sending.
+	DigestQueued DigestStatus = "queued"
+	/// DigestEmpty is a digest for a period in which no posts were sent, so was never emailed.
+	DigestEmpty DigestStatus = "empty"
+	/// DigestSent is a digest that was delivered to every digest subscriber, other than those it failed permanently for
+	/// or was given up on for after too many attempts.
+	DigestSent DigestStatus = "sent"
+	/// DigestFailed is a digest that failed for at least one subscriber, to be retried for them.
+	DigestFailed DigestStatus = "failed"
+)
+
+/// Digest is a single email listing the posts sent during a period, sent to subscribers who asked for fewer emails.
+type Digest struct {
+	/// PeriodStart is the start of the period the digest covers.
+	PeriodStart time.Time `json:"period_start"`
+	/// PeriodEnd is the end of the period the digest covers, identifying the digest.
+	PeriodEnd time.Time `json:"period_end"`
+	/// Status is the state of the digest.
+	Status DigestStatus `json:"status"`
+	/// JobId is the ID of the job sending the digest.
+	JobId uint64 `json:"job_id,omitempty"`
+	/// PostKeys are the keys of the posts listed in the digest, once it has been sent.
+	PostKeys []string `json:"post_keys,omitempty"`
+	/// SentAt is the time the digest was last sent.
+	SentAt time.Time `json:"sent_at,omitempty"`
+	/// Delivered is the number of subscribers the digest was delivered to.
+	Delivered int `json:"delivered"`
+	/// Failed is the number of subscribers the digest could not be delivered to.
+	Failed int `json:"failed"`
+}
+
+/// DeliveryKey gets the key deliveries of the digest are recorded with, alongside the deliveries of posts.
+func (d *Digest) DeliveryKey() string {
+	return "digest:" + d.PeriodEnd.UTC().Format(time.RFC3339)
+}
+
+/// digestKey builds the key for the digest of the period ending at the given time, so that digests sort by period.
+func digestKey(periodEnd time.Time) []byte {
+	return []byte(periodEnd.UTC().Format(time.RFC3339))
+}
+
+/// GetDigest finds the digest of the period ending at the given time, returning nil if there is none.
+func (s *Store) GetDigest(periodEnd time.Time) (*Digest, error) {
+	var digest *Digest
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(digestsBucket).Get(digestKey(periodEnd))
+
+		if value == nil {
+			return nil
+		}
+
+		digest = &Digest{}
+
+		return json.Unmarshal(value, digest)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return digest, nil
+}
+
+/// GetLatestDigest finds the digest of the most recent period, returning nil if no digest was ever queued.
+func (s *Store) GetLatestDigest() (*Digest, error) {
+	var digest *Digest
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		_, value := tx.Bucket(digestsBucket).Cursor().Last()
+
+		if value == nil {
+			return nil
+		}
+
+		digest = &Digest{}
+
+		return json.Unmarshal(value, digest)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return digest, nil
+}
+
+/// SaveDigest creates or updates a digest.
+func (s *Store) SaveDigest(digest *Digest) error {
+	value, err := json.Marshal(digest)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(digestsBucket).Put(digestKey(digest.PeriodEnd), value)
+	})
+}
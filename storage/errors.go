@@ -0,0 +1,32 @@
+package storage
+
+/// NotFoundError is an error returned if a requested record does not exist.
+type NotFoundError struct {
+	/// Key is the key of the missing record.
+	Key string
+}
+
+func (e NotFoundError) Error() string {
+	return "record '" + e.Key + "' not found"
+}
+
+/// SuppressedError is an error returned when subscribing an email address that was suppressed, as it mustn't be emailed
+/// again.
+type SuppressedError struct {
+	/// EmailAddress is the suppressed email address.
+	EmailAddress string
+}
+
+func (e SuppressedError) Error() string {
+	return "subscriber '" + e.EmailAddress + "' is suppressed"
+}
+
+/// LockedError is an error returned when opening a store another process has open, such as the running server.
+type LockedError struct {
+	/// Path is the file path of the store.
+	Path string
+}
+
+func (e LockedError) Error() string {
+	return "database '" + e.Path + "' is in use by another process"
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var feedStateKey = []byte("feed_state")
+
+/// FeedState records the last time the feed was checked, along with the validators needed to make the next request
+/// conditional.
+type FeedState struct {
+	/// Url is the URL of the feed the state is for.
+	Url string `json:"url"`
+	/// ETag is the entity tag of the feed from the last response.
+	ETag string `json:"etag,omitempty"`
+	/// LastModified is the value of the Last-Modified header from the last response.
+	LastModified string `json:"last_modified,omitempty"`
+	/// CheckedAt is the time the feed was last successfully checked.
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+/// GetFeedState gets the state of the feed with the given URL, or nil if it has never been checked.
+func (s *Store) GetFeedState(url string) (*FeedState, error) {
+	var state *FeedState
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(metaBucket).Get(feedStateKey)
+
+		if value == nil {
+			return nil
+		}
+
+		state = &FeedState{}
+
+		return json.Unmarshal(value, state)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The validators of a different feed are of no use
+	if state != nil && state.Url != url {
+		return nil, nil
+	}
+
+	return state, nil
+}
+
+/// SaveFeedState records the state of the feed after it was checked.
+func (s *Store) SaveFeedState(state *FeedState) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(feedStateKey, value)
+	})
+}
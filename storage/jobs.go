@@ -0,0 +1,314 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	jobsBucket = []byte("jobs")
+	/// pendingJobsBucket indexes pending jobs by the time they are due and their ID, so that the next job due can be
+	/// found without reading every job.
+	pendingJobsBucket = []byte("pending_jobs")
+)
+
+/// JobStatus is the state of a background job.
+type JobStatus string
+
+const (
+	/// JobPending is a job waiting to be run, either for the first time or to be retried.
+	JobPending JobStatus = "pending"
+	/// JobRunning is a job currently being run by a worker.
+	JobRunning JobStatus = "running"
+	/// JobSucceeded is a job that ran successfully.
+	JobSucceeded JobStatus = "succeeded"
+	/// JobDead is a job that failed too many times and won't be retried.
+	JobDead JobStatus = "dead"
+)
+
+/// Job is a unit of background work, persisted so that it survives restarts.
+type Job struct {
+	/// Id is the sequential identifier of the job, assigned when it is enqueued.
+	Id uint64 `json:"id"`
+	/// Kind determines how the job is processed.
+	Kind string `json:"kind"`
+	/// Payload holds the parameters of the job, if it has any.
+	Payload json.RawMessage `json:"payload,omitempty"`
+	/// Status is the state of the job.
+	Status JobStatus `json:"status"`
+	/// Attempts is the number of times running the job has been attempted.
+	Attempts int `json:"attempts"`
+	/// LastError is the reason the last attempt failed, if it did.
+	LastError string `json:"last_error,omitempty"`
+	/// RunAt is the earliest time the job should next be run.
+	RunAt time.Time `json:"run_at"`
+	/// CreatedAt is the time the job was enqueued.
+	CreatedAt time.Time `json:"created_at"`
+	/// UpdatedAt is the time the job last changed.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+/// sequenceKey gets the key of a record with a sequential ID, encoded big endian so that records are iterated in the
+/// order they were created.
+func sequenceKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+
+	return key
+}
+
+/// pendingJobKey gets the key of a pending job in the index, ordered by the time it is due and then by its ID.
+func pendingJobKey(job *Job) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(job.RunAt.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], job.Id)
+
+	return key
+}
+
+/// EnqueueJob persists a new pending job, assigning its ID.
+func (s *Store) EnqueueJob(job *Job) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+
+		job.Id = id
+		job.Status = JobPending
+		job.CreatedAt = now
+		job.UpdatedAt = now
+
+		if job.RunAt.IsZero() {
+			job.RunAt = now
+		}
+
+		return putJob(tx, job)
+	})
+}
+
+/// ClaimJob marks the pending job that has been due for longest at the given time as running and returns it, or returns
+/// nil if no job is due.
+func (s *Store) ClaimJob(now time.Time) (*Job, error) {
+	var claimed *Job
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// The index is ordered by due time, so only the first job in it can be due
+		k, _ := tx.Bucket(pendingJobsBucket).Cursor().First()
+
+		if k == nil || int64(binary.BigEndian.Uint64(k)) > now.UnixNano() {
+			return nil
+		}
+
+		value := tx.Bucket(jobsBucket).Get(k[8:])
+
+		if value == nil {
+			// The job is gone, so drop it from the index rather than blocking the jobs due after it
+			return tx.Bucket(pendingJobsBucket).Delete(k)
+		}
+
+		var job Job
+
+		if err := json.Unmarshal(value, &job); err != nil {
+			return err
+		}
+
+		job.Status = JobRunning
+		job.UpdatedAt = now.UTC()
+		claimed = &job
+
+		return putJob(tx, claimed)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return claimed, nil
+}
+
+/// SaveJob updates a job.
+func (s *Store) SaveJob(job *Job) error {
+	job.UpdatedAt = time.Now().UTC()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putJob(tx, job)
+	})
+}
+
+/// ListJobs lists the jobs with the given status, or every job if the status is empty, most recent first.
+func (s *Store) ListJobs(status JobStatus) ([]Job, error) {
+	var jobs []Job
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(jobsBucket).Cursor()
+
+		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+			var job Job
+
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+
+			if len(status) == 0 || job.Status == status {
+				jobs = append(jobs, job)
+			}
+		}
+
+		return nil
+	})
+
+	return jobs, err
+}
+
+/// RequeueRunningJobs marks every running job as pending again, returning how many there were.
+///
+/// This is used on startup, when any job recorded as running was interrupted by the process stopping.
+func (s *Store) RequeueRunningJobs() (int, error) {
+	requeued := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+
+		var interrupted []Job
+
+		err := bucket.ForEach(func(k, v []byte) error {
+			var job Job
+
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+
+			if job.Status == JobRunning {
+				interrupted = append(interrupted, job)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+
+		for i := range interrupted {
+			interrupted[i].Status = JobPending
+			interrupted[i].RunAt = now
+			interrupted[i].UpdatedAt = now
+
+			if err = putJob(tx, &interrupted[i]); err != nil {
+				return err
+			}
+		}
+
+		requeued = len(interrupted)
+
+		return nil
+	})
+
+	return requeued, err
+}
+
+/// PruneJobs deletes every succeeded job that finished before the first given time, and every dead job that gave up
+/// before the second, returning how many were deleted.
+func (s *Store) PruneJobs(succeededBefore, deadBefore time.Time) (int, error) {
+	pruned := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+
+		var expired [][]byte
+
+		err := bucket.ForEach(func(k, v []byte) error {
+			var job Job
+
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+
+			if (job.Status == JobSucceeded && job.UpdatedAt.Before(succeededBefore)) ||
+				(job.Status == JobDead && job.UpdatedAt.Before(deadBefore)) {
+				expired = append(expired, k)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err = bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		pruned = len(expired)
+
+		return nil
+	})
+
+	return pruned, err
+}
+
+/// putJob writes a job, keeping the index of pending jobs up to date.
+func putJob(tx *bolt.Tx, job *Job) error {
+	bucket := tx.Bucket(jobsBucket)
+	index := tx.Bucket(pendingJobsBucket)
+	key := sequenceKey(job.Id)
+
+	if previousValue := bucket.Get(key); previousValue != nil {
+		var previous Job
+
+		if err := json.Unmarshal(previousValue, &previous); err != nil {
+			return err
+		}
+
+		if previous.Status == JobPending {
+			if err := index.Delete(pendingJobKey(&previous)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if job.Status == JobPending {
+		if err := index.Put(pendingJobKey(job), nil); err != nil {
+			return err
+		}
+	}
+
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(key, value)
+}
+
+/// indexPendingJobs adds every pending job to the index of pending jobs, for stores created before it existed.
+func indexPendingJobs(tx *bolt.Tx) error {
+	index := tx.Bucket(pendingJobsBucket)
+
+	return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+		var job Job
+
+		if err := json.Unmarshal(v, &job); err != nil {
+			return err
+		}
+
+		if job.Status != JobPending {
+			return nil
+		}
+
+		return index.Put(pendingJobKey(&job), nil)
+	})
+}
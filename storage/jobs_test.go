@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClaimJobInDueOrder(t *testing.T) {
+	store := openTestStore(t)
+	now := time.Now().UTC()
+
+	later := &Job{Kind: "later", RunAt: now.Add(-time.Minute)}
+	earlier := &Job{Kind: "earlier", RunAt: now.Add(-time.Hour)}
+	future := &Job{Kind: "future", RunAt: now.Add(time.Hour)}
+
+	for _, job := range []*Job{later, earlier, future} {
+		if err := store.EnqueueJob(job); err != nil {
+			t.Fatalf("error enqueueing job: %s", err)
+		}
+	}
+
+	for _, expected := range []string{"earlier", "later", ""} {
+		claimed, err := store.ClaimJob(now)
+		if err != nil {
+			t.Fatalf("error claiming job: %s", err)
+		}
+
+		kind := ""
+
+		if claimed != nil {
+			kind = claimed.Kind
+
+			if claimed.Status != JobRunning {
+				t.Errorf("expected claimed job to be running, got %s", claimed.Status)
+			}
+		}
+
+		if kind != expected {
+			t.Fatalf("expected to claim '%s', got '%s'", expected, kind)
+		}
+	}
+
+	// Retrying a job moves it in the index to its new due time
+	later.Status = JobPending
+	later.RunAt = now.Add(time.Hour * 2)
+
+	if err := store.SaveJob(later); err != nil {
+		t.Fatalf("error saving job: %s", err)
+	}
+
+	claimed, err := store.ClaimJob(now.Add(time.Hour * 3))
+	if err != nil {
+		t.Fatalf("error claiming job: %s", err)
+	}
+
+	if claimed == nil || claimed.Kind != "future" {
+		t.Fatalf("expected to claim 'future', got %+v", claimed)
+	}
+
+	requeued, err := store.RequeueRunningJobs()
+	if err != nil {
+		t.Fatalf("error requeueing jobs: %s", err)
+	}
+
+	if requeued != 2 {
+		t.Errorf("expected 2 running jobs to be requeued, got %d", requeued)
+	}
+}
+
+func TestPruneJobs(t *testing.T) {
+	store := openTestStore(t)
+
+	for _, status := range []JobStatus{JobPending, JobSucceeded, JobDead} {
+		job := &Job{Kind: string(status)}
+
+		if err := store.EnqueueJob(job); err != nil {
+			t.Fatalf("error enqueueing job: %s", err)
+		}
+
+		job.Status = status
+
+		if err := store.SaveJob(job); err != nil {
+			t.Fatalf("error saving job: %s", err)
+		}
+	}
+
+	now := time.Now()
+
+	pruned, err := store.PruneJobs(now.Add(time.Minute), now.Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("error pruning jobs: %s", err)
+	}
+
+	if pruned != 1 {
+		t.Errorf("expected only the succeeded job to be pruned, pruned %d", pruned)
+	}
+
+	pruned, err = store.PruneJobs(now.Add(time.Minute), now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("error pruning jobs: %s", err)
+	}
+
+	if pruned != 1 {
+		t.Errorf("expected the dead job to be pruned once it's old enough, pruned %d", pruned)
+	}
+
+	jobs, err := store.ListJobs("")
+	if err != nil {
+		t.Fatalf("error listing jobs: %s", err)
+	}
+
+	if len(jobs) != 1 || jobs[0].Status != JobPending {
+		t.Errorf("expected only the pending job to be kept, got %+v", jobs)
+	}
+}
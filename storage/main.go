@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/// Store is a persistent, embedded store for the application's state.
+type Store struct {
+	db *bolt.DB
+}
+
+/// buckets lists every bucket the store uses, created when the store is opened.
+var buckets = [][]byte{
+	subscribersBucket,
+	noncesBucket,
+	sentPostsBucket,
+	deliveriesBucket,
+	metaBucket,
+	jobsBucket,
+	pendingJobsBucket,
+	webHookDeliveriesBucket,
+	campaignsBucket,
+	digestsBucket,
+}
+
+/// Open opens or creates the store at the given file path.
+///
+/// Only one process can have the store open at a time, so a LockedError is returned if another process doesn't release
+/// it within a few seconds.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		Timeout: time.Second * 5,
+	})
+
+	if err == bolt.ErrTimeout {
+		return nil, LockedError{path}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		indexed := tx.Bucket(pendingJobsBucket) != nil
+
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		if !indexed {
+			return indexPendingJobs(tx)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	return &Store{
+		db: db,
+	}, nil
+}
+
+/// Ping checks that the store can be written to by committing an empty write transaction.
+func (s *Store) Ping() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+/// Close closes the store, releasing the lock on its file.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
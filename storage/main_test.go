@@ -0,0 +1,22 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+/// openTestStore opens an empty store in a temporary directory, closing it when the test finishes.
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	store, err := Open(filepath.Join(t.TempDir(), "mailer.db"))
+	if err != nil {
+		t.Fatalf("error opening store: %s", err)
+	}
+
+	t.Cleanup(func() {
+		store.Close()
+	})
+
+	return store
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var noncesBucket = []byte("nonces")
+
+/// SaveSubscriberWithNonce creates or replaces a subscriber and records the single-use nonce that confirmed them as used
+/// in the same transaction, returning false and saving nothing if the nonce had already been used. A SuppressedError is
+/// returned without using the nonce if the existing subscriber was suppressed.
+func (s *Store) SaveSubscriberWithNonce(subscriber *Subscriber, nonce string, expiresAt time.Time) (bool, error) {
+	subscriber.UpdatedAt = time.Now().UTC()
+
+	value, err := json.Marshal(subscriber)
+	if err != nil {
+		return false, err
+	}
+
+	firstUse := false
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(subscribersBucket)
+
+		if err := checkNotSuppressed(bucket, subscriber.EmailAddress); err != nil {
+			return err
+		}
+
+		var err error
+
+		if firstUse, err = useNonce(tx, nonce, expiresAt); err != nil || !firstUse {
+			return err
+		}
+
+		return bucket.Put(subscriberKey(subscriber.EmailAddress), value)
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return firstUse, nil
+}
+
+/// useNonce records that a single-use nonce has been used, returning false if it had already been used.
+///
+/// The nonce is remembered until the given expiry time, after which whatever it protects is no longer valid anyway and
+/// the record is pruned.
+func useNonce(tx *bolt.Tx, nonce string, expiresAt time.Time) (bool, error) {
+	bucket := tx.Bucket(noncesBucket)
+
+	if err := pruneNonces(bucket, time.Now()); err != nil {
+		return false, err
+	}
+
+	if bucket.Get([]byte(nonce)) != nil {
+		return false, nil
+	}
+
+	return true, bucket.Put([]byte(nonce), []byte(expiresAt.UTC().Format(time.RFC3339)))
+}
+
+/// pruneNonces deletes every nonce that expired before the given time.
+func pruneNonces(bucket *bolt.Bucket, now time.Time) error {
+	var expired [][]byte
+
+	err := bucket.ForEach(func(k, v []byte) error {
+		expiresAt, err := time.Parse(time.RFC3339, string(v))
+
+		if err != nil || expiresAt.Before(now) {
+			expired = append(expired, k)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, k := range expired {
+		if err = bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
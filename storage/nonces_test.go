@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSaveSubscriberWithNonce(t *testing.T) {
+	store := openTestStore(t)
+	expiresAt := time.Now().Add(time.Hour)
+
+	firstUse, err := store.SaveSubscriberWithNonce(&Subscriber{
+		EmailAddress: "someone@example.com",
+		Name: "Someone",
+		Status: SubscriberActive,
+	}, "nonce", expiresAt)
+
+	if err != nil {
+		t.Fatalf("error saving subscriber: %s", err)
+	}
+
+	if !firstUse {
+		t.Fatal("expected a new nonce to be usable")
+	}
+
+	firstUse, err = store.SaveSubscriberWithNonce(&Subscriber{
+		EmailAddress: "someone@example.com",
+		Name: "Someone Else",
+		Status: SubscriberActive,
+	}, "nonce", expiresAt)
+
+	if err != nil {
+		t.Fatalf("error saving subscriber: %s", err)
+	}
+
+	if firstUse {
+		t.Error("expected a used nonce to be rejected")
+	}
+
+	subscriber, err := store.GetSubscriber("someone@example.com")
+	if err != nil {
+		t.Fatalf("error getting subscriber: %s", err)
+	}
+
+	if subscriber.Name != "Someone" {
+		t.Errorf("expected the subscriber not to be replaced with a used nonce, got name '%s'", subscriber.Name)
+	}
+
+	firstUse, err = store.SaveSubscriberWithNonce(&Subscriber{
+		EmailAddress: "other@example.com",
+		Status: SubscriberActive,
+	}, "expired", time.Now().Add(-time.Minute))
+
+	if err != nil {
+		t.Fatalf("error saving subscriber: %s", err)
+	}
+
+	if !firstUse {
+		t.Error("expected a new nonce to be usable")
+	}
+}
+
+func TestSaveSubscriberWithNonceSuppressed(t *testing.T) {
+	store := openTestStore(t)
+	expiresAt := time.Now().Add(time.Hour)
+
+	err := store.SaveSubscriber(&Subscriber{
+		EmailAddress: "someone@example.com",
+		Status: SubscriberSuppressed,
+	})
+
+	if err != nil {
+		t.Fatalf("error saving subscriber: %s", err)
+	}
+
+	_, err = store.SaveSubscriberWithNonce(&Subscriber{
+		EmailAddress: "Someone@Example.com",
+		Status: SubscriberActive,
+	}, "nonce", expiresAt)
+
+	if _, ok := err.(SuppressedError); !ok {
+		t.Fatalf("expected a suppressed error, got %v", err)
+	}
+
+	subscriber, err := store.GetSubscriber("someone@example.com")
+	if err != nil {
+		t.Fatalf("error getting subscriber: %s", err)
+	}
+
+	if subscriber.Status != SubscriberSuppressed {
+		t.Errorf("expected the subscriber to stay suppressed, got %s", subscriber.Status)
+	}
+
+	// The nonce isn't used up, although it can't be used to resubscribe the address while it is suppressed
+	firstUse, err := store.SaveSubscriberWithNonce(&Subscriber{
+		EmailAddress: "other@example.com",
+		Status: SubscriberActive,
+	}, "nonce", expiresAt)
+
+	if err != nil || !firstUse {
+		t.Errorf("expected the nonce not to be used by a refused subscriber, got %t, %v", firstUse, err)
+	}
+}
@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	sentPostsBucket  = []byte("sent_posts")
+	deliveriesBucket = []byte("deliveries")
+	metaBucket       = []byte("meta")
+
+	ledgerStartedAtKey = []byte("ledger_started_at")
+)
+
+/// SentPostStatus is the state of the notification for a blog post.
+type SentPostStatus string
+
+const (
+	/// SentPostSkipped is a post that was already published before the ledger was started, so is never sent.
+	SentPostSkipped SentPostStatus = "skipped"
+	/// SentPostHeld is a post whose notification is held until an administrator approves it.
+	SentPostHeld SentPostStatus = "held"
+	/// SentPostRejected is a post whose notification was rejected by an administrator, so is never sent.
+	SentPostRejected SentPostStatus = "rejected"
+	/// SentPostSending is a post whose notification has started being sent.
+	SentPostSending SentPostStatus = "sending"
+	/// SentPostSent is a post whose notification was delivered to every subscriber, other than those it failed
+	/// permanently for or was given up on for after too many attempts.
+	SentPostSent SentPostStatus = "sent"
+	/// SentPostFailed is a post whose notification failed for at least one subscriber, to be retried for them.
+	SentPostFailed SentPostStatus = "failed"
+)
+
+/// SentPost is the ledger entry for a single blog post from the feed.
+type SentPost struct {
+	/// Key identifies the post, being its GUID from the feed or its link if it has none.
+	Key string `json:"key"`
+	/// Title is the title of the post.
+	Title string `json:"title"`
+	/// Url is the link to the post.
+	Url string `json:"url"`
+	/// Summary is the summary of the post from the feed, kept to list the post in digests.
+	Summary string `json:"summary,omitempty"`
+	/// Author is the name of the author of the post.
+	Author string `json:"author,omitempty"`
+	/// PublishedAt is the publish date of the post according to the feed.
+	PublishedAt time.Time `json:"published_at"`
+	/// Status is the state of the notification for the post.
+	Status SentPostStatus `json:"status"`
+	/// FirstSeenAt is the time the post was first found in the feed.
+	FirstSeenAt time.Time `json:"first_seen_at"`
+	/// FirstSentAt is the time the notification for the post was first sent, which isn't changed when failed deliveries
+	/// are retried.
+	FirstSentAt time.Time `json:"first_sent_at,omitempty"`
+	/// SentAt is the time the notification for the post was last sent.
+	SentAt time.Time `json:"sent_at,omitempty"`
+	/// Delivered is the number of subscribers the notification was delivered to.
+	Delivered int `json:"delivered"`
+	/// Failed is the number of subscribers the notification could not be delivered to.
+	Failed int `json:"failed"`
+}
+
+/// MaxDeliveryAttempts is how many times sending an email to a subscriber is attempted before giving up on them.
+const MaxDeliveryAttempts = 5
+
+/// Delivery records the result of sending the notification for a post to a single subscriber.
+type Delivery struct {
+	/// EmailAddress is the address of the subscriber.
+	EmailAddress string `json:"email_address"`
+	/// MessageId is the message ID the mail provider assigned to the email, if it was accepted.
+	MessageId string `json:"message_id,omitempty"`
+	/// Provider is the name of the mail backend that accepted the email, if it was accepted.
+	Provider string `json:"provider,omitempty"`
+	/// Error is the reason sending failed, if it did.
+	Error string `json:"error,omitempty"`
+	/// Permanent is whether sending failed in a way that retrying won't fix, such as the address being rejected.
+	Permanent bool `json:"permanent,omitempty"`
+	/// Attempts is the number of times sending the email was attempted.
+	Attempts int `json:"attempts,omitempty"`
+	/// AttemptedAt is the time the email was last sent.
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+/// Succeeded checks whether the email was accepted by the mail provider.
+func (d *Delivery) Succeeded() bool {
+	return len(d.Error) == 0
+}
+
+/// Settled checks whether no more attempts will be made to send the email, because it was accepted, failed
+/// permanently or was attempted too many times.
+func (d *Delivery) Settled() bool {
+	return d.Succeeded() || d.Permanent || d.Attempts >= MaxDeliveryAttempts
+}
+
+/// GetLedgerStartedAt gets the time the ledger was started, or nil if it hasn't been started yet.
+func (s *Store) GetLedgerStartedAt() (*time.Time, error) {
+	var startedAt *time.Time
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(metaBucket).Get(ledgerStartedAtKey)
+
+		if value == nil {
+			return nil
+		}
+
+		parsed, err := time.Parse(time.RFC3339, string(value))
+		if err != nil {
+			return err
+		}
+
+		startedAt = &parsed
+
+		return nil
+	})
+
+	return startedAt, err
+}
+
+/// StartLedger records the ledger as started at the given time, marking the given posts as skipped.
+func (s *Store) StartLedger(startedAt time.Time, skippedPosts []*SentPost) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sentPostsBucket)
+		now := time.Now().UTC()
+
+		for _, post := range skippedPosts {
+			post.Status = SentPostSkipped
+			post.FirstSeenAt = now
+
+			value, err := json.Marshal(post)
+			if err != nil {
+				return err
+			}
+
+			if err = bucket.Put([]byte(post.Key), value); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(metaBucket).Put(ledgerStartedAtKey, []byte(startedAt.UTC().Format(time.RFC3339)))
+	})
+}
+
+/// GetSentPost finds the ledger entry for the post with the given key, returning a NotFoundError if there is none.
+func (s *Store) GetSentPost(key string) (*SentPost, error) {
+	var post *SentPost
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(sentPostsBucket).Get([]byte(key))
+
+		if value == nil {
+			return NotFoundError{
+				Key: key,
+			}
+		}
+
+		post = &SentPost{}
+
+		return json.Unmarshal(value, post)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return post, nil
+}
+
+/// SaveSentPost creates or replaces the ledger entry for a post.
+func (s *Store) SaveSentPost(post *SentPost) error {
+	value, err := json.Marshal(post)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sentPostsBucket).Put([]byte(post.Key), value)
+	})
+}
+
+/// ListSentPosts lists every ledger entry, most recently published first.
+func (s *Store) ListSentPosts() ([]SentPost, error) {
+	var posts []SentPost
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sentPostsBucket).ForEach(func(k, v []byte) error {
+			var post SentPost
+
+			if err := json.Unmarshal(v, &post); err != nil {
+				return err
+			}
+
+			posts = append(posts, post)
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(posts, func(i, j int) bool {
+		return posts[i].PublishedAt.After(posts[j].PublishedAt)
+	})
+
+	return posts, nil
+}
+
+/// RecordDelivery records the result of sending the notification for the post with the given key to a subscriber,
+/// replacing the result of any earlier attempt.
+func (s *Store) RecordDelivery(postKey string, delivery *Delivery) error {
+	value, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(deliveriesBucket).CreateBucketIfNotExists([]byte(postKey))
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(subscriberKey(delivery.EmailAddress), value)
+	})
+}
+
+/// GetDelivery finds the result of sending the notification for the post with the given key to a subscriber,
+/// returning nil if it was never sent to them.
+func (s *Store) GetDelivery(postKey, emailAddress string) (*Delivery, error) {
+	var delivery *Delivery
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(deliveriesBucket).Bucket([]byte(postKey))
+
+		if bucket == nil {
+			return nil
+		}
+
+		value := bucket.Get(subscriberKey(emailAddress))
+
+		if value == nil {
+			return nil
+		}
+
+		delivery = &Delivery{}
+
+		return json.Unmarshal(value, delivery)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return delivery, nil
+}
+
+/// ListDeliveries lists the result of sending the notification for the post with the given key to each subscriber.
+func (s *Store) ListDeliveries(postKey string) ([]Delivery, error) {
+	var deliveries []Delivery
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(deliveriesBucket).Bucket([]byte(postKey))
+
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var delivery Delivery
+
+			if err := json.Unmarshal(v, &delivery); err != nil {
+				return err
+			}
+
+			deliveries = append(deliveries, delivery)
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStartLedger(t *testing.T) {
+	store := openTestStore(t)
+
+	startedAt, err := store.GetLedgerStartedAt()
+	if err != nil {
+		t.Fatalf("error getting ledger start: %s", err)
+	}
+
+	if startedAt != nil {
+		t.Fatalf("expected ledger not to be started, but it was started at %s", startedAt)
+	}
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	err = store.StartLedger(now, []*SentPost{
+		{Key: "old", Title: "Old post", Status: SentPostSent},
+	})
+
+	if err != nil {
+		t.Fatalf("error starting ledger: %s", err)
+	}
+
+	startedAt, err = store.GetLedgerStartedAt()
+	if err != nil {
+		t.Fatalf("error getting ledger start: %s", err)
+	}
+
+	if startedAt == nil || !startedAt.Equal(now) {
+		t.Errorf("expected ledger to be started at %s, got %v", now, startedAt)
+	}
+
+	post, err := store.GetSentPost("old")
+	if err != nil {
+		t.Fatalf("error getting skipped post: %s", err)
+	}
+
+	if post.Status != SentPostSkipped {
+		t.Errorf("expected post published before the ledger to be %s, got %s", SentPostSkipped, post.Status)
+	}
+
+	if post.FirstSeenAt.IsZero() {
+		t.Error("expected skipped post to have a first seen time")
+	}
+}
+
+func TestGetSentPostNotFound(t *testing.T) {
+	store := openTestStore(t)
+
+	_, err := store.GetSentPost("missing")
+
+	if _, ok := err.(NotFoundError); !ok {
+		t.Errorf("expected NotFoundError, got %v", err)
+	}
+}
+
+func TestListSentPostsMostRecentFirst(t *testing.T) {
+	store := openTestStore(t)
+	published := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for i, key := range []string{"b", "c", "a"} {
+		err := store.SaveSentPost(&SentPost{
+			Key: key,
+			PublishedAt: published.Add(time.Hour * time.Duration(i)),
+			Status: SentPostSending,
+		})
+
+		if err != nil {
+			t.Fatalf("error saving post %s: %s", key, err)
+		}
+	}
+
+	posts, err := store.ListSentPosts()
+	if err != nil {
+		t.Fatalf("error listing posts: %s", err)
+	}
+
+	var keys []string
+
+	for _, post := range posts {
+		keys = append(keys, post.Key)
+	}
+
+	if len(keys) != 3 || keys[0] != "a" || keys[1] != "c" || keys[2] != "b" {
+		t.Errorf("expected posts [a c b], got %v", keys)
+	}
+}
+
+func TestRecordDeliveryReplacesEarlierAttempt(t *testing.T) {
+	store := openTestStore(t)
+
+	err := store.RecordDelivery("post", &Delivery{
+		EmailAddress: "Someone@Example.com",
+		Error: "connection refused",
+	})
+
+	if err != nil {
+		t.Fatalf("error recording failed delivery: %s", err)
+	}
+
+	err = store.RecordDelivery("post", &Delivery{
+		EmailAddress: "someone@example.com",
+		MessageId: "<1@example.com>",
+		Provider: "smtp",
+	})
+
+	if err != nil {
+		t.Fatalf("error recording retried delivery: %s", err)
+	}
+
+	deliveries, err := store.ListDeliveries("post")
+	if err != nil {
+		t.Fatalf("error listing deliveries: %s", err)
+	}
+
+	if len(deliveries) != 1 {
+		t.Fatalf("expected the retry to replace the failed delivery, got %d deliveries", len(deliveries))
+	}
+
+	delivery, err := store.GetDelivery("post", "SOMEONE@example.com")
+	if err != nil {
+		t.Fatalf("error getting delivery: %s", err)
+	}
+
+	if delivery == nil || !delivery.Succeeded() || delivery.MessageId != "<1@example.com>" {
+		t.Errorf("expected the successful retry to be recorded, got %+v", delivery)
+	}
+
+	delivery, err = store.GetDelivery("other", "someone@example.com")
+	if err != nil {
+		t.Fatalf("error getting delivery: %s", err)
+	}
+
+	if delivery != nil {
+		t.Errorf("expected no delivery for a post that wasn't sent, got %+v", delivery)
+	}
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var subscribersBucket = []byte("subscribers")
+
+/// SubscriberStatus is the state of a subscription.
+type SubscriberStatus string
+
+const (
+	/// SubscriberActive is a confirmed subscriber that receives notifications.
+	SubscriberActive SubscriberStatus = "active"
+	/// SubscriberUnsubscribed is a subscriber that has asked to stop receiving notifications.
+	SubscriberUnsubscribed SubscriberStatus = "unsubscribed"
+	/// SubscriberSuppressed is a subscriber whose address bounced or who complained of spam, so must not be emailed.
+	SubscriberSuppressed SubscriberStatus = "suppressed"
+)
+
+/// SubscriberFrequency is how often a subscriber is emailed about new posts.
+type SubscriberFrequency string
+
+const (
+	/// FrequencyEveryPost is a subscriber notified of every post as soon as it is published.
+	FrequencyEveryPost SubscriberFrequency = "every_post"
+	/// FrequencyWeeklyDigest is a subscriber sent a single digest of the posts published each week.
+	FrequencyWeeklyDigest SubscriberFrequency = "weekly_digest"
+)
+
+/// Subscriber is a single confirmed subscriber to the mailing list.
+type Subscriber struct {
+	/// EmailAddress is the address notifications are sent to.
+	EmailAddress string `json:"email_address"`
+	/// Name is the name the subscriber signed up with.
+	Name string `json:"name"`
+	/// ConfirmedAt is the time the subscriber confirmed their email address.
+	ConfirmedAt time.Time `json:"confirmed_at"`
+	/// SourceIp is the IP address the subscription was confirmed from.
+	SourceIp string `json:"source_ip"`
+	/// Status is the current state of the subscription.
+	Status SubscriberStatus `json:"status"`
+	/// Frequency is how often the subscriber is emailed. Subscribers from before digests existed have none, and are
+	/// notified of every post.
+	Frequency SubscriberFrequency `json:"frequency,omitempty"`
+	/// SoftBounces is the number of notifications in a row that were temporarily rejected by the subscriber's server.
+	SoftBounces int `json:"soft_bounces,omitempty"`
+	/// SoftBouncedMessageIds are the message IDs of the most recent of those notifications, so that a notification
+	/// rejected again each time it is retried is only counted once.
+	SoftBouncedMessageIds []string `json:"soft_bounced_message_ids,omitempty"`
+	/// SuppressionReason is why the subscriber was suppressed, if they were.
+	SuppressionReason string `json:"suppression_reason,omitempty"`
+	/// UpdatedAt is the time the subscriber was last changed.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+/// WantsDigest checks whether the subscriber is sent weekly digests rather than a notification of every post.
+func (subscriber *Subscriber) WantsDigest() bool {
+	return subscriber.Frequency == FrequencyWeeklyDigest
+}
+
+/// subscriberKey builds the key for a subscriber, so that addresses differing only by case are the same subscriber.
+func subscriberKey(emailAddress string) []byte {
+	return []byte(strings.ToLower(strings.TrimSpace(emailAddress)))
+}
+
+/// SaveSubscriber creates or replaces the subscriber with the same email address.
+func (s *Store) SaveSubscriber(subscriber *Subscriber) error {
+	subscriber.UpdatedAt = time.Now().UTC()
+
+	value, err := json.Marshal(subscriber)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(subscribersBucket).Put(subscriberKey(subscriber.EmailAddress), value)
+	})
+}
+
+/// SaveSubscriberUnlessSuppressed creates or replaces the subscriber with the same email address, returning a
+/// SuppressedError and saving nothing if the existing subscriber was suppressed.
+func (s *Store) SaveSubscriberUnlessSuppressed(subscriber *Subscriber) error {
+	subscriber.UpdatedAt = time.Now().UTC()
+
+	value, err := json.Marshal(subscriber)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(subscribersBucket)
+
+		if err := checkNotSuppressed(bucket, subscriber.EmailAddress); err != nil {
+			return err
+		}
+
+		return bucket.Put(subscriberKey(subscriber.EmailAddress), value)
+	})
+}
+
+/// checkNotSuppressed returns a SuppressedError if the subscriber with the given email address was suppressed.
+func checkNotSuppressed(bucket *bolt.Bucket, emailAddress string) error {
+	value := bucket.Get(subscriberKey(emailAddress))
+
+	if value == nil {
+		return nil
+	}
+
+	var existing Subscriber
+
+	if err := json.Unmarshal(value, &existing); err != nil {
+		return err
+	}
+
+	if existing.Status == SubscriberSuppressed {
+		return SuppressedError{
+			EmailAddress: emailAddress,
+		}
+	}
+
+	return nil
+}
+
+/// GetSubscriber finds the subscriber with the given email address, returning a NotFoundError if there is none.
+func (s *Store) GetSubscriber(emailAddress string) (*Subscriber, error) {
+	var subscriber *Subscriber
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(subscribersBucket).Get(subscriberKey(emailAddress))
+
+		if value == nil {
+			return NotFoundError{
+				Key: emailAddress,
+			}
+		}
+
+		subscriber = &Subscriber{}
+
+		return json.Unmarshal(value, subscriber)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return subscriber, nil
+}
+
+/// SetSubscriberStatus changes the status of the subscriber with the given email address, returning a NotFoundError if
+/// there is none.
+func (s *Store) SetSubscriberStatus(emailAddress string, status SubscriberStatus) error {
+	return s.UpdateSubscriber(emailAddress, func(subscriber *Subscriber) error {
+		subscriber.Status = status
+
+		return nil
+	})
+}
+
+/// UpdateSubscriber changes the subscriber with the given email address in a single transaction, returning a
+/// NotFoundError if there is none. Nothing is changed if the update function returns an error.
+func (s *Store) UpdateSubscriber(emailAddress string, update func(subscriber *Subscriber) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(subscribersBucket)
+		key := subscriberKey(emailAddress)
+
+		value := bucket.Get(key)
+
+		if value == nil {
+			return NotFoundError{
+				Key: emailAddress,
+			}
+		}
+
+		var subscriber Subscriber
+
+		if err := json.Unmarshal(value, &subscriber); err != nil {
+			return err
+		}
+
+		if err := update(&subscriber); err != nil {
+			return err
+		}
+
+		subscriber.UpdatedAt = time.Now().UTC()
+
+		value, err := json.Marshal(&subscriber)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(key, value)
+	})
+}
+
+/// ListSubscribers lists all subscribers with the given status, or every subscriber if the status is empty.
+func (s *Store) ListSubscribers(status SubscriberStatus) ([]Subscriber, error) {
+	var subscribers []Subscriber
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(subscribersBucket).ForEach(func(k, v []byte) error {
+			var subscriber Subscriber
+
+			if err := json.Unmarshal(v, &subscriber); err != nil {
+				return err
+			}
+
+			if len(status) == 0 || subscriber.Status == status {
+				subscribers = append(subscribers, subscriber)
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return subscribers, nil
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var webHookDeliveriesBucket = []byte("webhook_deliveries")
+
+/// WebHookDeliveryOutcome is what was done with a webhook delivery.
+type WebHookDeliveryOutcome string
+
+const (
+	/// WebHookDeliveryQueued is a delivery that queued a feed check.
+	WebHookDeliveryQueued WebHookDeliveryOutcome = "queued"
+	/// WebHookDeliveryIgnored is a delivery of an event that didn't match any trigger rule.
+	WebHookDeliveryIgnored WebHookDeliveryOutcome = "ignored"
+	/// WebHookDeliveryUnsupported is a delivery of a type of event that isn't supported.
+	WebHookDeliveryUnsupported WebHookDeliveryOutcome = "unsupported"
+	/// WebHookDeliveryProcessed is a delivery of a mail provider event that was applied to a subscriber.
+	WebHookDeliveryProcessed WebHookDeliveryOutcome = "processed"
+)
+
+/// WebHookDelivery records a webhook request that was received, so that redeliveries of it can be recognised.
+type WebHookDelivery struct {
+	/// Receiver is the name of the route that received the delivery.
+	Receiver string `json:"receiver"`
+	/// Id is the unique ID the sender gave the delivery, such as GitHub's X-GitHub-Delivery header.
+	Id string `json:"id"`
+	/// Event describes the event that was delivered.
+	Event string `json:"event,omitempty"`
+	/// Outcome is what was done with the delivery.
+	Outcome WebHookDeliveryOutcome `json:"outcome,omitempty"`
+	/// JobId is the ID of the job queued by the delivery, if one was.
+	JobId uint64 `json:"job_id,omitempty"`
+	/// ReceivedAt is the time the delivery was first received.
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+/// webHookDeliveryKey gets the key of a delivery, as IDs are only unique for a single sender.
+func webHookDeliveryKey(delivery *WebHookDelivery) []byte {
+	return []byte(delivery.Receiver + "/" + delivery.Id)
+}
+
+/// RecordWebHookDelivery records a delivery the first time it is received, returning false if it had already been
+/// received.
+///
+/// Deliveries are remembered for the given retention period, after which they are pruned.
+func (s *Store) RecordWebHookDelivery(delivery *WebHookDelivery, retention time.Duration) (bool, error) {
+	recorded := false
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(webHookDeliveriesBucket)
+
+		if err := pruneWebHookDeliveries(bucket, time.Now().Add(-retention)); err != nil {
+			return err
+		}
+
+		key := webHookDeliveryKey(delivery)
+
+		if bucket.Get(key) != nil {
+			return nil
+		}
+
+		value, err := json.Marshal(delivery)
+		if err != nil {
+			return err
+		}
+
+		recorded = true
+
+		return bucket.Put(key, value)
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return recorded, nil
+}
+
+/// SaveWebHookDelivery updates a recorded delivery.
+func (s *Store) SaveWebHookDelivery(delivery *WebHookDelivery) error {
+	value, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(webHookDeliveriesBucket).Put(webHookDeliveryKey(delivery), value)
+	})
+}
+
+/// DeleteWebHookDelivery forgets a recorded delivery, so that a redelivery of it is processed.
+func (s *Store) DeleteWebHookDelivery(delivery *WebHookDelivery) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(webHookDeliveriesBucket).Delete(webHookDeliveryKey(delivery))
+	})
+}
+
+/// ListWebHookDeliveries lists every recorded delivery, most recent first.
+func (s *Store) ListWebHookDeliveries() ([]WebHookDelivery, error) {
+	var deliveries []WebHookDelivery
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(webHookDeliveriesBucket).ForEach(func(k, v []byte) error {
+			var delivery WebHookDelivery
+
+			if err := json.Unmarshal(v, &delivery); err != nil {
+				return err
+			}
+
+			deliveries = append(deliveries, delivery)
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].ReceivedAt.After(deliveries[j].ReceivedAt)
+	})
+
+	return deliveries, nil
+}
+
+/// pruneWebHookDeliveries deletes every delivery received before the given time.
+func pruneWebHookDeliveries(bucket *bolt.Bucket, before time.Time) error {
+	var expired [][]byte
+
+	err := bucket.ForEach(func(k, v []byte) error {
+		var delivery WebHookDelivery
+
+		if err := json.Unmarshal(v, &delivery); err != nil || delivery.ReceivedAt.Before(before) {
+			expired = append(expired, k)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, k := range expired {
+		if err = bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -1,49 +1,60 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"net/http"
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/base64"
-	"crypto/subtle"
-	"log"
+	"log/slog"
 	"encoding/gob"
+	"net"
+	"time"
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/sessions"
 
+	"github.com/mybb/mybb-blog-mailer/logging"
 	"github.com/mybb/mybb-blog-mailer/mail"
+	"github.com/mybb/mybb-blog-mailer/metrics"
+	"github.com/mybb/mybb-blog-mailer/storage"
 )
 
 type SubscriptionService struct {
 	mailHandler  mail.Handler
+	store        *storage.Store
 	templates    *template.Template
 	sessionStore sessions.Store
 	hmacSecret   string
+	confirmationTokenTtl time.Duration
+	logger       *slog.Logger
 }
 
 type FlashMessages map[string]string
 
-func NewSubscriptionService(mailHandler mail.Handler, templates *template.Template, hmacSecret string,
-	sessionKey []byte) (*SubscriptionService) {
+func NewSubscriptionService(mailHandler mail.Handler, store *storage.Store, templates *template.Template,
+	hmacSecret string, confirmationTokenTtl time.Duration, sessionKey []byte,
+	logger *slog.Logger) (*SubscriptionService) {
 	gob.Register(&FlashMessages{})
 
 	return &SubscriptionService{
 		mailHandler: mailHandler,
+		store: store,
 		templates:   templates,
 		sessionStore: sessions.NewCookieStore(sessionKey),
 		hmacSecret: hmacSecret,
+		confirmationTokenTtl: confirmationTokenTtl,
+		logger: logger,
 	}
 }
 
 /// Index handles a request to /, showing the sign-up form.
 func (subService *SubscriptionService) Index(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), subService.logger)
+
 	session, err := subService.sessionStore.Get(r, "blog-mailer-session")
 	if err != nil {
-		log.Printf("[ERROR] getting session for request: %s\n", err)
+		logger.Error("error getting session for request", logging.Error(err))
 
 		http.Error(w, fmt.Sprintf("Error getting session for request: %s", err),
 			http.StatusInternalServerError)
@@ -57,10 +68,9 @@ func (subService *SubscriptionService) Index(w http.ResponseWriter, r *http.Requ
 	if len(flashes) > 0 {
 		if decodedErrors, ok := flashes[0].(*FlashMessages); !ok {
 			// Handle the case that it's not an expected type
-			log.Printf("[ERROR] decoding flash values for request: %s\n", err)
+			logger.Error("error decoding flash values for request", "type", fmt.Sprintf("%T", flashes[0]))
 
-			http.Error(w, fmt.Sprintf("Error decoding flash values for request: %s", err),
-				http.StatusInternalServerError)
+			http.Error(w, "Error decoding flash values for request", http.StatusInternalServerError)
 
 			return
 		} else {
@@ -76,9 +86,11 @@ func (subService *SubscriptionService) Index(w http.ResponseWriter, r *http.Requ
 
 /// SignUp handles a POST request to /signup, validating the request and subscribing the user to the mailing list.
 func (subService *SubscriptionService) SignUp(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), subService.logger)
+
 	session, err := subService.sessionStore.Get(r, "blog-mailer-session")
 	if err != nil {
-		log.Printf("[ERROR] getting session for request: %s\n", err)
+		logger.Error("error getting session for request", logging.Error(err))
 
 		http.Error(w, fmt.Sprintf("Error getting session for request: %s", err),
 			http.StatusInternalServerError)
@@ -89,7 +101,7 @@ func (subService *SubscriptionService) SignUp(w http.ResponseWriter, r *http.Req
 	err = r.ParseForm()
 
 	if err != nil {
-		log.Printf("[ERROR] parsing form data for subscribe request: %s\n", err)
+		logger.Error("error parsing form data for subscribe request", logging.Error(err))
 
 		http.Error(w, fmt.Sprintf("Error parsing form data for subscribe request: %s", err),
 			http.StatusInternalServerError)
@@ -99,12 +111,14 @@ func (subService *SubscriptionService) SignUp(w http.ResponseWriter, r *http.Req
 	name, ok := r.PostForm["name"]
 
 	if !ok || len(name) == 0 || len(name[0]) == 0 {
+		countInvalidSignUp("name")
+
 		session.AddFlash(FlashMessages{
 			"error": "Name is required",
 		})
 
 		if err = session.Save(r, w); err != nil {
-			log.Printf("[ERROR] saving session data: %s\n", err)
+			logger.Error("error saving session data", logging.Error(err))
 
 			http.Error(w, fmt.Sprintf("Error saving session data: %s", err),
 				http.StatusInternalServerError)
@@ -118,12 +132,39 @@ func (subService *SubscriptionService) SignUp(w http.ResponseWriter, r *http.Req
 	emailAddress, ok := r.PostForm["email"]
 
 	if !ok || len(emailAddress) == 0 || len(emailAddress[0]) == 0 {
+		countInvalidSignUp("email")
+
 		session.AddFlash(FlashMessages{
 			"error": "Email address is required",
 		})
 
 		if err = session.Save(r, w); err != nil {
-			log.Printf("[ERROR] saving session data: %s\n", err)
+			logger.Error("error saving session data", logging.Error(err))
+
+			http.Error(w, fmt.Sprintf("Error saving session data: %s", err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, "/", 301)
+		return
+	}
+
+	frequency := storage.SubscriberFrequency(r.PostForm.Get("frequency"))
+
+	if len(frequency) == 0 {
+		frequency = storage.FrequencyEveryPost
+	}
+
+	if frequency != storage.FrequencyEveryPost && frequency != storage.FrequencyWeeklyDigest {
+		countInvalidSignUp("frequency")
+
+		session.AddFlash(FlashMessages{
+			"error": "Please choose whether to receive every post or a weekly digest",
+		})
+
+		if err = session.Save(r, w); err != nil {
+			logger.Error("error saving session data", logging.Error(err))
 
 			http.Error(w, fmt.Sprintf("Error saving session data: %s", err),
 				http.StatusInternalServerError)
@@ -137,6 +178,8 @@ func (subService *SubscriptionService) SignUp(w http.ResponseWriter, r *http.Req
 	isValidEmail, err := subService.mailHandler.CheckValidEmail(emailAddress[0])
 
 	if err != nil || !isValidEmail {
+		countInvalidSignUp("email")
+
 		var errorMessage string
 		if err != nil {
 			errorMessage = fmt.Sprintf("Invalid email address: %s", err)
@@ -149,7 +192,7 @@ func (subService *SubscriptionService) SignUp(w http.ResponseWriter, r *http.Req
 		})
 
 		if err = session.Save(r, w); err != nil {
-			log.Printf("[ERROR] saving session data: %s\n", err)
+			logger.Error("error saving session data", logging.Error(err))
 
 			http.Error(w, fmt.Sprintf("Error saving session data: %s", err),
 				http.StatusInternalServerError)
@@ -160,17 +203,36 @@ func (subService *SubscriptionService) SignUp(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	err = subService.sendEmailSubscriptionConfirmation(emailAddress[0], name[0])
+	// A suppressed address mustn't be emailed again, but the page is the same so as not to reveal that it was suppressed
+	if subscriber, err := subService.store.GetSubscriber(emailAddress[0]); err == nil &&
+		subscriber.Status == storage.SubscriberSuppressed {
+		logger.Warn("not sending subscription confirmation email to suppressed subscriber",
+			logging.Email(emailAddress[0]))
+
+		metrics.SignUps.WithLabelValues("suppressed").Inc()
+
+		subService.templates.ExecuteTemplate(w, "signup.html", map[string]interface{}{
+			"name": name[0],
+			"emailAddress": emailAddress[0],
+		})
+
+		return
+	}
+
+	err = subService.sendEmailSubscriptionConfirmation(emailAddress[0], name[0], frequency)
 
 	if err != nil {
-		log.Printf("[ERROR] sending subscription confirmation email to '%s': %s\n", emailAddress, err)
+		logger.Error("error sending subscription confirmation email", logging.Email(emailAddress[0]),
+			logging.Error(err))
+
+		metrics.SignUps.WithLabelValues("error").Inc()
 
 		session.AddFlash(FlashMessages{
 			"error": "Failed to send subscription confirmation email",
 		})
 
 		if err = session.Save(r, w); err != nil {
-			log.Printf("[ERROR] saving session data: %s\n", err)
+			logger.Error("error saving session data", logging.Error(err))
 
 			http.Error(w, fmt.Sprintf("Error saving session data: %s", err),
 				http.StatusInternalServerError)
@@ -181,18 +243,46 @@ func (subService *SubscriptionService) SignUp(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	metrics.SignUps.WithLabelValues("confirmation_sent").Inc()
+
 	subService.templates.ExecuteTemplate(w, "signup.html", map[string]interface{}{
 		"name": name[0],
 		"emailAddress": emailAddress[0],
 	})
 }
 
-func (subService *SubscriptionService) sendEmailSubscriptionConfirmation(emailAddress, name string) error {
+/// countInvalidSignUp counts a sign-up request rejected because the given field failed validation.
+func countInvalidSignUp(field string) {
+	metrics.ValidationFailures.WithLabelValues(field).Inc()
+	metrics.SignUps.WithLabelValues("invalid").Inc()
+}
+
+func (subService *SubscriptionService) sendEmailSubscriptionConfirmation(emailAddress, name string,
+	frequency storage.SubscriberFrequency) error {
+	token, err := subService.generateEmailConfirmationToken(emailAddress, name, frequency)
+
+	if err != nil {
+		return err
+	}
+
+	textContent, htmlContent, err := subService.renderConfirmationEmail(emailAddress, name, token)
+
+	if err != nil {
+		return err
+	}
+
+	err = subService.mailHandler.SendSubscriptionConfirmationEmail(emailAddress, textContent, htmlContent)
+
+	return err
+}
+
+/// renderConfirmationEmail renders the plain text and HTML content of the email asking a new subscriber to confirm
+/// their subscription with the given token.
+func (subService *SubscriptionService) renderConfirmationEmail(emailAddress, name,
+	token string) (string, string, error) {
 	var plainTextContentBuffer bytes.Buffer
 	var htmlContentBuffer bytes.Buffer
 
-	token := subService.generateEmailConfirmationToken(emailAddress, name)
-
 	err := subService.templates.ExecuteTemplate(&plainTextContentBuffer, "emails/confirm_subscription.txt", map[string]string{
 		"emailAddress": emailAddress,
 		"name": name,
@@ -200,7 +290,9 @@ func (subService *SubscriptionService) sendEmailSubscriptionConfirmation(emailAd
 	})
 
 	if err != nil {
-		return err
+		metrics.TemplateRenderErrors.WithLabelValues("emails/confirm_subscription.txt").Inc()
+
+		return "", "", err
 	}
 
 	err = subService.templates.ExecuteTemplate(&htmlContentBuffer, "emails/confirm_subscription.html", map[string]string{
@@ -210,29 +302,20 @@ func (subService *SubscriptionService) sendEmailSubscriptionConfirmation(emailAd
 	})
 
 	if err != nil {
-		return err
-	}
-
-	err = subService.mailHandler.SendSubscriptionConfirmationEmail(emailAddress,
-		plainTextContentBuffer.String(), htmlContentBuffer.String())
-
-	return err
-}
-
-func (subService *SubscriptionService) generateEmailConfirmationToken(emailAddress, name string) string {
-	message := emailAddress + "_" + name
+		metrics.TemplateRenderErrors.WithLabelValues("emails/confirm_subscription.html").Inc()
 
-	key := []byte(subService.hmacSecret)
-	h := hmac.New(sha256.New, key)
-	h.Write([]byte(message))
+		return "", "", err
+	}
 
-	return base64.URLEncoding.EncodeToString(h.Sum(nil))
+	return plainTextContentBuffer.String(), htmlContentBuffer.String(), nil
 }
 
 func (subService *SubscriptionService) ConfirmSignUp(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), subService.logger)
+
 	session, err := subService.sessionStore.Get(r, "blog-mailer-session")
 	if err != nil {
-		log.Printf("[ERROR] getting session for request: %s\n", err)
+		logger.Error("error getting session for request", logging.Error(err))
 
 		http.Error(w, fmt.Sprintf("Error getting session for request: %s", err),
 			http.StatusInternalServerError)
@@ -240,17 +323,17 @@ func (subService *SubscriptionService) ConfirmSignUp(w http.ResponseWriter, r *h
 		return
 	}
 
-	query := r.URL.Query()
+	token := r.URL.Query().Get("token")
 
-	emailAddress, ok := query["emailAddress"]
+	if len(token) == 0 {
+		metrics.Confirmations.WithLabelValues("invalid").Inc()
 
-	if !ok || len(emailAddress) == 0 || len(emailAddress[0]) == 0 {
 		session.AddFlash(FlashMessages{
-			"error": "Email address missing",
+			"error": "Token missing",
 		})
 
 		if err = session.Save(r, w); err != nil {
-			log.Printf("[ERROR] saving session data: %s\n", err)
+			logger.Error("error saving session data", logging.Error(err))
 
 			http.Error(w, fmt.Sprintf("Error saving session data: %s", err),
 				http.StatusInternalServerError)
@@ -261,34 +344,32 @@ func (subService *SubscriptionService) ConfirmSignUp(w http.ResponseWriter, r *h
 		return
 	}
 
-	name, ok := query["name"]
+	confirmation, err := subService.parseEmailConfirmationToken(token)
 
-	if !ok || len(name) == 0 || len(name[0]) == 0 {
-		session.AddFlash(FlashMessages{
-			"error": "Name missing",
-		})
+	if expiredErr, ok := err.(TokenExpiredError); ok {
+		metrics.Confirmations.WithLabelValues("expired").Inc()
 
-		if err = session.Save(r, w); err != nil {
-			log.Printf("[ERROR] saving session data: %s\n", err)
-
-			http.Error(w, fmt.Sprintf("Error saving session data: %s", err),
-				http.StatusInternalServerError)
-			return
-		}
+		subService.templates.ExecuteTemplate(w, "confirm_expired.html", map[string]interface{}{
+			csrf.TemplateTag: csrf.TemplateField(r),
+			"name": expiredErr.Token.Name,
+			"emailAddress": expiredErr.Token.EmailAddress,
+			"frequency": expiredErr.Token.frequency(),
+		})
 
-		http.Redirect(w, r, "/", 301)
 		return
 	}
 
-	token, ok := query["token"]
+	if err != nil {
+		logger.Warn("invalid subscription confirmation token", logging.Error(err))
+
+		metrics.Confirmations.WithLabelValues("invalid").Inc()
 
-	if !ok || len(token) == 0 || len(token[0]) == 0 {
 		session.AddFlash(FlashMessages{
-			"error": "Token missing",
+			"error": "The confirmation link is invalid, please try signing up again",
 		})
 
 		if err = session.Save(r, w); err != nil {
-			log.Printf("[ERROR] saving session data: %s\n", err)
+			logger.Error("error saving session data", logging.Error(err))
 
 			http.Error(w, fmt.Sprintf("Error saving session data: %s", err),
 				http.StatusInternalServerError)
@@ -299,19 +380,37 @@ func (subService *SubscriptionService) ConfirmSignUp(w http.ResponseWriter, r *h
 		return
 	}
 
-	expectedToken := subService.generateEmailConfirmationToken(emailAddress[0], name[0])
+	emailAddress := confirmation.EmailAddress
+	name := confirmation.Name
+
+	// The token is only spent along with saving the subscriber, so that a failure to save leaves the link usable
+	firstUse, err := subService.store.SaveSubscriberWithNonce(
+		newSubscriber(emailAddress, name, remoteIp(r), confirmation.frequency()), confirmation.Nonce,
+		confirmation.expiresAt(subService.confirmationTokenTtl))
+
+	if err != nil || !firstUse {
+		var errorMessage string
+		if _, ok := err.(storage.SuppressedError); ok {
+			logger.Warn("refused to resubscribe suppressed subscriber", logging.Email(emailAddress))
+
+			errorMessage = "This email address can't be subscribed, as emails to it bounced or were reported as spam"
+			metrics.Confirmations.WithLabelValues("suppressed").Inc()
+		} else if err != nil {
+			logger.Error("error saving subscriber", logging.Email(emailAddress), logging.Error(err))
 
-	if subtle.ConstantTimeCompare([]byte(expectedToken), []byte(token[0])) != 1 {
-		log.Printf(
-			"[ERROR] the provided email address '%s' didn't match the details originally registered according to the token\n",
-			emailAddress[0])
+			errorMessage = "Error subscribing to the mailing list"
+			metrics.Confirmations.WithLabelValues("error").Inc()
+		} else {
+			errorMessage = "The confirmation link has already been used"
+			metrics.Confirmations.WithLabelValues("already_used").Inc()
+		}
 
 		session.AddFlash(FlashMessages{
-			"error": "The provided email address and name didn't match the details originally registered, please try again",
+			"error": errorMessage,
 		})
 
 		if err = session.Save(r, w); err != nil {
-			log.Printf("[ERROR] saving session data: %s\n", err)
+			logger.Error("error saving session data", logging.Error(err))
 
 			http.Error(w, fmt.Sprintf("Error saving session data: %s", err),
 				http.StatusInternalServerError)
@@ -322,29 +421,60 @@ func (subService *SubscriptionService) ConfirmSignUp(w http.ResponseWriter, r *h
 		return
 	}
 
-	err = subService.mailHandler.SubscribeEmailToMailingList(emailAddress[0], name[0])
+	subService.addToMailingList(r.Context(), emailAddress, name)
 
-	if err != nil {
-		log.Printf("[ERROR] subscribing email '%s' to the mailing list: %s\n", emailAddress[0], err)
+	metrics.Confirmations.WithLabelValues("confirmed").Inc()
 
-		session.AddFlash(FlashMessages{
-			"error": "Error subscribing to the mailing list",
-		})
+	subService.templates.ExecuteTemplate(w, "confirm.html", map[string]interface{}{
+		"name": name,
+		"emailAddress": emailAddress,
+		"digest": confirmation.frequency() == storage.FrequencyWeeklyDigest,
+	})
+}
 
-		if err = session.Save(r, w); err != nil {
-			log.Printf("[ERROR] saving session data: %s\n", err)
+/// subscribe saves an active subscriber emailed as often as they chose, and adds them to the mail provider's own
+/// mailing list. A suppressed subscriber stays suppressed, returning a SuppressedError.
+func (subService *SubscriptionService) subscribe(ctx context.Context, emailAddress, name, sourceIp string,
+	frequency storage.SubscriberFrequency) error {
+	if err := subService.store.SaveSubscriberUnlessSuppressed(newSubscriber(emailAddress, name, sourceIp, frequency)); err != nil {
+		return err
+	}
 
-			http.Error(w, fmt.Sprintf("Error saving session data: %s", err),
-				http.StatusInternalServerError)
-			return
-		}
+	subService.addToMailingList(ctx, emailAddress, name)
 
-		http.Redirect(w, r, "/", 301)
-		return
+	return nil
+}
+
+/// addToMailingList adds a saved subscriber to the mail provider's own mailing list.
+func (subService *SubscriptionService) addToMailingList(ctx context.Context, emailAddress, name string) {
+	// The local subscriber store is the source of truth, so keeping the provider's own list in sync is best effort
+	err := subService.mailHandler.SubscribeEmailToMailingList(emailAddress, name)
+
+	if err != nil {
+		logging.FromContext(ctx, subService.logger).Warn("error subscribing email to the mail provider's mailing list",
+			logging.Email(emailAddress), logging.Error(err))
 	}
+}
 
-	subService.templates.ExecuteTemplate(w, "confirm.html", map[string]interface{}{
-		"name": name[0],
-		"emailAddress": emailAddress[0],
-	})
+/// newSubscriber creates an active subscriber confirmed now, emailed as often as they chose.
+func newSubscriber(emailAddress, name, sourceIp string, frequency storage.SubscriberFrequency) *storage.Subscriber {
+	return &storage.Subscriber{
+		EmailAddress: emailAddress,
+		Name: name,
+		ConfirmedAt: time.Now().UTC(),
+		SourceIp: sourceIp,
+		Status: storage.SubscriberActive,
+		Frequency: frequency,
+	}
+}
+
+/// remoteIp gets the IP address of the client that made a request.
+func remoteIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
 }
\ No newline at end of file
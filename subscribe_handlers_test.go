@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+func TestSuppressedSubscriberStaysSuppressed(t *testing.T) {
+	const emailAddress = "someone@example.com"
+
+	templates, err := loadTemplates(NewUrlBuilder("https://blog-mailer.example.com"))
+	if err != nil {
+		t.Fatalf("error loading templates: %s", err)
+	}
+
+	mailHandler := &recordingMailHandler{}
+	testService := newTestSubscriptionService(t)
+	subService := NewSubscriptionService(mailHandler, testService.store, templates, testService.hmacSecret, time.Hour,
+		make([]byte, 32), testService.logger)
+
+	err = subService.store.SaveSubscriber(&storage.Subscriber{
+		EmailAddress: emailAddress,
+		Status: storage.SubscriberSuppressed,
+		SuppressionReason: "spam complaint",
+	})
+
+	if err != nil {
+		t.Fatalf("error saving subscriber: %s", err)
+	}
+
+	expectSuppressed := func(t *testing.T) {
+		t.Helper()
+
+		subscriber, err := subService.store.GetSubscriber(emailAddress)
+		if err != nil {
+			t.Fatalf("error reading subscriber: %s", err)
+		}
+
+		if subscriber.Status != storage.SubscriberSuppressed || subscriber.SuppressionReason != "spam complaint" {
+			t.Errorf("expected subscriber to stay suppressed, got %s (%s)", subscriber.Status,
+				subscriber.SuppressionReason)
+		}
+	}
+
+	t.Run("signing up", func(t *testing.T) {
+		form := url.Values{
+			"name": {"Someone"},
+			"email": {emailAddress},
+		}
+
+		r := httptest.NewRequest("POST", "/signup", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+
+		subService.SignUp(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
+		}
+
+		if len(mailHandler.confirmations) != 0 {
+			t.Errorf("expected no confirmation email to be sent, got %v", mailHandler.confirmations)
+		}
+	})
+
+	t.Run("confirming", func(t *testing.T) {
+		token, err := subService.generateEmailConfirmationToken(emailAddress, "Someone", storage.FrequencyEveryPost)
+		if err != nil {
+			t.Fatalf("error generating token: %s", err)
+		}
+
+		r := httptest.NewRequest("GET", "/confirm?"+url.Values{"token": {token}}.Encode(), nil)
+		w := httptest.NewRecorder()
+
+		subService.ConfirmSignUp(w, r)
+
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("expected a redirect back to the sign-up form, got status %d", w.Code)
+		}
+
+		expectSuppressed(t)
+	})
+
+	t.Run("subscribing", func(t *testing.T) {
+		err := subService.subscribe(context.Background(), emailAddress, "Someone", "", storage.FrequencyEveryPost)
+
+		if _, ok := err.(storage.SuppressedError); !ok {
+			t.Errorf("expected a suppressed error, got %v", err)
+		}
+
+		expectSuppressed(t)
+	})
+
+	t.Run("unsubscribing", func(t *testing.T) {
+		if err := subService.unsubscribe(context.Background(), emailAddress); err != nil {
+			t.Fatalf("error unsubscribing: %s", err)
+		}
+
+		expectSuppressed(t)
+	})
+}
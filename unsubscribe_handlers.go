@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/sessions"
+
+	"github.com/mybb/mybb-blog-mailer/logging"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// oneClickUnsubscribeMaxMemory is how much of a multipart one-click unsubscribe request body is held in memory. The
+/// body only has to hold the List-Unsubscribe field.
+const oneClickUnsubscribeMaxMemory = 1 << 16
+
+/// Unsubscribe handles a GET request to /unsubscribe, asking the subscriber to confirm they want to unsubscribe.
+///
+/// Nothing is changed here, as link scanners and mail clients prefetch links found in emails.
+func (subService *SubscriptionService) Unsubscribe(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), subService.logger)
+
+	session, err := subService.sessionStore.Get(r, "blog-mailer-session")
+	if err != nil {
+		logger.Error("error getting session for request", logging.Error(err))
+
+		http.Error(w, fmt.Sprintf("Error getting session for request: %s", err),
+			http.StatusInternalServerError)
+
+		return
+	}
+
+	query := r.URL.Query()
+
+	emailAddress := query.Get("emailAddress")
+	token := query.Get("token")
+
+	if !subService.isValidUnsubscribeRequest(emailAddress, token) {
+		subService.redirectWithError(w, r, session, "The unsubscribe link is invalid, please use the link from the "+
+			"footer of the most recent email you received")
+		return
+	}
+
+	subService.templates.ExecuteTemplate(w, "unsubscribe.html", map[string]interface{}{
+		csrf.TemplateTag: csrf.TemplateField(r),
+		"emailAddress": emailAddress,
+		"token": token,
+	})
+}
+
+/// ConfirmUnsubscribe handles a POST request to /unsubscribe, removing the subscriber from the mailing list.
+func (subService *SubscriptionService) ConfirmUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), subService.logger)
+
+	session, err := subService.sessionStore.Get(r, "blog-mailer-session")
+	if err != nil {
+		logger.Error("error getting session for request", logging.Error(err))
+
+		http.Error(w, fmt.Sprintf("Error getting session for request: %s", err),
+			http.StatusInternalServerError)
+
+		return
+	}
+
+	err = r.ParseForm()
+
+	if err != nil {
+		logger.Error("error parsing form data for unsubscribe request", logging.Error(err))
+
+		http.Error(w, fmt.Sprintf("Error parsing form data for unsubscribe request: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	emailAddress := r.PostForm.Get("emailAddress")
+	token := r.PostForm.Get("token")
+
+	if !subService.isValidUnsubscribeRequest(emailAddress, token) {
+		subService.redirectWithError(w, r, session, "The unsubscribe link is invalid, please use the link from the "+
+			"footer of the most recent email you received")
+		return
+	}
+
+	if err = subService.unsubscribe(r.Context(), emailAddress); err != nil {
+		logger.Error("error unsubscribing email", logging.Email(emailAddress), logging.Error(err))
+
+		subService.redirectWithError(w, r, session, "Error unsubscribing from the mailing list")
+		return
+	}
+
+	subService.templates.ExecuteTemplate(w, "unsubscribed.html", map[string]interface{}{
+		"emailAddress": emailAddress,
+	})
+}
+
+/// OneClickUnsubscribe handles a one-click unsubscribe POST request to /unsubscribe/one-click, as sent by mail clients
+/// for the List-Unsubscribe and List-Unsubscribe-Post headers described in RFC 8058.
+///
+/// The request is made by the mail client or provider rather than by a browser showing our form, so it is exempt
+/// from CSRF protection and is authenticated by the signed token in the URL alone.
+///
+/// RFC 8058 allows the body to be sent as either multipart/form-data or application/x-www-form-urlencoded, and
+/// providers use both.
+func (subService *SubscriptionService) OneClickUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), subService.logger)
+
+	r.Body = http.MaxBytesReader(w, r.Body, oneClickUnsubscribeMaxMemory)
+
+	// A URL encoded body is parsed before the request is found not to be multipart
+	err := r.ParseMultipartForm(oneClickUnsubscribeMaxMemory)
+
+	if err != nil && err != http.ErrNotMultipart {
+		http.Error(w, fmt.Sprintf("Error parsing form data for unsubscribe request: %s", err),
+			http.StatusBadRequest)
+		return
+	}
+
+	// The field must be in the body rather than the query, so that a prefetched link can't unsubscribe anyone
+	if r.PostFormValue("List-Unsubscribe") != "One-Click" {
+		http.Error(w, "Expected a List-Unsubscribe=One-Click request body", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+
+	emailAddress := query.Get("emailAddress")
+
+	if !subService.isValidUnsubscribeRequest(emailAddress, query.Get("token")) {
+		http.Error(w, "Invalid unsubscribe token", http.StatusForbidden)
+		return
+	}
+
+	if err = subService.unsubscribe(r.Context(), emailAddress); err != nil {
+		logger.Error("error unsubscribing email", logging.Email(emailAddress), logging.Error(err))
+
+		http.Error(w, "Error unsubscribing from the mailing list", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte("Unsubscribed"))
+}
+
+/// isValidUnsubscribeRequest checks whether the token from an unsubscribe link was issued for the given email address.
+func (subService *SubscriptionService) isValidUnsubscribeRequest(emailAddress, token string) bool {
+	if len(emailAddress) == 0 || len(token) == 0 {
+		return false
+	}
+
+	expectedToken := generateUnsubscribeToken(subService.hmacSecret, emailAddress)
+
+	return subtle.ConstantTimeCompare([]byte(expectedToken), []byte(token)) == 1
+}
+
+/// unsubscribe marks the subscriber as unsubscribed and removes them from the mail provider's own mailing list. A
+/// suppressed subscriber stays suppressed, as otherwise the reason they mustn't be emailed would be lost.
+func (subService *SubscriptionService) unsubscribe(ctx context.Context, emailAddress string) error {
+	err := subService.store.UpdateSubscriber(emailAddress, func(subscriber *storage.Subscriber) error {
+		if subscriber.Status != storage.SubscriberSuppressed {
+			subscriber.Status = storage.SubscriberUnsubscribed
+		}
+
+		return nil
+	})
+
+	if _, ok := err.(storage.NotFoundError); err != nil && !ok {
+		return err
+	}
+
+	// As when subscribing, the provider's own list is only kept in sync on a best effort basis
+	err = subService.mailHandler.UnsubscribeEmailFromMailingList(emailAddress)
+
+	if err != nil {
+		logging.FromContext(ctx, subService.logger).Warn("error unsubscribing email from the mail provider's mailing list",
+			logging.Email(emailAddress), logging.Error(err))
+	}
+
+	return nil
+}
+
+/// redirectWithError adds an error message to the session and redirects back to the sign-up form to show it.
+func (subService *SubscriptionService) redirectWithError(w http.ResponseWriter, r *http.Request,
+	session *sessions.Session, errorMessage string) {
+	session.AddFlash(FlashMessages{
+		"error": errorMessage,
+	})
+
+	if err := session.Save(r, w); err != nil {
+		logging.FromContext(r.Context(), subService.logger).Error("error saving session data", logging.Error(err))
+
+		http.Error(w, fmt.Sprintf("Error saving session data: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+/// generateUnsubscribeToken signs an email address so that only the recipient of a notification can unsubscribe it.
+func generateUnsubscribeToken(hmacSecret, emailAddress string) string {
+	message := "unsubscribe_" + strings.ToLower(emailAddress)
+
+	key := []byte(hmacSecret)
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(message))
+
+	return base64.URLEncoding.EncodeToString(h.Sum(nil))
+}
+
+/// buildUnsubscribeUrl builds the absolute URL of the unsubscribe page for the given email address.
+func buildUnsubscribeUrl(urls *UrlBuilder, hmacSecret, emailAddress string) (string, error) {
+	return urls.Url("unsubscribe", "emailAddress", emailAddress, "token",
+		generateUnsubscribeToken(hmacSecret, emailAddress))
+}
+
+/// buildOneClickUnsubscribeUrl builds the absolute URL to unsubscribe the given email address with a single POST
+/// request, for use in the List-Unsubscribe header.
+func buildOneClickUnsubscribeUrl(urls *UrlBuilder, hmacSecret, emailAddress string) (string, error) {
+	return urls.Url("one_click_unsubscribe", "emailAddress", emailAddress, "token",
+		generateUnsubscribeToken(hmacSecret, emailAddress))
+}
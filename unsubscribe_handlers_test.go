@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/mail/dryrun"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// newTestSubscriptionService creates a subscription service with an empty store and a dry run mail handler.
+func newTestSubscriptionService(t *testing.T) *SubscriptionService {
+	t.Helper()
+
+	directory := t.TempDir()
+
+	store, err := storage.Open(filepath.Join(directory, "mailer.db"))
+	if err != nil {
+		t.Fatalf("error opening store: %s", err)
+	}
+
+	t.Cleanup(func() {
+		store.Close()
+	})
+
+	logger := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	mailHandler := dryrun.NewHandler(&config.DryRunConfig{
+		Directory: filepath.Join(directory, "emails"),
+	}, logger)
+
+	return &SubscriptionService{
+		mailHandler: mailHandler,
+		store: store,
+		hmacSecret: "secret",
+		logger: logger,
+	}
+}
+
+func TestOneClickUnsubscribe(t *testing.T) {
+	const emailAddress = "someone@example.com"
+
+	multipartBody := func(value string) (string, string) {
+		var body bytes.Buffer
+
+		writer := multipart.NewWriter(&body)
+		writer.WriteField("List-Unsubscribe", value)
+		writer.Close()
+
+		return writer.FormDataContentType(), body.String()
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		token       string
+		status      int
+	}{
+		{
+			name: "url encoded",
+			contentType: "application/x-www-form-urlencoded",
+			body: "List-Unsubscribe=One-Click",
+			status: http.StatusOK,
+		},
+		{
+			name: "multipart",
+			status: http.StatusOK,
+		},
+		{
+			name: "wrong value",
+			contentType: "application/x-www-form-urlencoded",
+			body: "List-Unsubscribe=Two-Click",
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "empty body",
+			contentType: "application/x-www-form-urlencoded",
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "invalid token",
+			contentType: "application/x-www-form-urlencoded",
+			body: "List-Unsubscribe=One-Click",
+			token: "invalid",
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subService := newTestSubscriptionService(t)
+
+			err := subService.store.SaveSubscriber(&storage.Subscriber{
+				EmailAddress: emailAddress,
+				Status: storage.SubscriberActive,
+			})
+
+			if err != nil {
+				t.Fatalf("error saving subscriber: %s", err)
+			}
+
+			contentType, body := test.contentType, test.body
+
+			if len(contentType) == 0 {
+				contentType, body = multipartBody("One-Click")
+			}
+
+			token := test.token
+
+			if len(token) == 0 {
+				token = generateUnsubscribeToken(subService.hmacSecret, emailAddress)
+			}
+
+			query := url.Values{
+				"emailAddress": {emailAddress},
+				"token": {token},
+			}
+
+			r := httptest.NewRequest("POST", "/unsubscribe/one-click?"+query.Encode(), strings.NewReader(body))
+			r.Header.Set("Content-Type", contentType)
+			w := httptest.NewRecorder()
+
+			subService.OneClickUnsubscribe(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, w.Code, w.Body.String())
+			}
+
+			subscriber, err := subService.store.GetSubscriber(emailAddress)
+			if err != nil {
+				t.Fatalf("error getting subscriber: %s", err)
+			}
+
+			expected := storage.SubscriberActive
+
+			if test.status == http.StatusOK {
+				expected = storage.SubscriberUnsubscribed
+			}
+
+			if subscriber.Status != expected {
+				t.Errorf("expected subscriber to be %s, got %s", expected, subscriber.Status)
+			}
+		})
+	}
+}
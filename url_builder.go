@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/url"
+	"regexp"
+
+	"github.com/gorilla/mux"
+)
+
+/// routeVariablePattern matches the variables in the path template of a route, such as `{action:approve|reject}`.
+var routeVariablePattern = regexp.MustCompile(`\{([^{}:]+)(?::[^{}]*)?\}`)
+
+/// UrlBuilder builds the URLs of the named routes of the router, so that links in pages and emails always match the
+/// routes they point to.
+///
+/// The router is set after the templates using the builder are parsed, as the handlers of the routes need the
+/// templates to be created.
+type UrlBuilder struct {
+	baseUrl string
+	router  *mux.Router
+}
+
+/// RouteNotFoundError is returned when building the URL of a route that doesn't exist.
+type RouteNotFoundError struct {
+	Name string
+}
+
+func (e RouteNotFoundError) Error() string {
+	return fmt.Sprintf("no route named '%s'", e.Name)
+}
+
+/// NewUrlBuilder creates a new URL builder making absolute URLs relative to the given base URL.
+func NewUrlBuilder(baseUrl string) *UrlBuilder {
+	return &UrlBuilder{
+		baseUrl: baseUrl,
+	}
+}
+
+/// SetRouter sets the router whose named routes URLs are built for.
+func (builder *UrlBuilder) SetRouter(router *mux.Router) {
+	builder.router = router
+}
+
+/// FuncMap builds the template functions building URLs: `url` builds an absolute URL for use in emails, and `path`
+/// builds the path for use in pages.
+///
+/// Both take the name of the route followed by pairs of keys and values, such as
+/// `{{url "confirm_signup" "token" .token}}`.
+func (builder *UrlBuilder) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"url": builder.Url,
+		"path": builder.Path,
+	}
+}
+
+/// Url builds the absolute URL of a named route, using the public base URL of the mailer.
+func (builder *UrlBuilder) Url(name string, pairs ...string) (string, error) {
+	path, err := builder.Path(name, pairs...)
+
+	if err != nil {
+		return "", err
+	}
+
+	return builder.baseUrl + path, nil
+}
+
+/// Path builds the path of a named route, followed by a query string if needed.
+///
+/// The pairs of keys and values given fill in the variables of the route's path, and any others are added to the
+/// query string, all escaped as needed.
+func (builder *UrlBuilder) Path(name string, pairs ...string) (string, error) {
+	if len(pairs)%2 != 0 {
+		return "", fmt.Errorf("building URL of route '%s': expected pairs of keys and values", name)
+	}
+
+	if builder.router == nil {
+		return "", fmt.Errorf("building URL of route '%s': no router has been set", name)
+	}
+
+	route := builder.router.Get(name)
+
+	if route == nil {
+		return "", RouteNotFoundError{name}
+	}
+
+	pathTemplate, err := route.GetPathTemplate()
+
+	if err != nil {
+		return "", fmt.Errorf("building URL of route '%s': %s", name, err)
+	}
+
+	pathVariables := make(map[string]bool)
+
+	for _, match := range routeVariablePattern.FindAllStringSubmatch(pathTemplate, -1) {
+		pathVariables[match[1]] = true
+	}
+
+	var pathPairs []string
+	query := url.Values{}
+
+	for i := 0; i < len(pairs); i += 2 {
+		if pathVariables[pairs[i]] {
+			pathPairs = append(pathPairs, pairs[i], pairs[i+1])
+		} else {
+			query.Add(pairs[i], pairs[i+1])
+		}
+	}
+
+	path, err := route.URLPath(pathPairs...)
+
+	if err != nil {
+		return "", fmt.Errorf("building URL of route '%s': %s", name, err)
+	}
+
+	if len(query) > 0 {
+		path.RawQuery = query.Encode()
+	}
+
+	return path.String(), nil
+}
@@ -1,126 +1,318 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"time"
 	"fmt"
-	"log"
+	"log/slog"
 	"bytes"
 	"io/ioutil"
 	"os"
 	"html/template"
+	"sort"
+	"sync"
 
-	"github.com/google/go-github/github"
 	"github.com/mmcdole/gofeed"
 
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/jobs"
+	"github.com/mybb/mybb-blog-mailer/logging"
 	"github.com/mybb/mybb-blog-mailer/mail"
+	"github.com/mybb/mybb-blog-mailer/metrics"
+	"github.com/mybb/mybb-blog-mailer/storage"
 )
 
 type WebHookService struct {
 	mailHandler   mail.Handler
+	store         *storage.Store
+	jobQueue      *jobs.Queue
 	templates *template.Template
 	httpClient    *http.Client
-	webHookSecret []byte
+	receivers     []webHookReceiver
+	deliveryRetention time.Duration
+	holdForApproval bool
+	approvalEmailAddress string
+	approvalAutoSendDelay time.Duration
+	/// campaignLock ensures a campaign can't be approved and rejected at the same time.
+	campaignLock  sync.Mutex
+	/// sendLock ensures only one feed check runs at a time, so that concurrent checks can't send the same post twice.
+	sendLock      sync.Mutex
+	triggerRules  []config.TriggerRule
 	xmlFeedUrl    string
 	lastPostDateFilePath string
+	urls          *UrlBuilder
+	hmacSecret    string
+	notificationMode string
+	logger        *slog.Logger
+}
+
+/// feedNotModifiedError is returned when a conditional request for the feed finds that it hasn't changed.
+type feedNotModifiedError struct{}
+
+func (e feedNotModifiedError) Error() string {
+	return "feed not modified"
+}
+
+/// DeliveryFailedError is returned when a notification couldn't be sent to some of the subscribers.
+type DeliveryFailedError struct {
+	Delivered int
+	Failed    int
+}
+
+func (e DeliveryFailedError) Error() string {
+	return fmt.Sprintf("failed to notify %d of %d subscribers", e.Failed, e.Delivered + e.Failed)
+}
+
+/// SendingInterruptedError is returned when sending an email to every subscriber is stopped part way, such as by the
+/// server shutting down. The deliveries made before it stopped are recorded, so a retry carries on where it stopped.
+type SendingInterruptedError struct {
+	Delivered int
+	Failed    int
+	/// Err is why sending was interrupted.
+	Err error
+}
+
+func (e SendingInterruptedError) Error() string {
+	return fmt.Sprintf("interrupted after notifying %d subscribers: %s", e.Delivered + e.Failed, e.Err)
 }
 
 type newBlogPost struct {
+	/// Key identifies the post in the sent post ledger.
+	Key         string
 	Title       string
 	Summary     string
 	Url         string
 	PublishedAt time.Time
 	Author      string
+	/// FirstSeenAt is the time sending the notification for the post was first attempted, if it has been.
+	FirstSeenAt time.Time
 }
 
-func NewWebHookService(mailHandler mail.Handler, templates *template.Template, webHookSecret string, xmlFeedUrl string,
-	lastPostDateFilePath string) (*WebHookService) {
+/// notificationRecipient holds the details of the subscriber a notification is being rendered for.
+type notificationRecipient struct {
+	Name           string
+	EmailAddress   string
+	UnsubscribeUrl string
+}
+
+/// blogPostNotification is the data used to render a new blog post notification for a single subscriber.
+type blogPostNotification struct {
+	*newBlogPost
+	notificationRecipient
+}
+
+/// blogPostsNotification is the data used to render a single notification of several new blog posts.
+type blogPostsNotification struct {
+	Posts []*newBlogPost
+	notificationRecipient
+}
+
+func NewWebHookService(mailHandler mail.Handler, store *storage.Store, jobQueue *jobs.Queue,
+	templates *template.Template, urls *UrlBuilder, configuration *config.Config, lastPostDateFilePath string,
+	logger *slog.Logger) (*WebHookService) {
 	return &WebHookService{
 		mailHandler: mailHandler,
+		store: store,
+		jobQueue: jobQueue,
 		templates: templates,
 		httpClient: &http.Client{
 			Timeout: time.Second * 5,
 		},
-		webHookSecret: []byte(webHookSecret),
-		xmlFeedUrl:    xmlFeedUrl,
+		receivers: newWebHookReceivers(configuration),
+		deliveryRetention: configuration.WebHookDeliveryRetention,
+		triggerRules: configuration.WebHookTriggers,
+		xmlFeedUrl:    configuration.XmlFeedUrl,
 		lastPostDateFilePath: lastPostDateFilePath,
+		urls: urls,
+		hmacSecret: configuration.HmacSecret,
+		notificationMode: configuration.NotificationMode,
+		holdForApproval: configuration.HoldForApproval,
+		approvalEmailAddress: configuration.ApprovalEmailAddress,
+		approvalAutoSendDelay: configuration.ApprovalAutoSendDelay,
+		logger: logger,
 	}
 }
 
-/// Index handles a request to /webhook, handling an incoming web hook request from GitHub.
-func (whService *WebHookService) Index(w http.ResponseWriter, r *http.Request) {
-	payload, err := github.ValidatePayload(r, whService.webHookSecret)
+/// Receive creates a handler for webhook requests to a receiver's route, verifying the request and queueing a feed
+/// check if the event matches one of the configured trigger rules.
+func (whService *WebHookService) Receive(receiver webHookReceiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logging.FromContext(r.Context(), whService.logger).With("receiver", receiver.name)
 
-	if err != nil {
-		errorMessage := fmt.Sprintf("error validating request body: %s", err)
+		if len(receiver.deliveryHeader) > 0 && len(r.Header.Get(receiver.deliveryHeader)) > 0 {
+			logger = logger.With(logging.DeliveryIdKey, r.Header.Get(receiver.deliveryHeader))
+		}
 
-		log.Printf("[ERROR] " + errorMessage + "\n")
+		// Parsing the event may log too, so give it the logger with the delivery ID
+		r = r.WithContext(logging.NewContext(r.Context(), logger))
 
-		http.Error(w, errorMessage, http.StatusBadRequest)
-		return
+		// Every delivery is counted once it has been handled, by the type of event and what was done with it
+		eventType, status := "unknown", "error"
+
+		defer func() {
+			metrics.WebHookEvents.WithLabelValues(receiver.name, eventType, status).Inc()
+		}()
+
+		// Bound the body before anything reads it, as it is read in full before its signature can be checked
+		r.Body = http.MaxBytesReader(w, r.Body, maxWebHookPayloadSize)
+
+		payload, err := receiver.verifier.Verify(r)
+
+		if err != nil {
+			status = "invalid"
+
+			errorMessage := fmt.Sprintf("error validating request body: %s", err)
+
+			logger.Error("error validating request body", logging.Error(err))
+
+			http.Error(w, errorMessage, http.StatusBadRequest)
+			return
+		}
+
+		defer r.Body.Close()
+
+		delivery, firstDelivery, err := whService.recordDelivery(r, receiver)
+
+		if err != nil {
+			logger.Error("error recording webhook delivery", logging.Error(err))
+
+			http.Error(w, "Error recording webhook delivery", http.StatusInternalServerError)
+			return
+		}
+
+		if !firstDelivery {
+			status = "redelivery"
+
+			logger.Debug("ignoring redelivery of webhook delivery")
+
+			fmt.Fprintln(w, "Delivery already received, ignoring")
+			return
+		}
+
+		event, err := receiver.parse(r, payload)
+
+		if err != nil {
+			status = "invalid"
+			errorMessage := fmt.Sprintf("could not parse webhook: %s", err)
+
+			logger.Error("could not parse webhook", logging.Error(err))
+
+			whService.forgetDelivery(logger, delivery)
+
+			http.Error(w, errorMessage, http.StatusBadRequest)
+			return
+		}
+
+		if event == nil {
+			status = string(storage.WebHookDeliveryUnsupported)
+			warningMessage := "unknown event type"
+
+			logger.Warn(warningMessage + " received")
+
+			whService.finishDelivery(logger, delivery, "", storage.WebHookDeliveryUnsupported, 0)
+
+			http.Error(w, warningMessage, http.StatusNotImplemented)
+			return
+		}
+
+		eventType = event.Event
+
+		if !matchesTriggerRules(whService.triggerRules, event) {
+			status = string(storage.WebHookDeliveryIgnored)
+
+			logger.Debug("ignoring event that doesn't match any trigger rule", "event", event.String())
+
+			whService.finishDelivery(logger, delivery, event.String(), storage.WebHookDeliveryIgnored, 0)
+
+			fmt.Fprintln(w, "Event doesn't match any trigger rule, ignoring")
+			return
+		}
+
+		logger.Debug("received event, queueing feed check to send emails", "event", event.String())
+
+		// Check the feed for new posts in the background as senders such as GitHub only wait 10 seconds for a response
+		job, err := whService.jobQueue.Enqueue(checkFeedJobKind, nil)
+
+		if err != nil {
+			logger.Error("error queueing feed check", logging.Error(err))
+
+			whService.forgetDelivery(logger, delivery)
+
+			http.Error(w, "Error queueing feed check", http.StatusInternalServerError)
+			return
+		}
+
+		status = string(storage.WebHookDeliveryQueued)
+
+		logger.Info("queued feed check", "event", event.String(), "job_id", job.Id)
+
+		whService.finishDelivery(logger, delivery, event.String(), storage.WebHookDeliveryQueued, job.Id)
+
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "Queued feed check as job %d\n", job.Id)
 	}
+}
 
-	defer r.Body.Close()
+/// recordDelivery records the delivery ID of a webhook request, returning false if the same delivery was already
+/// received so that redeliveries are acknowledged without checking the feed again.
+///
+/// Requests without a delivery ID are always treated as the first delivery, and a nil delivery is returned for them.
+func (whService *WebHookService) recordDelivery(r *http.Request,
+	receiver webHookReceiver) (*storage.WebHookDelivery, bool, error) {
+	if len(receiver.deliveryHeader) == 0 || len(r.Header.Get(receiver.deliveryHeader)) == 0 {
+		return nil, true, nil
+	}
 
-	event, err := github.ParseWebHook(github.WebHookType(r), payload)
-	if err != nil {
-		errorMessage := fmt.Sprintf("could not parse webhook: %s", err)
+	delivery := &storage.WebHookDelivery{
+		Receiver: receiver.name,
+		Id: r.Header.Get(receiver.deliveryHeader),
+		ReceivedAt: time.Now().UTC(),
+	}
+
+	firstDelivery, err := whService.store.RecordWebHookDelivery(delivery, whService.deliveryRetention)
 
-		log.Printf("[ERROR] " + errorMessage + "\n")
+	return delivery, firstDelivery, err
+}
 
-		http.Error(w, errorMessage, http.StatusBadRequest)
+/// finishDelivery records what was done with a webhook delivery.
+func (whService *WebHookService) finishDelivery(logger *slog.Logger, delivery *storage.WebHookDelivery, event string,
+	outcome storage.WebHookDeliveryOutcome, jobId uint64) {
+	if delivery == nil {
 		return
 	}
 
-	switch e := event.(type) {
-	case *github.PingEvent:
-		log.Println("[DEBUG] received ping event")
-	case *github.PageBuildEvent:
-		switch buildStatus := e.Build.GetStatus(); buildStatus {
-		case "built":
-			log.Println("[DEBUG] received successful page build event, reading feed to send emails")
-
-			// Build was successful, so get the newest post and send email
-			whService.sendMailNotification()
-		case "queued":
-			log.Println("[DEBUG] rceived page build event with queued status")
-		case "building":
-			log.Println("[DEBUG] rceived page build event with building status")
-		case "errored":
-			buildError := e.Build.GetError()
-			buildErrorMessage := ""
-
-			if buildError != nil {
-				buildErrorMessage = buildError.GetMessage()
-			}
+	delivery.Event = event
+	delivery.Outcome = outcome
+	delivery.JobId = jobId
 
-			if len(buildErrorMessage) > 0 {
-				log.Printf("[WARN] received page build event with error message: %s\n")
-			} else {
-				log.Println("[WARN] received page build event with error status but no error message")
-			}
-		default:
-			log.Printf("[WARN] received page build event with unknown build status: %s\n", buildStatus)
-		}
-	default:
-		warningMessage := fmt.Sprintf("unknown event type: %s", github.WebHookType(r))
-
-		log.Printf("[WARN] " + warningMessage + "\n")
+	if err := whService.store.SaveWebHookDelivery(delivery); err != nil {
+		logger.Warn("error recording outcome of webhook delivery", logging.Error(err))
+	}
+}
 
-		http.Error(w, warningMessage, http.StatusNotImplemented)
+/// forgetDelivery forgets a webhook delivery that couldn't be processed, so that it is processed if it is redelivered.
+func (whService *WebHookService) forgetDelivery(logger *slog.Logger, delivery *storage.WebHookDelivery) {
+	if delivery == nil {
 		return
 	}
+
+	if err := whService.store.DeleteWebHookDelivery(delivery); err != nil {
+		logger.Warn("error forgetting webhook delivery", logging.Error(err))
+	}
 }
 
-func (whService *WebHookService) getLastPostDate() (*time.Time, error) {
+/// readLegacyLastPostDate reads the date of the last sent post from the file used before the sent post ledger existed,
+/// returning nil if there is no such file.
+func (whService *WebHookService) readLegacyLastPostDate() (*time.Time, error) {
+	if len(whService.lastPostDateFilePath) == 0 {
+		return nil, nil
+	}
+
 	fileContent, err := ioutil.ReadFile(whService.lastPostDateFilePath)
 
 	if os.IsNotExist(err) {
-		currentTime := time.Now()
-
-		ioutil.WriteFile(whService.lastPostDateFilePath, []byte(currentTime.Format(time.RFC3339)), 0644)
-
-		return &currentTime, nil
+		return nil, nil
 	}
 
 	if err != nil || len(fileContent) == 0 {
@@ -136,105 +328,678 @@ func (whService *WebHookService) getLastPostDate() (*time.Time, error) {
 	return &parsedTime, nil
 }
 
-func (whService *WebHookService) tryGetNewPost() (*newBlogPost, error) {
-	resp, err := whService.httpClient.Get(whService.xmlFeedUrl)
+/// startLedger starts the ledger of sent posts the first time the feed is read, recording every post already in the
+/// feed as skipped so that subscribers aren't sent the whole history of the blog.
+///
+/// If the file used to store the date of the last sent post before the ledger existed is found, posts published
+/// after that date are left to be sent.
+func (whService *WebHookService) startLedger(posts []*newBlogPost) error {
+	startedAt := time.Now()
+
+	legacyLastPostDate, err := whService.readLegacyLastPostDate()
 
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("error reading legacy last post date: %s", err)
 	}
 
-	defer resp.Body.Close()
+	if legacyLastPostDate != nil {
+		startedAt = *legacyLastPostDate
+	}
 
-	feedParser := gofeed.NewParser()
+	var skippedPosts []*storage.SentPost
 
-	feed, err := feedParser.Parse(resp.Body)
+	for _, post := range posts {
+		if !post.PublishedAt.After(startedAt) {
+			skippedPosts = append(skippedPosts, post.toSentPost())
+		}
+	}
+
+	whService.logger.Info("starting sent post ledger, skipping posts already in the feed", "started_at", startedAt,
+		"skipped_posts", len(skippedPosts))
+
+	return whService.store.StartLedger(startedAt, skippedPosts)
+}
+
+/// tryGetNewPosts reads the feed and returns every post that subscribers haven't been notified of yet, oldest first,
+/// along with the state of the feed to save once they are handled. If the state of the last check is given, the feed
+/// is only read if it has changed since, returning a feedNotModifiedError if it hasn't.
+///
+/// Posts are identified by their GUID (or their link if they have none) rather than their publish date, so back-dated
+/// and re-dated posts are neither skipped nor sent twice. Posts whose notification failed for some subscribers are
+/// returned again so that it can be retried for them.
+func (whService *WebHookService) tryGetNewPosts(state *storage.FeedState) ([]*newBlogPost, *storage.FeedState, error) {
+	feedPosts, state, err := whService.readFeedPosts(state)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if len(feed.Items) == 0 {
-		return nil, nil
+	ledgerStartedAt, err := whService.store.GetLedgerStartedAt()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ledgerStartedAt == nil {
+		if err = whService.startLedger(feedPosts); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	lastPostDate, err := whService.getLastPostDate()
+	var newPosts []*newBlogPost
+
+	for _, post := range feedPosts {
+		sentPost, err := whService.store.GetSentPost(post.Key)
+
+		if _, ok := err.(storage.NotFoundError); ok {
+			newPosts = append(newPosts, post)
+
+			continue
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if sentPost.Status == storage.SentPostSending || sentPost.Status == storage.SentPostFailed {
+			post.FirstSeenAt = sentPost.FirstSeenAt
+
+			newPosts = append(newPosts, post)
+		}
+	}
+
+	sort.SliceStable(newPosts, func(i, j int) bool {
+		return newPosts[i].PublishedAt.Before(newPosts[j].PublishedAt)
+	})
+
+	return newPosts, state, nil
+}
+
+/// readFeedPosts reads every post in the feed, in the order they appear in it, along with the state of the feed. If
+/// the state of the last check is given, the feed is only read if it has changed since.
+func (whService *WebHookService) readFeedPosts(state *storage.FeedState) ([]*newBlogPost, *storage.FeedState, error) {
+	startedAt := time.Now()
+
+	feed, state, err := whService.fetchFeed(state)
+
+	metrics.FeedFetchDuration.Observe(time.Since(startedAt).Seconds())
+
+	if _, ok := err.(feedNotModifiedError); ok {
+		return nil, nil, err
+	}
 
 	if err != nil {
-		return nil, err
+		metrics.FeedFetchErrors.Inc()
+
+		return nil, nil, err
 	}
 
-	// We only check the most recent post
+	var feedPosts []*newBlogPost
 
-	mostRecentPost := feed.Items[0]
+	for _, item := range feed.Items {
+		post := newBlogPostFromFeedItem(item)
 
-	if lastPostDate != nil && (mostRecentPost.PublishedParsed == nil || !mostRecentPost.PublishedParsed.After(*lastPostDate)) {
-		return nil, nil
+		if len(post.Key) == 0 {
+			whService.logger.Warn("ignoring post without a GUID or link", "title", item.Title)
+
+			continue
+		}
+
+		feedPosts = append(feedPosts, post)
+	}
+
+	return feedPosts, state, nil
+}
+
+/// fetchFeed fetches and parses the feed, along with its state holding the validators of the response.
+///
+/// If the state of the last check is given, the request is made conditional using its ETag and Last-Modified
+/// validators, returning a feedNotModifiedError if the feed hasn't changed since, so that checking an unchanged feed
+/// is cheap for both sides.
+func (whService *WebHookService) fetchFeed(state *storage.FeedState) (*gofeed.Feed, *storage.FeedState, error) {
+	req, err := http.NewRequest(http.MethodGet, whService.xmlFeedUrl, nil)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if state != nil {
+		if len(state.ETag) > 0 {
+			req.Header.Set("If-None-Match", state.ETag)
+		}
+
+		if len(state.LastModified) > 0 {
+			req.Header.Set("If-Modified-Since", state.LastModified)
+		}
+	}
+
+	resp, err := whService.httpClient.Do(req)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && state != nil {
+		return nil, nil, feedNotModifiedError{}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, fmt.Errorf("unexpected response status fetching feed: %s", resp.Status)
+	}
+
+	feedParser := gofeed.NewParser()
+
+	feed, err := feedParser.Parse(resp.Body)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return feed, &storage.FeedState{
+		Url: whService.xmlFeedUrl,
+		ETag: resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		CheckedAt: time.Now().UTC(),
+	}, nil
+}
+
+/// newBlogPostFromFeedItem converts an item from the feed to a blog post.
+func newBlogPostFromFeedItem(item *gofeed.Item) *newBlogPost {
+	key := item.GUID
+
+	if len(key) == 0 {
+		key = item.Link
+	}
+
+	var publishedAt time.Time
+
+	if item.PublishedParsed != nil {
+		publishedAt = *item.PublishedParsed
+	} else if item.UpdatedParsed != nil {
+		publishedAt = *item.UpdatedParsed
+	} else {
+		// Without a date the best we can do is assume the post was published just now
+		publishedAt = time.Now()
 	}
 
 	author := ""
 
-	if mostRecentPost.Author != nil {
-		author = mostRecentPost.Author.Name
+	if item.Author != nil {
+		author = item.Author.Name
 	}
 
 	return &newBlogPost{
-		Title:       mostRecentPost.Title,
-		Summary:     mostRecentPost.Description,
-		Url:         mostRecentPost.Link,
-		PublishedAt: *mostRecentPost.PublishedParsed,
+		Key:         key,
+		Title:       item.Title,
+		Summary:     item.Description,
+		Url:         item.Link,
+		PublishedAt: publishedAt,
 		Author:      author,
-	}, nil
+	}
+}
+
+/// toSentPost creates a new ledger entry for the post.
+func (post *newBlogPost) toSentPost() *storage.SentPost {
+	return &storage.SentPost{
+		Key:         post.Key,
+		Title:       post.Title,
+		Url:         post.Url,
+		Summary:     post.Summary,
+		Author:      post.Author,
+		PublishedAt: post.PublishedAt,
+	}
 }
 
-func (whService *WebHookService) sendMailNotification() {
-	newBlogPost, err := whService.tryGetNewPost()
+/// checkFeedJobKind is the kind of job that checks the feed and notifies subscribers of any new posts.
+const checkFeedJobKind = "check_feed"
+
+/// CheckFeed handles a queued job to check the feed, returning an error if it should be retried.
+func (whService *WebHookService) CheckFeed(ctx context.Context, job *storage.Job) error {
+	return whService.sendMailNotification(ctx)
+}
+
+/// sendMailNotification checks the feed for new posts and notifies subscribers of them, or holds them for approval
+/// if approval is required. The feed is only read if it has changed since the last successful check, using the
+/// validators of the response it read.
+///
+/// An error is returned if the feed couldn't be read, any notification failed or sending was interrupted by the context
+/// being cancelled, in which case running it again retries the failed notifications without sending the successful
+/// ones twice.
+func (whService *WebHookService) sendMailNotification(ctx context.Context) error {
+	whService.sendLock.Lock()
+	defer whService.sendLock.Unlock()
+
+	previousState, err := whService.store.GetFeedState(whService.xmlFeedUrl)
 
 	if err != nil {
-		log.Printf("[ERROR] unable to get new blog post: %s\n", err)
+		return fmt.Errorf("error reading feed state: %s", err)
+	}
 
-		return
+	newBlogPosts, state, err := whService.tryGetNewPosts(previousState)
+
+	if _, ok := err.(feedNotModifiedError); ok {
+		whService.logger.Debug("feed not modified since it was last checked")
+
+		previousState.CheckedAt = time.Now().UTC()
+
+		return whService.store.SaveFeedState(previousState)
 	}
 
-	if newBlogPost == nil {
-		log.Println("[DEBUG] no new blog post found")
+	if err != nil {
+		return fmt.Errorf("unable to get new blog posts: %s", err)
+	}
 
-		return
+	if err = whService.handleNewPosts(ctx, newBlogPosts); err != nil {
+		return err
+	}
+
+	// Only remember the validators once the posts are handled, so that a failed check reads the feed again when retried
+	return whService.store.SaveFeedState(state)
+}
+
+/// handleNewPosts notifies subscribers of new posts, or holds them for approval if approval is required.
+func (whService *WebHookService) handleNewPosts(ctx context.Context, newBlogPosts []*newBlogPost) error {
+	if len(newBlogPosts) == 0 {
+		whService.logger.Debug("no new blog post found")
+
+		return nil
+	}
+
+	whService.logger.Debug("found new blog posts", "posts", len(newBlogPosts))
+
+	if whService.holdForApproval {
+		var unseenPosts, retriedPosts []*newBlogPost
+
+		// Posts whose sending was already attempted were approved before, so only retry them
+		for _, post := range newBlogPosts {
+			if post.FirstSeenAt.IsZero() {
+				unseenPosts = append(unseenPosts, post)
+			} else {
+				retriedPosts = append(retriedPosts, post)
+			}
+		}
+
+		if len(unseenPosts) > 0 {
+			if err := whService.holdPostsForApproval(unseenPosts); err != nil {
+				return fmt.Errorf("holding new blog posts for approval: %s", err)
+			}
+		}
+
+		newBlogPosts = retriedPosts
+	}
+
+	return whService.notifyOfPosts(ctx, newBlogPosts)
+}
+
+/// notification is an email to be sent to every subscriber about one or more blog posts.
+type notification struct {
+	posts        []*newBlogPost
+	subject      string
+	templateName string
+	/// buildData builds the data to render the template with for a subscriber.
+	buildData func(recipient notificationRecipient) interface{}
+}
+
+/// planNotifications decides which notifications to send for the given posts, depending on the notification mode.
+func (whService *WebHookService) planNotifications(posts []*newBlogPost) []*notification {
+	if whService.notificationMode == "combined" && len(posts) > 1 {
+		return []*notification{{
+			posts: posts,
+			subject: fmt.Sprintf("%d New MyBB Blog Posts", len(posts)),
+			templateName: "emails/blog_posts_notification",
+			buildData: func(recipient notificationRecipient) interface{} {
+				return &blogPostsNotification{
+					Posts: posts,
+					notificationRecipient: recipient,
+				}
+			},
+		}}
+	}
+
+	notifications := make([]*notification, len(posts))
+
+	for i, post := range posts {
+		post := post
+
+		notifications[i] = &notification{
+			posts: []*newBlogPost{post},
+			subject: "New MyBB Blog Post: " + post.Title,
+			templateName: "emails/blog_post_notification",
+			buildData: func(recipient notificationRecipient) interface{} {
+				return &blogPostNotification{
+					newBlogPost: post,
+					notificationRecipient: recipient,
+				}
+			},
+		}
+	}
+
+	return notifications
+}
+
+/// notifyOfPosts sends the notifications for the given posts to every subscriber, stopping once the context is
+/// cancelled.
+func (whService *WebHookService) notifyOfPosts(ctx context.Context, posts []*newBlogPost) error {
+	var lastErr error
+
+	for _, notification := range whService.planNotifications(posts) {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("interrupted before sending notification '%s': %s", notification.subject, err)
+		}
+
+		whService.logger.Debug("sending notification", "subject", notification.subject, "posts",
+			len(notification.posts))
+
+		err := whService.notifySubscribers(ctx, notification)
+
+		if err == nil {
+			continue
+		}
+
+		lastErr = fmt.Errorf("sending notification '%s': %s", notification.subject, err)
+
+		if failedErr, ok := err.(DeliveryFailedError); !ok || failedErr.Delivered == 0 {
+			// The mail provider is most likely down, so leave the remaining posts for the retry
+			return lastErr
+		}
+	}
+
+	return lastErr
+}
+
+/// notifySubscribers sends a notification to every active subscriber.
+///
+/// The result for each subscriber is recorded in the ledger against every one of the posts. Subscribers that were
+/// already sent the notification for all of the posts by an earlier attempt are skipped, as are subscribers that
+/// signed up after the first attempt and subscribers sent weekly digests instead.
+///
+/// The context is checked between subscribers, and if it is cancelled, the deliveries made so far are recorded, the
+/// posts are marked as failed so that they are retried, and a SendingInterruptedError is returned. Otherwise, a
+/// DeliveryFailedError is returned if the notification couldn't be sent to every subscriber.
+func (whService *WebHookService) notifySubscribers(ctx context.Context, notification *notification) error {
+	posts := notification.posts
+	subject := notification.subject
+	sentPosts := make([]*storage.SentPost, len(posts))
+
+	for i, post := range posts {
+		sentPosts[i] = post.toSentPost()
+		sentPosts[i].Status = storage.SentPostSending
+
+		// A post that was held for approval or is being retried keeps the time it was first seen, so that subscribers
+		// who signed up since aren't sent it, and the time it was first sent, so that it stays in the same digest
+		previousSentPost, err := whService.store.GetSentPost(post.Key)
+
+		if err == nil {
+			if post.FirstSeenAt.IsZero() {
+				post.FirstSeenAt = previousSentPost.FirstSeenAt
+			}
+
+			sentPosts[i].FirstSentAt = previousSentPost.FirstSentAt
+		} else if _, ok := err.(storage.NotFoundError); !ok {
+			return fmt.Errorf("error reading post '%s' from the ledger: %s", post.Title, err)
+		}
+
+		if post.FirstSeenAt.IsZero() {
+			post.FirstSeenAt = time.Now().UTC()
+		}
+
+		sentPosts[i].FirstSeenAt = post.FirstSeenAt
+
+		if err := whService.store.SaveSentPost(sentPosts[i]); err != nil {
+			return fmt.Errorf("error recording post '%s' in the ledger: %s", post.Title, err)
+		}
+	}
+
+	subscribers, err := whService.store.ListSubscribers(storage.SubscriberActive)
+
+	if err != nil {
+		return fmt.Errorf("error listing subscribers to notify: %s", err)
+	}
+
+	var tally deliveryTally
+	var interruptErr error
+
+	for _, subscriber := range subscribers {
+		if interruptErr = ctx.Err(); interruptErr != nil {
+			break
+		}
+
+		if subscriber.WantsDigest() || subscriber.ConfirmedAt.After(posts[0].FirstSeenAt) {
+			continue
+		}
+
+		previousDelivery, err := whService.previousDelivery(posts, subscriber.EmailAddress)
+
+		if err != nil {
+			return fmt.Errorf("error reading ledger: %s", err)
+		}
+
+		if previousDelivery != nil && previousDelivery.Settled() {
+			tally.add(previousDelivery)
+
+			continue
+		}
+
+		sentMessage, err := whService.notifySubscriber(&subscriber, notification)
+
+		delivery := newDelivery(previousDelivery, subscriber.EmailAddress, sentMessage, err)
+
+		if err != nil {
+			whService.logDeliveryFailure("notification", subject, delivery, err)
+		}
+
+		tally.add(delivery)
+
+		for _, post := range posts {
+			if err = whService.store.RecordDelivery(post.Key, delivery); err != nil {
+				whService.logger.Warn("error recording delivery", "post", post.Title,
+					logging.Email(subscriber.EmailAddress), logging.Error(err))
+			}
+		}
+	}
+
+	if interruptErr != nil {
+		whService.logger.Warn("interrupted sending notification", "subject", subject, "delivered", tally.delivered,
+			"failed", tally.failed, logging.Error(interruptErr))
 	} else {
-		log.Printf("[DEBUG] found new blog post: %+v\n", *newBlogPost)
+		whService.logger.Info("sent notification", "subject", subject, "delivered", tally.delivered, "failed",
+			tally.failed, "retrying", tally.retrying)
 	}
 
-	var plainTextContentBuffer bytes.Buffer
+	for _, sentPost := range sentPosts {
+		sentPost.SentAt = time.Now().UTC()
+
+		if sentPost.FirstSentAt.IsZero() {
+			sentPost.FirstSentAt = sentPost.SentAt
+		}
+
+		sentPost.Delivered = tally.delivered
+		sentPost.Failed = tally.failed
+
+		// Failures that won't be retried don't hold the post back, or it would be retried for nothing forever
+		if tally.retrying > 0 || interruptErr != nil {
+			sentPost.Status = storage.SentPostFailed
+		} else {
+			sentPost.Status = storage.SentPostSent
+		}
+
+		if err = whService.store.SaveSentPost(sentPost); err != nil {
+			whService.logger.Warn("error recording post in the ledger", "post", sentPost.Title, "status",
+				sentPost.Status, logging.Error(err))
+		}
+	}
+
+	if interruptErr != nil {
+		return tally.interrupted(interruptErr)
+	}
+
+	return tally.err()
+}
 
-	err = whService.templates.ExecuteTemplate(&plainTextContentBuffer, "emails/blog_post_notification.txt", newBlogPost)
+/// previousDelivery finds the result of the last attempt to send the notification for the given posts to a
+/// subscriber, returning nil if it wasn't sent to them for every one of the posts. If it failed for any of the posts,
+/// that failure is returned.
+func (whService *WebHookService) previousDelivery(posts []*newBlogPost, emailAddress string) (*storage.Delivery,
+	error) {
+	var previous *storage.Delivery
+
+	for _, post := range posts {
+		delivery, err := whService.store.GetDelivery(post.Key, emailAddress)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if delivery == nil {
+			return nil, nil
+		}
+
+		if previous == nil || !delivery.Succeeded() {
+			previous = delivery
+		}
+	}
+
+	return previous, nil
+}
+
+/// newDelivery records the result of an attempt to send an email to a subscriber, counting any earlier attempts.
+func newDelivery(previous *storage.Delivery, emailAddress string, sentMessage mail.SentMessage,
+	err error) *storage.Delivery {
+	delivery := &storage.Delivery{
+		EmailAddress: emailAddress,
+		MessageId: sentMessage.Id,
+		Provider: sentMessage.Provider,
+		Attempts: 1,
+		AttemptedAt: time.Now().UTC(),
+	}
+
+	if previous != nil {
+		delivery.Attempts += previous.Attempts
+	}
 
 	if err != nil {
-		log.Printf("[ERROR] unable to create plaintext email content: %s\n", err)
+		delivery.Error = err.Error()
+		delivery.Permanent = mail.IsPermanent(err)
+	}
+
+	return delivery
+}
+
+/// logDeliveryFailure logs a failure to send an email to a subscriber, saying whether it will be retried.
+func (whService *WebHookService) logDeliveryFailure(kind, subject string, delivery *storage.Delivery, err error) {
+	if delivery.Settled() {
+		whService.logger.Error("error sending "+kind+", giving up on subscriber", "subject", subject,
+			logging.Email(delivery.EmailAddress), "attempts", delivery.Attempts, "permanent", delivery.Permanent,
+			logging.Error(err))
 
 		return
 	}
 
-	var htmlContentBuffer bytes.Buffer
+	whService.logger.Error("error sending "+kind, "subject", subject, logging.Email(delivery.EmailAddress),
+		"attempts", delivery.Attempts, logging.Error(err))
+}
 
-	err = whService.templates.ExecuteTemplate(&htmlContentBuffer, "emails/blog_post_notification.html", newBlogPost)
+/// deliveryTally counts the results of sending an email to every subscriber.
+type deliveryTally struct {
+	delivered int
+	failed    int
+	/// retrying is how many of the failures will be retried.
+	retrying int
+}
 
-	if err != nil {
-		log.Printf("[ERROR] unable to create HTML email content: %s\n", err)
+/// add counts the result of sending the email to a subscriber.
+func (t *deliveryTally) add(delivery *storage.Delivery) {
+	if delivery.Succeeded() {
+		t.delivered++
 
 		return
 	}
 
-	err = whService.mailHandler.SendNotificationToMailingList(newBlogPost.Title, plainTextContentBuffer.String(),
-		htmlContentBuffer.String())
+	t.failed++
+
+	if !delivery.Settled() {
+		t.retrying++
+	}
+}
+
+/// err gets a DeliveryFailedError if sending should be retried for any of the subscribers.
+func (t *deliveryTally) err() error {
+	if t.retrying == 0 {
+		return nil
+	}
+
+	return DeliveryFailedError{
+		Delivered: t.delivered,
+		Failed: t.failed,
+	}
+}
+
+/// interrupted gets a SendingInterruptedError for sending that was stopped part way for the given reason.
+func (t *deliveryTally) interrupted(err error) error {
+	return SendingInterruptedError{
+		Delivered: t.delivered,
+		Failed: t.failed,
+		Err: err,
+	}
+}
+
+/// notifySubscriber renders a notification for a subscriber and sends it to them, returning the message ID and the
+/// mail backend that sent it.
+func (whService *WebHookService) notifySubscriber(subscriber *storage.Subscriber,
+	notification *notification) (mail.SentMessage, error) {
+	unsubscribeUrl, err := buildUnsubscribeUrl(whService.urls, whService.hmacSecret, subscriber.EmailAddress)
 
 	if err != nil {
-		log.Printf("[ERROR] sending blog post notification for post '%s': %s", newBlogPost.Title, err)
-	} else {
-		lastPostDate := newBlogPost.PublishedAt.Format(time.RFC3339)
+		return mail.SentMessage{}, err
+	}
 
-		err = ioutil.WriteFile(whService.lastPostDateFilePath, []byte(lastPostDate), 0644)
+	oneClickUnsubscribeUrl, err := buildOneClickUnsubscribeUrl(whService.urls, whService.hmacSecret,
+		subscriber.EmailAddress)
 
-		if err != nil {
-			log.Printf("[WARN] saving last post date '%s' for '%s': %s\n", lastPostDate, newBlogPost.Title, err)
-		}
+	if err != nil {
+		return mail.SentMessage{}, err
+	}
+
+	textContent, htmlContent, err := whService.renderNotification(notification, notificationRecipient{
+		Name: subscriber.Name,
+		EmailAddress: subscriber.EmailAddress,
+		UnsubscribeUrl: unsubscribeUrl,
+	})
+
+	if err != nil {
+		return mail.SentMessage{}, err
 	}
-}
\ No newline at end of file
+
+	return whService.mailHandler.SendNotificationToSubscriber(subscriber.EmailAddress, oneClickUnsubscribeUrl,
+		notification.subject, textContent, htmlContent)
+}
+
+/// renderNotification renders the plain text and HTML content of a notification for a recipient.
+func (whService *WebHookService) renderNotification(notification *notification,
+	recipient notificationRecipient) (string, string, error) {
+	data := notification.buildData(recipient)
+
+	var plainTextContentBuffer bytes.Buffer
+
+	err := whService.templates.ExecuteTemplate(&plainTextContentBuffer, notification.templateName + ".txt", data)
+
+	if err != nil {
+		metrics.TemplateRenderErrors.WithLabelValues(notification.templateName + ".txt").Inc()
+
+		return "", "", fmt.Errorf("unable to create plaintext email content: %s", err)
+	}
+
+	var htmlContentBuffer bytes.Buffer
+
+	err = whService.templates.ExecuteTemplate(&htmlContentBuffer, notification.templateName + ".html", data)
+
+	if err != nil {
+		metrics.TemplateRenderErrors.WithLabelValues(notification.templateName + ".html").Inc()
+
+		return "", "", fmt.Errorf("unable to create HTML email content: %s", err)
+	}
+
+	return plainTextContentBuffer.String(), htmlContentBuffer.String(), nil
+}
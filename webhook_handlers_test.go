@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/jobs"
+	"github.com/mybb/mybb-blog-mailer/mail"
+	"github.com/mybb/mybb-blog-mailer/storage"
+)
+
+/// recordingMailHandler records the notifications and confirmation emails sent through it, calling afterSend after each
+/// notification.
+type recordingMailHandler struct {
+	sent          []string
+	confirmations []string
+	afterSend     func()
+}
+
+func (h *recordingMailHandler) CheckValidEmail(emailAddress string) (bool, error) {
+	return true, nil
+}
+
+func (h *recordingMailHandler) SendSubscriptionConfirmationEmail(emailAddress string, textContent,
+	htmlContent string) error {
+	h.confirmations = append(h.confirmations, emailAddress)
+
+	return nil
+}
+
+func (h *recordingMailHandler) SubscribeEmailToMailingList(emailAddress, name string) error {
+	return nil
+}
+
+func (h *recordingMailHandler) UnsubscribeEmailFromMailingList(emailAddress string) error {
+	return nil
+}
+
+func (h *recordingMailHandler) SendAdminEmail(emailAddress, subject string, textContent, htmlContent string) error {
+	return nil
+}
+
+func (h *recordingMailHandler) SendNotificationToSubscriber(emailAddress, unsubscribeUrl, subject string,
+	textContent, htmlContent string) (mail.SentMessage, error) {
+	h.sent = append(h.sent, emailAddress)
+
+	if h.afterSend != nil {
+		h.afterSend()
+	}
+
+	return mail.SentMessage{
+		Id: "<" + emailAddress + ">",
+		Provider: "test",
+	}, nil
+}
+
+func (h *recordingMailHandler) Ping() error {
+	return nil
+}
+
+func TestNotifySubscribersInterrupted(t *testing.T) {
+	store := newTestSubscriptionService(t).store
+	logger := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	configuration := &config.Config{
+		BaseUrl: "https://blog-mailer.example.com",
+		HmacSecret: "secret",
+		NotificationMode: "each",
+	}
+
+	urls := NewUrlBuilder(configuration.BaseUrl)
+	templates, err := loadTemplates(urls)
+	if err != nil {
+		t.Fatalf("error loading templates: %s", err)
+	}
+
+	mailHandler := &recordingMailHandler{}
+	whService := NewWebHookService(mailHandler, store, jobs.NewQueue(store, configuration, logger), templates, urls,
+		configuration, filepath.Join(t.TempDir(), "last_post_date"), logger)
+	urls.SetRouter(newRouter(&SubscriptionService{}, whService, nil, nil, nil, nil))
+
+	for _, emailAddress := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		err := store.SaveSubscriber(&storage.Subscriber{
+			EmailAddress: emailAddress,
+			Status: storage.SubscriberActive,
+			ConfirmedAt: time.Now().Add(-time.Hour),
+		})
+
+		if err != nil {
+			t.Fatalf("error saving subscriber: %s", err)
+		}
+	}
+
+	post := &newBlogPost{
+		Key: "post",
+		Title: "Post",
+		Url: "https://blog.example.com/post",
+		PublishedAt: time.Now(),
+	}
+	notification := whService.planNotifications([]*newBlogPost{post})[0]
+
+	// Interrupt sending once the first subscriber has been notified
+	ctx, cancel := context.WithCancel(context.Background())
+	mailHandler.afterSend = cancel
+
+	err = whService.notifySubscribers(ctx, notification)
+
+	if interruptedErr, ok := err.(SendingInterruptedError); !ok || interruptedErr.Delivered != 1 {
+		t.Fatalf("expected sending to be interrupted after 1 delivery, got %v", err)
+	}
+
+	sentPost, err := store.GetSentPost(post.Key)
+	if err != nil {
+		t.Fatalf("error reading sent post: %s", err)
+	}
+
+	if sentPost.Status != storage.SentPostFailed || sentPost.Delivered != 1 {
+		t.Errorf("expected the post to be recorded as failed with 1 delivery, got %s with %d", sentPost.Status,
+			sentPost.Delivered)
+	}
+
+	deliveries, err := store.ListDeliveries(post.Key)
+	if err != nil {
+		t.Fatalf("error listing deliveries: %s", err)
+	}
+
+	if len(deliveries) != 1 {
+		t.Errorf("expected the delivery made before the interruption to be recorded, got %d", len(deliveries))
+	}
+
+	// Retrying carries on with the subscribers that weren't notified
+	mailHandler.afterSend = nil
+
+	if err = whService.notifySubscribers(context.Background(), notification); err != nil {
+		t.Fatalf("error retrying notification: %s", err)
+	}
+
+	if len(mailHandler.sent) != 3 {
+		t.Errorf("expected every subscriber to be notified once, got %v", mailHandler.sent)
+	}
+
+	if sentPost, err = store.GetSentPost(post.Key); err != nil {
+		t.Fatalf("error reading sent post: %s", err)
+	}
+
+	if sentPost.Status != storage.SentPostSent || sentPost.Delivered != 3 {
+		t.Errorf("expected the post to be recorded as sent with 3 deliveries, got %s with %d", sentPost.Status,
+			sentPost.Delivered)
+	}
+}
+
+/// testFeed is a feed served over HTTP, recording the conditional headers of each request for it.
+type testFeed struct {
+	lock         sync.Mutex
+	items        []string
+	etag         string
+	lastModified string
+	status       int
+	requests     []http.Header
+}
+
+func (f *testFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.requests = append(f.requests, r.Header.Clone())
+
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+
+		return
+	}
+
+	if len(f.etag) > 0 {
+		w.Header().Set("ETag", f.etag)
+
+		if r.Header.Get("If-None-Match") == f.etag {
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+	}
+
+	if len(f.lastModified) > 0 {
+		w.Header().Set("Last-Modified", f.lastModified)
+	}
+
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><rss version="2.0"><channel><title>MyBB Blog</title>`)
+
+	for _, item := range f.items {
+		fmt.Fprintf(w, `<item><title>%s</title><link>https://blog.example.com/%s</link><guid>%s</guid>`+
+			`<pubDate>%s</pubDate></item>`, item, item, item, time.Now().Format(time.RFC1123Z))
+	}
+
+	fmt.Fprint(w, `</channel></rss>`)
+}
+
+/// update changes how the feed is served.
+func (f *testFeed) update(change func()) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	change()
+}
+
+/// lastRequest gets the conditional headers of the last request for the feed.
+func (f *testFeed) lastRequest() (string, string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	header := f.requests[len(f.requests)-1]
+
+	return header.Get("If-None-Match"), header.Get("If-Modified-Since")
+}
+
+func TestConditionalFeedCheck(t *testing.T) {
+	store := newTestSubscriptionService(t).store
+	logger := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	feed := &testFeed{
+		items: []string{"first"},
+		etag: `"v1"`,
+		lastModified: "Mon, 12 Oct 2026 10:00:00 GMT",
+	}
+
+	server := httptest.NewServer(feed)
+	defer server.Close()
+
+	configuration := &config.Config{
+		BaseUrl: "https://blog-mailer.example.com",
+		HmacSecret: "secret",
+		NotificationMode: "each",
+		XmlFeedUrl: server.URL,
+	}
+
+	urls := NewUrlBuilder(configuration.BaseUrl)
+	templates, err := loadTemplates(urls)
+	if err != nil {
+		t.Fatalf("error loading templates: %s", err)
+	}
+
+	mailHandler := &recordingMailHandler{}
+	whService := NewWebHookService(mailHandler, store, jobs.NewQueue(store, configuration, logger), templates, urls,
+		configuration, filepath.Join(t.TempDir(), "last_post_date"), logger)
+	urls.SetRouter(newRouter(&SubscriptionService{}, whService, nil, nil, nil, nil))
+
+	err = store.SaveSubscriber(&storage.Subscriber{
+		EmailAddress: "someone@example.com",
+		Status: storage.SubscriberActive,
+		ConfirmedAt: time.Now().Add(-time.Hour),
+	})
+
+	if err != nil {
+		t.Fatalf("error saving subscriber: %s", err)
+	}
+
+	check := func(t *testing.T) *storage.FeedState {
+		t.Helper()
+
+		if err := whService.CheckFeed(context.Background(), &storage.Job{}); err != nil {
+			t.Fatalf("error checking feed: %s", err)
+		}
+
+		state, err := store.GetFeedState(server.URL)
+		if err != nil || state == nil {
+			t.Fatalf("expected the feed state to be saved, got %v", err)
+		}
+
+		return state
+	}
+
+	var lastState *storage.FeedState
+
+	t.Run("200 with validators", func(t *testing.T) {
+		state := check(t)
+
+		if etag, lastModified := feed.lastRequest(); len(etag) > 0 || len(lastModified) > 0 {
+			t.Errorf("expected the first request to be unconditional, got '%s' and '%s'", etag, lastModified)
+		}
+
+		if state.ETag != `"v1"` || state.LastModified != "Mon, 12 Oct 2026 10:00:00 GMT" {
+			t.Errorf("expected the validators of the response to be saved, got %+v", state)
+		}
+
+		lastState = state
+	})
+
+	t.Run("304", func(t *testing.T) {
+		state := check(t)
+
+		if etag, lastModified := feed.lastRequest(); etag != `"v1"` || lastModified != "Mon, 12 Oct 2026 10:00:00 GMT" {
+			t.Errorf("expected the request to be conditional, got '%s' and '%s'", etag, lastModified)
+		}
+
+		if state.ETag != `"v1"` || !state.CheckedAt.After(lastState.CheckedAt) {
+			t.Errorf("expected the validators to be kept and the check time updated, got %+v", state)
+		}
+
+		lastState = state
+	})
+
+	t.Run("failed fetch", func(t *testing.T) {
+		feed.update(func() {
+			feed.status = http.StatusInternalServerError
+		})
+
+		if err := whService.CheckFeed(context.Background(), &storage.Job{}); err == nil {
+			t.Fatalf("expected the check to fail")
+		}
+
+		feed.update(func() {
+			feed.status = 0
+		})
+
+		state, err := store.GetFeedState(server.URL)
+
+		if err != nil || state.ETag != `"v1"` || !state.CheckedAt.Equal(lastState.CheckedAt) {
+			t.Errorf("expected the feed state to be unchanged, got %+v (%v)", state, err)
+		}
+	})
+
+	t.Run("200 with new validators", func(t *testing.T) {
+		feed.update(func() {
+			feed.items = append(feed.items, "second")
+			feed.etag = `"v2"`
+		})
+
+		state := check(t)
+
+		if len(mailHandler.sent) != 1 {
+			t.Errorf("expected the subscriber to be notified of the new post, got %v", mailHandler.sent)
+		}
+
+		if state.ETag != `"v2"` {
+			t.Errorf("expected the new validators to be saved, got %+v", state)
+		}
+	})
+
+	t.Run("200 without validators", func(t *testing.T) {
+		feed.update(func() {
+			feed.items = append(feed.items, "third")
+			feed.etag = ""
+			feed.lastModified = ""
+		})
+
+		state := check(t)
+
+		if len(mailHandler.sent) != 2 {
+			t.Errorf("expected the subscriber to be notified of the new post, got %v", mailHandler.sent)
+		}
+
+		if len(state.ETag) > 0 || len(state.LastModified) > 0 {
+			t.Errorf("expected no validators to be saved, got %+v", state)
+		}
+
+		// Without validators, the next check downloads the feed again
+		check(t)
+
+		if etag, lastModified := feed.lastRequest(); len(etag) > 0 || len(lastModified) > 0 {
+			t.Errorf("expected the request to be unconditional, got '%s' and '%s'", etag, lastModified)
+		}
+
+		if len(mailHandler.sent) != 2 {
+			t.Errorf("expected no post to be sent twice, got %v", mailHandler.sent)
+		}
+	})
+}
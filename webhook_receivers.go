@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/github"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+	"github.com/mybb/mybb-blog-mailer/logging"
+)
+
+/// maxWebHookPayloadSize is the largest webhook request body that is read. Deployment events are far smaller, but push
+/// events listing many commits can be large.
+const maxWebHookPayloadSize = 5 << 20
+
+/// webHookVerifier checks that a webhook request was sent by a trusted sender.
+type webHookVerifier interface {
+	/// Verify checks the request is authentic, returning its body if it is.
+	Verify(r *http.Request) ([]byte, error)
+}
+
+/// webHookParser converts the event in a verified webhook request to a deployment event, returning nil if the type of
+/// event isn't supported.
+type webHookParser func(r *http.Request, payload []byte) (*deploymentEvent, error)
+
+/// webHookReceiver handles webhook requests from one kind of sender on its own route.
+type webHookReceiver struct {
+	/// path is the path of the route the receiver handles.
+	path string
+	/// name is the name of the route.
+	name     string
+	/// deliveryHeader is the header holding the unique ID of each delivery, used to recognise redeliveries.
+	deliveryHeader string
+	verifier webHookVerifier
+	parse    webHookParser
+}
+
+/// newWebHookReceivers creates a receiver for every kind of webhook sender that is configured.
+func newWebHookReceivers(configuration *config.Config) []webHookReceiver {
+	var receivers []webHookReceiver
+
+	if configuration.WebHookEnabled {
+		receivers = append(receivers, webHookReceiver{
+			path: "/webhook",
+			name: "webhook",
+			deliveryHeader: "X-GitHub-Delivery",
+			verifier: gitHubVerifier{
+				secret: []byte(configuration.WebHookSecret),
+			},
+			parse: func(r *http.Request, payload []byte) (*deploymentEvent, error) {
+				return parseGitHubEvent(logging.FromContext(r.Context(), slog.Default()), github.WebHookType(r),
+					payload)
+			},
+		})
+	}
+
+	if len(configuration.GitLabWebHookToken) > 0 {
+		receivers = append(receivers, webHookReceiver{
+			path: "/webhook/gitlab",
+			name: "gitlab_webhook",
+			deliveryHeader: "X-Gitlab-Event-UUID",
+			verifier: tokenVerifier{
+				header: "X-Gitlab-Token",
+				token: []byte(configuration.GitLabWebHookToken),
+			},
+			parse: parseGitLabEvent,
+		})
+	}
+
+	if len(configuration.GiteaWebHookSecret) > 0 {
+		receivers = append(receivers, webHookReceiver{
+			path: "/webhook/gitea",
+			name: "gitea_webhook",
+			deliveryHeader: "X-Gitea-Delivery",
+			verifier: hmacSignatureVerifier{
+				header: "X-Gitea-Signature",
+				secret: []byte(configuration.GiteaWebHookSecret),
+			},
+			parse: parseGiteaEvent,
+		})
+	}
+
+	if len(configuration.GenericWebHookSecret) > 0 {
+		receivers = append(receivers, webHookReceiver{
+			path: "/webhook/generic",
+			name: "generic_webhook",
+			deliveryHeader: "X-Delivery-Id",
+			verifier: hmacSignatureVerifier{
+				header: "X-Signature-256",
+				prefix: "sha256=",
+				secret: []byte(configuration.GenericWebHookSecret),
+			},
+			parse: parseGenericEvent,
+		})
+	}
+
+	return receivers
+}
+
+/// gitHubVerifier verifies the signature GitHub sends in the X-Hub-Signature header.
+type gitHubVerifier struct {
+	secret []byte
+}
+
+func (v gitHubVerifier) Verify(r *http.Request) ([]byte, error) {
+	return github.ValidatePayload(r, v.secret)
+}
+
+/// tokenVerifier verifies a shared secret token sent as-is in a header, as GitLab does.
+type tokenVerifier struct {
+	header string
+	token  []byte
+}
+
+func (v tokenVerifier) Verify(r *http.Request) ([]byte, error) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(v.header)), v.token) != 1 {
+		return nil, fmt.Errorf("missing or invalid %s header", v.header)
+	}
+
+	return ioutil.ReadAll(r.Body)
+}
+
+/// hmacSignatureVerifier verifies a hex encoded HMAC-SHA256 signature of the request body sent in a header,
+/// optionally following a prefix.
+type hmacSignatureVerifier struct {
+	header string
+	prefix string
+	secret []byte
+}
+
+func (v hmacSignatureVerifier) Verify(r *http.Request) ([]byte, error) {
+	signatureHeader := r.Header.Get(v.header)
+
+	if len(signatureHeader) == 0 || !strings.HasPrefix(signatureHeader, v.prefix) {
+		return nil, fmt.Errorf("missing or malformed %s header", v.header)
+	}
+
+	signature, err := hex.DecodeString(strings.TrimPrefix(signatureHeader, v.prefix))
+
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s header: %s", v.header, err)
+	}
+
+	payload, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write(payload)
+
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid %s header", v.header)
+	}
+
+	return payload, nil
+}
+
+/// parseGitLabEvent parses the payload of a GitLab webhook event, of which only pipeline events are supported.
+func parseGitLabEvent(r *http.Request, payload []byte) (*deploymentEvent, error) {
+	if r.Header.Get("X-Gitlab-Event") != "Pipeline Hook" {
+		return nil, nil
+	}
+
+	var pipeline struct {
+		ObjectAttributes struct {
+			Name   string `json:"name"`
+			Ref    string `json:"ref"`
+			Status string `json:"status"`
+		} `json:"object_attributes"`
+	}
+
+	if err := json.Unmarshal(payload, &pipeline); err != nil {
+		return nil, err
+	}
+
+	return &deploymentEvent{
+		Event: "gitlab_pipeline",
+		Workflow: pipeline.ObjectAttributes.Name,
+		Branch: pipeline.ObjectAttributes.Ref,
+		Conclusion: pipeline.ObjectAttributes.Status,
+	}, nil
+}
+
+/// parseGiteaEvent parses the payload of a Gitea webhook event, of which only push events are supported.
+func parseGiteaEvent(r *http.Request, payload []byte) (*deploymentEvent, error) {
+	if r.Header.Get("X-Gitea-Event") != "push" {
+		return nil, nil
+	}
+
+	var push struct {
+		Ref string `json:"ref"`
+	}
+
+	if err := json.Unmarshal(payload, &push); err != nil {
+		return nil, err
+	}
+
+	return &deploymentEvent{
+		Event: "gitea_push",
+		Branch: strings.TrimPrefix(push.Ref, "refs/heads/"),
+	}, nil
+}
+
+/// parseGenericEvent parses the payload of a generic webhook event, being an optional JSON object with the same
+/// fields as a trigger rule, such as `{"branch": "main", "conclusion": "success"}`.
+func parseGenericEvent(r *http.Request, payload []byte) (*deploymentEvent, error) {
+	var details struct {
+		Workflow    string `json:"workflow"`
+		Branch      string `json:"branch"`
+		Conclusion  string `json:"conclusion"`
+		Environment string `json:"environment"`
+	}
+
+	if len(strings.TrimSpace(string(payload))) > 0 {
+		if err := json.Unmarshal(payload, &details); err != nil {
+			return nil, err
+		}
+	}
+
+	return &deploymentEvent{
+		Event: "generic",
+		Workflow: details.Workflow,
+		Branch: details.Branch,
+		Conclusion: details.Conclusion,
+		Environment: details.Environment,
+	}, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testPayload = `{"branch":"main"}`
+
+/// sign gets the hex encoded HMAC of the test payload.
+func sign(hashFunc func() hash.Hash, secret string) string {
+	mac := hmac.New(hashFunc, []byte(secret))
+	mac.Write([]byte(testPayload))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebHookVerifiers(t *testing.T) {
+	gitHub := gitHubVerifier{
+		secret: []byte("secret"),
+	}
+	gitLab := tokenVerifier{
+		header: "X-Gitlab-Token",
+		token: []byte("secret"),
+	}
+	generic := hmacSignatureVerifier{
+		header: "X-Signature-256",
+		prefix: "sha256=",
+		secret: []byte("secret"),
+	}
+
+	tests := []struct {
+		name     string
+		verifier webHookVerifier
+		headers  map[string]string
+		valid    bool
+	}{
+		{
+			name: "github sha256",
+			verifier: gitHub,
+			headers: map[string]string{"X-Hub-Signature": "sha256=" + sign(sha256.New, "secret")},
+			valid: true,
+		},
+		{
+			name: "github sha1",
+			verifier: gitHub,
+			headers: map[string]string{"X-Hub-Signature": "sha1=" + sign(sha1.New, "secret")},
+			valid: true,
+		},
+		{
+			name: "github wrong secret",
+			verifier: gitHub,
+			headers: map[string]string{"X-Hub-Signature": "sha1=" + sign(sha1.New, "other")},
+		},
+		{
+			name: "github unsigned",
+			verifier: gitHub,
+		},
+		{
+			name: "gitlab token",
+			verifier: gitLab,
+			headers: map[string]string{"X-Gitlab-Token": "secret"},
+			valid: true,
+		},
+		{
+			name: "gitlab wrong token",
+			verifier: gitLab,
+			headers: map[string]string{"X-Gitlab-Token": "secret2"},
+		},
+		{
+			name: "gitlab missing token",
+			verifier: gitLab,
+		},
+		{
+			name: "hmac signature",
+			verifier: generic,
+			headers: map[string]string{"X-Signature-256": "sha256=" + sign(sha256.New, "secret")},
+			valid: true,
+		},
+		{
+			name: "hmac wrong secret",
+			verifier: generic,
+			headers: map[string]string{"X-Signature-256": "sha256=" + sign(sha256.New, "other")},
+		},
+		{
+			name: "hmac missing prefix",
+			verifier: generic,
+			headers: map[string]string{"X-Signature-256": sign(sha256.New, "secret")},
+		},
+		{
+			name: "hmac not hex",
+			verifier: generic,
+			headers: map[string]string{"X-Signature-256": "sha256=zz"},
+		},
+		{
+			name: "hmac missing",
+			verifier: generic,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/webhook", strings.NewReader(testPayload))
+			r.Header.Set("Content-Type", "application/json")
+
+			for name, value := range test.headers {
+				r.Header.Set(name, value)
+			}
+
+			payload, err := test.verifier.Verify(r)
+
+			if !test.valid {
+				if err == nil {
+					t.Error("expected the request to be rejected")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected the request to be accepted, got %s", err)
+			}
+
+			if string(payload) != testPayload {
+				t.Errorf("expected the payload to be returned, got %s", payload)
+			}
+		})
+	}
+}
+
+func TestWebHookPayloadTooLarge(t *testing.T) {
+	verifier := hmacSignatureVerifier{
+		header: "X-Signature-256",
+		prefix: "sha256=",
+		secret: []byte("secret"),
+	}
+	whService := &WebHookService{
+		logger: slog.New(slog.NewTextHandler(ioutil.Discard, nil)),
+	}
+
+	r := httptest.NewRequest("POST", "/webhook/generic",
+		strings.NewReader(strings.Repeat(" ", maxWebHookPayloadSize+1)))
+	r.Header.Set("X-Signature-256", "sha256="+sign(sha256.New, "secret"))
+	w := httptest.NewRecorder()
+
+	whService.Receive(webHookReceiver{
+		path: "/webhook/generic",
+		name: "generic_webhook",
+		verifier: verifier,
+	})(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a body over the limit to be rejected, got status %d", w.Code)
+	}
+}
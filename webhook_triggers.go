@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/google/go-github/github"
+
+	"github.com/mybb/mybb-blog-mailer/config"
+)
+
+/// deploymentEvent summarises a webhook event that may mean the site was deployed, to be matched against the
+/// trigger rules.
+type deploymentEvent struct {
+	Event       string
+	Workflow    string
+	Branch      string
+	Conclusion  string
+	Environment string
+}
+
+func (event *deploymentEvent) String() string {
+	description := event.Event
+
+	for _, detail := range []struct{ name, value string }{
+		{"workflow", event.Workflow},
+		{"branch", event.Branch},
+		{"conclusion", event.Conclusion},
+		{"environment", event.Environment},
+	} {
+		if len(detail.value) > 0 {
+			description += fmt.Sprintf(" %s=%s", detail.name, detail.value)
+		}
+	}
+
+	return description
+}
+
+/// matchesTriggerRules checks whether an event matches any of the given trigger rules.
+func matchesTriggerRules(rules []config.TriggerRule, event *deploymentEvent) bool {
+	for _, rule := range rules {
+		if rule.Event == event.Event &&
+			matchesCondition(rule.Workflow, event.Workflow) &&
+			matchesCondition(rule.Branch, event.Branch) &&
+			matchesCondition(rule.Conclusion, event.Conclusion) &&
+			matchesCondition(rule.Environment, event.Environment) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/// matchesCondition checks whether a value matches a condition of a trigger rule, where an empty condition matches
+/// anything.
+func matchesCondition(condition, value string) bool {
+	return len(condition) == 0 || condition == value
+}
+
+/// workflowRunEvent holds the parts of a GitHub workflow_run event needed to match trigger rules, as the version of
+/// go-github in use predates GitHub Actions.
+type workflowRunEvent struct {
+	Action      string `json:"action"`
+	WorkflowRun struct {
+		Name       string `json:"name"`
+		HeadBranch string `json:"head_branch"`
+		Conclusion string `json:"conclusion"`
+	} `json:"workflow_run"`
+}
+
+/// parseGitHubEvent parses the payload of a GitHub webhook event, returning nil if the event type isn't supported.
+func parseGitHubEvent(logger *slog.Logger, eventType string, payload []byte) (*deploymentEvent, error) {
+	if eventType == "workflow_run" {
+		var workflowRun workflowRunEvent
+
+		if err := json.Unmarshal(payload, &workflowRun); err != nil {
+			return nil, err
+		}
+
+		event := &deploymentEvent{
+			Event: "workflow_run",
+			Workflow: workflowRun.WorkflowRun.Name,
+			Branch: workflowRun.WorkflowRun.HeadBranch,
+		}
+
+		// Runs that have only been requested or are in progress have no conclusion yet, so can't match a rule
+		// requiring one
+		if workflowRun.Action == "completed" {
+			event.Conclusion = workflowRun.WorkflowRun.Conclusion
+		} else {
+			event.Conclusion = workflowRun.Action
+		}
+
+		return event, nil
+	}
+
+	parsed, err := github.ParseWebHook(eventType, payload)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch e := parsed.(type) {
+	case *github.PingEvent:
+		// Ping events never match a trigger rule, so are acknowledged without doing anything
+		return &deploymentEvent{
+			Event: "ping",
+		}, nil
+	case *github.PageBuildEvent:
+		buildStatus := e.Build.GetStatus()
+
+		if buildStatus == "errored" {
+			buildError := e.Build.GetError()
+			buildErrorMessage := ""
+
+			if buildError != nil {
+				buildErrorMessage = buildError.GetMessage()
+			}
+
+			if len(buildErrorMessage) > 0 {
+				logger.Warn("received page build event with error message", "message", buildErrorMessage)
+			} else {
+				logger.Warn("received page build event with error status but no error message")
+			}
+		}
+
+		return &deploymentEvent{
+			Event: "page_build",
+			Conclusion: buildStatus,
+		}, nil
+	case *github.PushEvent:
+		return &deploymentEvent{
+			Event: "push",
+			Branch: strings.TrimPrefix(e.GetRef(), "refs/heads/"),
+		}, nil
+	case *github.DeploymentStatusEvent:
+		return &deploymentEvent{
+			Event: "deployment_status",
+			Branch: e.Deployment.GetRef(),
+			Conclusion: e.DeploymentStatus.GetState(),
+			Environment: e.Deployment.GetEnvironment(),
+		}, nil
+	default:
+		return nil, nil
+	}
+}